@@ -0,0 +1,126 @@
+package ucenter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+)
+
+// Principal the user authenticated by access token
+type Principal struct {
+	// Tenant of user, empty for default tenant
+	Tenant string
+	// UserName empty if token is issued to client itself
+	UserName string
+	// ClientID oauth client the token issued to, empty if user
+	// login by ucenter itself
+	ClientID string
+	// Session of web site, empty if user has not login by web site
+	Session string
+	// Scopes granted to the access token
+	Scopes []string
+	// Roles of user, include roles inherited
+	Roles []string
+	// Organizations of user and his role in them
+	Organizations []OrganizationMembership
+}
+
+// Authenticate check access token and return the user who own it, so
+// the user name is not needed as CheckAccessToken
+func Authenticate(token string) (*Principal, error) {
+	if len(token) == 0 {
+		return nil, ErrParamInvalid
+	}
+	if ct, _ := getClientToken(token); ct != nil {
+		return &Principal{ClientID: ct.ClientID,
+			Scopes: parseScope(ct.Scope)}, nil
+	}
+	name, scope, client, err := accessTokenOwner(token)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkAccessToken(name, token); err != nil {
+		return nil, err
+	}
+	access, err := getUserAccess(name)
+	if err != nil {
+		return nil, err
+	}
+	tenant, user := splitAccountKey(name)
+	return &Principal{Tenant: tenant, UserName: user, ClientID: client,
+		Session: getSession(name), Scopes: parseScope(scope),
+		Roles: access.Roles, Organizations: access.Organizations}, nil
+}
+
+// HasPermission user of principal has the permission by his roles
+func (p *Principal) HasPermission(permission string) (bool, error) {
+	if len(p.UserName) == 0 {
+		return false, nil
+	}
+	return hasPermission(accountKey(p.Tenant, p.UserName), permission)
+}
+
+// OrganizationRole role of user in the organization, empty if
+// user is not its member
+func (p *Principal) OrganizationRole(org string) string {
+	for i := 0; i < len(p.Organizations); i++ {
+		if p.Organizations[i].Organization == org {
+			return p.Organizations[i].Role
+		}
+	}
+	return ""
+}
+
+// accessTokenOwner find account key of user, scope and client of access
+// token, jwt has them in it and other token is found in cache, database
+// or redis
+func accessTokenOwner(token string) (string, string, string, error) {
+	if Config.AccessTokenFormat == TokenFormatJWT && isJWT(token) {
+		_, payload, _, err := splitJWT(token)
+		if err != nil {
+			return "", "", "", ErrAccessTokenInvalid
+		}
+		// signature is checked by CheckAccessToken
+		var claims AccessTokenClaims
+		if err = json.Unmarshal(payload, &claims); err != nil {
+			return "", "", "", ErrAccessTokenInvalid
+		}
+		return accountKey(claims.Tenant, claims.UserName), claims.Scope,
+			claims.ClientID, nil
+	}
+	if redisPool == nil {
+		// client id has no newline as scope
+		scope, s := splitScopeValue(tokenOwnerCache.Get(token))
+		client, name := splitScopeValue(s)
+		if len(name) > 0 {
+			return name, scope, client, nil
+		}
+	}
+	t, typ, err := findTokenOwner(token)
+	if err != nil {
+		return "", "", "", err
+	}
+	if t == nil || typ == refreshToken {
+		return "", "", "", ErrAccessTokenInvalid
+	}
+	scope := tokenScope(t, typ)
+	if redisPool == nil {
+		tokenOwnerCache.Set(token, joinScopeValue(scope,
+			joinScopeValue(t.ClientID, t.key())))
+	}
+	return t.key(), scope, t.ClientID, nil
+}
+
+// getSession session of user for web site
+func getSession(name string) string {
+	if redisPool == nil {
+		return sessionCache.Get(name)
+	}
+	c := redisPool.Get()
+	defer c.Close()
+	s, err := redis.String(c.Do("GET", "session@"+name))
+	if err != nil && err != redis.ErrNil {
+		fmt.Println("redis get failed:", err)
+	}
+	return s
+}
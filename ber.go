@@ -0,0 +1,164 @@
+package ucenter
+
+import (
+	"io"
+)
+
+// tags of BER (X.690) used by ldap
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+	berSet         = 0x31
+)
+
+// berMaxLength limit length of untrusted element
+const berMaxLength = 1 << 20
+
+// berElement tag and content of BER encoded element, only tag number
+// less than 31 is supported, it is enough for ldap
+type berElement struct {
+	Tag     byte
+	Content []byte
+}
+
+// berEncode encode element of tag and content
+func berEncode(tag byte, content []byte) []byte {
+	n := len(content)
+	b := []byte{tag}
+	if n < 0x80 {
+		b = append(b, byte(n))
+	} else {
+		var l []byte
+		for ; n > 0; n >>= 8 {
+			l = append([]byte{byte(n)}, l...)
+		}
+		b = append(b, 0x80|byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, content...)
+}
+
+// berConstructed encode constructed element of encoded elements
+func berConstructed(tag byte, elements ...[]byte) []byte {
+	var content []byte
+	for i := 0; i < len(elements); i++ {
+		content = append(content, elements[i]...)
+	}
+	return berEncode(tag, content)
+}
+
+// berInt encode integer or enumerated in the fewest bytes
+func berInt(tag byte, n int64) []byte {
+	b := []byte{byte(n)}
+	for v := n >> 8; ; v >>= 8 {
+		// stop when sign bit of first byte matches the rest
+		if (v == 0 && b[0]&0x80 == 0) || (v == -1 && b[0]&0x80 != 0) {
+			break
+		}
+		b = append([]byte{byte(v)}, b...)
+	}
+	return berEncode(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return berEncode(tag, []byte(s))
+}
+
+func berBool(v bool) []byte {
+	if v {
+		return berEncode(berBoolean, []byte{0xff})
+	}
+	return berEncode(berBoolean, []byte{0})
+}
+
+// berDecode decode the first element of data, the rest of data is
+// also returned
+func berDecode(data []byte) (*berElement, []byte, error) {
+	if len(data) < 2 || data[0]&0x1f == 0x1f {
+		return nil, nil, ErrBERInvalid
+	}
+	tag := data[0]
+	n := int(data[1])
+	data = data[2:]
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		// indefinite length is not allowed in ldap, active directory
+		// always encodes length in 4 bytes
+		if size == 0 || size > 4 || len(data) < size {
+			return nil, nil, ErrBERInvalid
+		}
+		n = 0
+		for i := 0; i < size; i++ {
+			n = n<<8 | int(data[i])
+			if n > berMaxLength {
+				return nil, nil, ErrBERInvalid
+			}
+		}
+		data = data[size:]
+	}
+	if n > len(data) {
+		return nil, nil, ErrBERInvalid
+	}
+	return &berElement{Tag: tag, Content: data[:n]}, data[n:], nil
+}
+
+// berChildren decode elements in content of constructed element
+func berChildren(content []byte) ([]berElement, error) {
+	var ret []berElement
+	for len(content) > 0 {
+		e, rest, err := berDecode(content)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, *e)
+		content = rest
+	}
+	return ret, nil
+}
+
+// berParseInt value of integer or enumerated
+func berParseInt(content []byte) (int64, error) {
+	if len(content) == 0 || len(content) > 8 {
+		return 0, ErrBERInvalid
+	}
+	n := int64(int8(content[0]))
+	for i := 1; i < len(content); i++ {
+		n = n<<8 | int64(content[i])
+	}
+	return n, nil
+}
+
+// berRead read one encoded element from stream
+func berRead(r io.Reader) ([]byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	n := int(head[1])
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 {
+			return nil, ErrBERInvalid
+		}
+		l := make([]byte, size)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return nil, err
+		}
+		head = append(head, l...)
+		n = 0
+		for i := 0; i < size; i++ {
+			n = n<<8 | int(l[i])
+			if n > berMaxLength {
+				return nil, ErrBERInvalid
+			}
+		}
+	}
+	content := make([]byte, n)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	return append(head, content...), nil
+}
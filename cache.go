@@ -2,6 +2,8 @@ package ucenter
 
 import (
 	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -21,6 +23,15 @@ type Cache struct {
 type Value struct {
 	value   string
 	created int64
+	// expire of this value, 0 means use expire of cache
+	expire int64
+}
+
+func (v *Value) expired(now int64, expire int) bool {
+	if v.expire > 0 {
+		return now-v.created > v.expire
+	}
+	return now-v.created > int64(expire)
 }
 
 // Init cache,
@@ -46,7 +57,7 @@ func (c *Cache) checkExpired() {
 			var cleankeys []string
 			for k, v := range c.mapping {
 				if v != nil {
-					if now-v.created > int64(c.expire) {
+					if v.expired(now, c.expire) {
 						cleankeys = append(
 							cleankeys, k)
 					}
@@ -80,6 +91,9 @@ func (c *Cache) Get(key string) string {
 	}
 	v, ok := c.mapping[key]
 	if ok {
+		if v.expire > 0 && v.expired(time.Now().Unix(), c.expire) {
+			return ""
+		}
 		return v.value
 	}
 	return ""
@@ -93,10 +107,139 @@ func (c *Cache) Set(key string, val string) {
 		fmt.Println("cache not init")
 		return
 	}
-	v := Value{val, time.Now().Unix()}
+	v := Value{val, time.Now().Unix(), 0}
+	c.mapping[key] = &v
+}
+
+// SetEx set cache which expired after expire seconds
+func (c *Cache) SetEx(key string, val string, expire int) {
+	c.Lock()
+	defer c.Unlock()
+	if c.mapping == nil {
+		fmt.Println("cache not init")
+		return
+	}
+	v := Value{val, time.Now().Unix(), int64(expire)}
 	c.mapping[key] = &v
 }
 
+// Take get cache and delete it, so only one caller can get the value
+func (c *Cache) Take(key string) string {
+	c.Lock()
+	defer c.Unlock()
+	v, ok := c.mapping[key]
+	if !ok {
+		return ""
+	}
+	delete(c.mapping, key)
+	if v.expire > 0 && v.expired(time.Now().Unix(), c.expire) {
+		return ""
+	}
+	return v.value
+}
+
+// Incr increase the number saved in key, if key not exist
+// it will be set to 1 and expired after expire seconds
+func (c *Cache) Incr(key string, expire int) int {
+	c.Lock()
+	defer c.Unlock()
+	if c.mapping == nil {
+		fmt.Println("cache not init")
+		return 0
+	}
+	now := time.Now().Unix()
+	v, ok := c.mapping[key]
+	if !ok || v.expired(now, c.expire) {
+		c.mapping[key] = &Value{"1", now, int64(expire)}
+		return 1
+	}
+	n, _ := strconv.Atoi(v.value)
+	n++
+	v.value = strconv.Itoa(n)
+	return n
+}
+
+// setTempValue save a short-lived value in redis or in-memory cache
+func setTempValue(key string, value string, expire int) error {
+	if redisPool == nil {
+		tempCache.SetEx(key, value, expire)
+		return nil
+	}
+	c := redisPool.Get()
+	defer c.Close()
+	_, err := c.Do("SET", key, value, "EX", strconv.Itoa(expire))
+	if err != nil {
+		fmt.Println(err)
+		return ErrSetRedis
+	}
+	return nil
+}
+
+// getTempValue get value saved by setTempValue, return "" if not exist
+func getTempValue(key string) string {
+	if redisPool == nil {
+		return tempCache.Get(key)
+	}
+	c := redisPool.Get()
+	defer c.Close()
+	s, err := redis.String(c.Do("GET", key))
+	if err != nil {
+		return ""
+	}
+	return s
+}
+
+// takeTempValue get and delete value saved by setTempValue,
+// used for the value can only use once
+func takeTempValue(key string) string {
+	if redisPool == nil {
+		return tempCache.Take(key)
+	}
+	c := redisPool.Get()
+	defer c.Close()
+	c.Send("MULTI")
+	c.Send("GET", key)
+	c.Send("DEL", key)
+	r, err := redis.Values(c.Do("EXEC"))
+	if err != nil || len(r) == 0 {
+		return ""
+	}
+	s, err := redis.String(r[0], nil)
+	if err != nil {
+		return ""
+	}
+	return s
+}
+
+// deleteTempValue delete value saved by setTempValue
+func deleteTempValue(key string) {
+	if redisPool == nil {
+		tempCache.Delete(key)
+		return
+	}
+	c := redisPool.Get()
+	defer c.Close()
+	c.Do("DEL", key)
+}
+
+// incrTempValue increase counter which expired after expire seconds
+func incrTempValue(key string, expire int) (int, error) {
+	if redisPool == nil {
+		return tempCache.Incr(key, expire), nil
+	}
+	c := redisPool.Get()
+	defer c.Close()
+	n, err := redis.Int(c.Do("INCR", key))
+	if err != nil {
+		fmt.Println(err)
+		return 0, ErrSetRedis
+	}
+	if n == 1 {
+		c.Do("EXPIRE", key, strconv.Itoa(expire))
+	}
+	return n, nil
+}
+
 // Delete delete cache
 func (c *Cache) Delete(key string) {
 	c.Lock()
@@ -20,3 +20,21 @@ func TestCache(t *testing.T) {
 		t.Fatal("cache set expire error")
 	}
 }
+
+func TestCacheSetEx(t *testing.T) {
+	cache := Cache{expire: 60, checkInterval: 60}
+	cache.Init()
+	defer cache.Close()
+	cache.SetEx("code", "123456", 1)
+	if cache.Incr("attempts", 1) != 1 || cache.Incr("attempts", 1) != 2 {
+		t.Fatal("cache incr error")
+	}
+	if cache.Take("code") != "123456" || cache.Get("code") != "" {
+		t.Fatal("cache take error")
+	}
+	cache.SetEx("code", "123456", 1)
+	time.Sleep(2 * time.Second)
+	if cache.Get("code") != "" || cache.Incr("attempts", 1) != 1 {
+		t.Fatal("cache set expire error")
+	}
+}
@@ -0,0 +1,121 @@
+package ucenter
+
+import (
+	"encoding/binary"
+)
+
+// cborMaxDepth limit nesting of untrusted data
+const cborMaxDepth = 16
+
+// decodeCBOR decode the first cbor item (RFC 7049) of data, only the types
+// used by webauthn are supported: integer, byte/text string, array, map,
+// bool and null. integers decode to int64, maps to
+// map[interface{}]interface{}. The rest of data is also returned
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth || len(data) == 0 {
+		return nil, nil, ErrCBORInvalid
+	}
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		}
+		return nil, nil, ErrCBORInvalid
+	}
+
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info == 24 && len(data) >= 1:
+		n = uint64(data[0])
+		data = data[1:]
+	case info == 25 && len(data) >= 2:
+		n = uint64(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	case info == 26 && len(data) >= 4:
+		n = uint64(binary.BigEndian.Uint32(data))
+		data = data[4:]
+	case info == 27 && len(data) >= 8:
+		n = binary.BigEndian.Uint64(data)
+		data = data[8:]
+	default:
+		// indefinite length is not used by webauthn
+		return nil, nil, ErrCBORInvalid
+	}
+
+	switch major {
+	case 0:
+		if n > 1<<63-1 {
+			return nil, nil, ErrCBORInvalid
+		}
+		return int64(n), data, nil
+	case 1:
+		if n > 1<<63-1 {
+			return nil, nil, ErrCBORInvalid
+		}
+		return -1 - int64(n), data, nil
+	case 2, 3:
+		if n > uint64(len(data)) {
+			return nil, nil, ErrCBORInvalid
+		}
+		b := make([]byte, n)
+		copy(b, data[:n])
+		if major == 3 {
+			return string(b), data[n:], nil
+		}
+		return b, data[n:], nil
+	case 4:
+		if n > uint64(len(data)) {
+			return nil, nil, ErrCBORInvalid
+		}
+		items := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var v interface{}
+			var err error
+			v, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, v)
+		}
+		return items, data, nil
+	case 5:
+		if n > uint64(len(data)) {
+			return nil, nil, ErrCBORInvalid
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			var k, v interface{}
+			var err error
+			k, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, ErrCBORInvalid
+			}
+			v, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, data, nil
+	}
+	// tags are not used by webauthn
+	return nil, nil, ErrCBORInvalid
+}
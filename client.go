@@ -0,0 +1,299 @@
+package ucenter
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// clientToken access token issued to client itself by client
+// credentials grant, saved in token table as a row without user,
+// or in redis until it expired
+type clientToken struct {
+	ClientID  string `json:"client_id"`
+	Scope     string `json:"scope"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// ClientCredentialsToken get access token for confidential client
+// itself, the token has no user and no refresh token. scopes must be
+// registered by client, all registered scopes if it is empty
+func ClientCredentialsToken(clientID string, secret string, scopes ...string) (*LoginResult, error) {
+	c, err := authenticateOAuthClient(clientID, secret)
+	if err != nil {
+		return nil, err
+	}
+	return clientCredentialsToken(c, scopes)
+}
+
+// RotateOAuthClientSecret generate new secret for confidential client,
+// the old secret can still be used in overlap seconds, so the client
+// can be updated without downtime
+func RotateOAuthClientSecret(id string, overlap int) (string, error) {
+	c, err := GetOAuthClient(id)
+	if err != nil {
+		return "", err
+	}
+	if !c.Confidential {
+		return "", ErrOAuthClientInvalid
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	var expires int64
+	if overlap > 0 {
+		expires = time.Now().Unix() + int64(overlap)
+	}
+	sql := "update " + Config.OAuthClientTableName + " set secret_hash = ?," +
+		" old_secret_hash = secret_hash, old_secret_expires = ?" +
+		" where client_id = ?"
+	_, err = db.Exec(sql, hashToken(secret), expires, id)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// authenticateOAuthClient check secret of confidential client, public
+// client has no secret and must not send it
+func authenticateOAuthClient(id string, secret string) (*OAuthClient, error) {
+	c, err := GetOAuthClient(id)
+	if err != nil {
+		return nil, err
+	}
+	if !c.Confidential {
+		if len(secret) > 0 {
+			return nil, ErrOAuthClientInvalid
+		}
+		return c, nil
+	}
+	if len(secret) == 0 {
+		return nil, ErrOAuthClientInvalid
+	}
+	hash := []byte(hashToken(secret))
+	if hmac.Equal(hash, []byte(c.secretHash)) {
+		return c, nil
+	}
+	if c.oldSecretExpires > time.Now().Unix() &&
+		hmac.Equal(hash, []byte(c.oldSecretHash)) {
+		return c, nil
+	}
+	return nil, ErrOAuthClientInvalid
+}
+
+// clientCredentialsToken issue access token to authenticated client
+func clientCredentialsToken(c *OAuthClient, scopes []string) (*LoginResult, error) {
+	if !c.Confidential || !c.allowGrantType("client_credentials") {
+		return nil, ErrUnauthorizedClient
+	}
+	scope, err := normalizeScopes(scopes)
+	if err != nil {
+		return nil, err
+	}
+	if len(scope) == 0 {
+		scope = strings.Join(c.Scopes, " ")
+	} else if len(c.Scopes) > 0 &&
+		!hasScopes(strings.Join(c.Scopes, " "), parseScope(scope)) {
+		return nil, ErrScopeInvalid
+	}
+	lifetime := Config.TokenExpiresIn
+	if c.AccessTokenExpiresIn > 0 && c.AccessTokenExpiresIn < lifetime {
+		lifetime = c.AccessTokenExpiresIn
+	}
+	now := time.Now().Unix()
+	ct := clientToken{ClientID: c.ID, Scope: scope, IssuedAt: now,
+		ExpiresAt: now + int64(lifetime)}
+	token, stored, err := newClientAccessToken(&ct)
+	if err != nil {
+		return nil, err
+	}
+	if err = saveClientToken(hashToken(stored), &ct, lifetime); err != nil {
+		return nil, err
+	}
+	return &LoginResult{AccessToken: token,
+		AccessTokenExpiresIn: lifetime,
+		Scopes:               parseScope(scope)}, nil
+}
+
+// newClientAccessToken create access token for client, the second
+// value is saved, it is jti if token is jwt
+func newClientAccessToken(ct *clientToken) (string, string, error) {
+	id, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	if Config.AccessTokenFormat != TokenFormatJWT {
+		return id, id, nil
+	}
+	key, err := currentSigningKey()
+	if err != nil {
+		return "", "", err
+	}
+	claims := AccessTokenClaims{
+		Issuer:    Config.JWTIssuer,
+		Subject:   ct.ClientID,
+		IssuedAt:  ct.IssuedAt,
+		ExpiresAt: ct.ExpiresAt,
+		ID:        id,
+		Scope:     ct.Scope,
+		ClientID:  ct.ClientID,
+	}
+	token, err := signJWT(key, jwtTypAccessToken, claims)
+	if err != nil {
+		return "", "", err
+	}
+	return token, id, nil
+}
+
+// saveClientToken save client token by hash of its stored value, expired
+// tokens of the client are deleted from database at the same time
+func saveClientToken(hash string, ct *clientToken, lifetime int) error {
+	if redisPool == nil {
+		sql := "delete from " + Config.TokenTablename +
+			" where tenant_id = '' and user_name = '' and client_id = ?" +
+			" and atoken_created < date_sub(now(), interval ? second)"
+		if _, err := db.Exec(sql, ct.ClientID, lifetime); err != nil {
+			fmt.Println(err)
+		}
+		sql = "insert into " + Config.TokenTablename +
+			"(client_id, access_token, scope, access_scope)" +
+			" values(?, ?, ?, ?)"
+		_, err := db.Exec(sql, ct.ClientID, hash, ct.Scope, ct.Scope)
+		if err != nil {
+			fmt.Println(err)
+			return ErrSetAccessToken
+		}
+		return nil
+	}
+	b, err := json.Marshal(ct)
+	if err != nil {
+		return err
+	}
+	return setTempValue("client_token@"+hash, string(b), lifetime)
+}
+
+// loadClientToken client token saved by saveClientToken, nil if
+// not exist
+func loadClientToken(hash string) (*clientToken, error) {
+	if redisPool != nil {
+		s := getTempValue("client_token@" + hash)
+		if len(s) == 0 {
+			return nil, nil
+		}
+		var ct clientToken
+		if err := json.Unmarshal([]byte(s), &ct); err != nil {
+			return nil, err
+		}
+		return &ct, nil
+	}
+	sql := "select client_id, access_scope, atoken_created from " +
+		Config.TokenTablename + " where access_token = ?" +
+		" and tenant_id = '' and user_name = ''"
+	rows, err := db.Query(sql, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ct clientToken
+		var created string
+		if err = rows.Scan(&ct.ClientID, &ct.Scope, &created); err != nil {
+			return nil, err
+		}
+		t, err := parseDBTime(created)
+		if err != nil {
+			return nil, err
+		}
+		ct.IssuedAt = t.Unix()
+		ct.ExpiresAt = ct.IssuedAt +
+			int64(tokenConfig("", ct.ClientID).TokenExpiresIn)
+		return &ct, nil
+	}
+	return nil, nil
+}
+
+// deleteClientToken revoke client token saved by saveClientToken
+func deleteClientToken(hash string) error {
+	if redisPool != nil {
+		deleteTempValue("client_token@" + hash)
+		return nil
+	}
+	sql := "delete from " + Config.TokenTablename + " where access_token = ?" +
+		" and tenant_id = '' and user_name = ''"
+	if _, err := db.Exec(sql, hash); err != nil {
+		fmt.Println(err)
+		return ErrSetAccessToken
+	}
+	return nil
+}
+
+// getClientToken find access token issued to client itself, nil if
+// it is not a valid client token. the second value is hash of it
+func getClientToken(token string) (*clientToken, string) {
+	stored := token
+	if Config.AccessTokenFormat == TokenFormatJWT && isJWT(token) {
+		header, payload, _, err := splitJWT(token)
+		if err != nil {
+			return nil, ""
+		}
+		var claims AccessTokenClaims
+		if err = json.Unmarshal(payload, &claims); err != nil ||
+			len(claims.UserName) > 0 {
+			// token of user
+			return nil, ""
+		}
+		key, err := verifyingKey(header.Kid)
+		if err != nil {
+			return nil, ""
+		}
+		if _, err = parseAccessToken(token, key); err != nil {
+			return nil, ""
+		}
+		stored = claims.ID
+	}
+	hash := hashToken(stored)
+	ct, err := loadClientToken(hash)
+	if err != nil {
+		fmt.Println(err)
+		return nil, ""
+	}
+	if ct == nil || ct.ExpiresAt <= time.Now().Unix() {
+		return nil, ""
+	}
+	return ct, hash
+}
+
+// requestClient client id and secret from basic authorization
+// header or post form
+func requestClient(r *http.Request) (string, string, error) {
+	if err := r.ParseForm(); err != nil {
+		return "", "", ErrParamInvalid
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret"), nil
+	}
+	// client id and secret are form encoded in basic auth
+	var err error
+	if id, err = url.QueryUnescape(id); err != nil {
+		return "", "", ErrOAuthClientInvalid
+	}
+	if secret, err = url.QueryUnescape(secret); err != nil {
+		return "", "", ErrOAuthClientInvalid
+	}
+	return id, secret, nil
+}
+
+// clientTokenIntrospection introspection of active client token
+func clientTokenIntrospection(ct *clientToken) *TokenIntrospection {
+	return &TokenIntrospection{Active: true, Scope: ct.Scope,
+		ClientID: ct.ClientID, TokenType: introspectBearer,
+		IssuedAt: ct.IssuedAt, ExpiresAt: ct.ExpiresAt,
+		Subject: ct.ClientID, Issuer: Config.JWTIssuer}
+}
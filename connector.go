@@ -0,0 +1,304 @@
+package ucenter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Connector upstream oauth2 provider which users can login by, such
+// as QQConnector, WeiboConnector and OIDCConnector
+type Connector interface {
+	// Name unique name of connector, such as "qq"
+	Name() string
+	// AuthCodeURL url to redirect user to login at provider
+	AuthCodeURL(req *ConnectorRequest) (string, error)
+	// Identity exchange code for token and get user of provider
+	Identity(req *ConnectorRequest, code string) (*ExternalIdentity, error)
+}
+
+// ConnectorRequest login request to upstream provider, it is saved
+// by State until user come back with code
+type ConnectorRequest struct {
+	Connector   string `json:"connector"`
+	State       string `json:"state"`
+	RedirectURI string `json:"redirect_uri"`
+	// Nonce and CodeVerifier are used by connectors support them
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+}
+
+// ExternalIdentity user of upstream provider
+type ExternalIdentity struct {
+	// ID of user at provider, it never change
+	ID string
+	// UserName is used to register user if it has not been used,
+	// otherwise the name is connector_ID
+	UserName string
+	Nickname string
+	// Email only set if it is verified by provider
+	Email string
+}
+
+// maxIdentityNameLength max length of user name registered for
+// identity, user_name is varchar(60) and suffix may be added
+const maxIdentityNameLength = 50
+
+var (
+	connectors     = map[string]Connector{}
+	connectorsLock sync.RWMutex
+
+	// connectorClient http client for upstream providers
+	connectorClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// RegisterConnector add connector users can login by, connector of
+// same name is replaced
+func RegisterConnector(c Connector) {
+	connectorsLock.Lock()
+	connectors[c.Name()] = c
+	connectorsLock.Unlock()
+}
+
+// ConnectorAuthURL url to redirect user to login by connector, the
+// provider send user back to redirectURI with code and state
+func ConnectorAuthURL(name string, redirectURI string) (string, error) {
+	c := getConnector(name)
+	if c == nil {
+		return "", ErrConnectorInvalid
+	}
+	state, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	req := &ConnectorRequest{Connector: name, State: state,
+		RedirectURI: redirectURI, Nonce: nonce, CodeVerifier: verifier}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	err = setTempValue("connector_state@"+hashToken(state), string(b),
+		Config.ConnectorStateExpiresIn)
+	if err != nil {
+		return "", err
+	}
+	return c.AuthCodeURL(req)
+}
+
+// ConnectorLogin login user come back from provider with state and
+// code, user is registered at first login. it returns MFAChallenge
+// as UserLogin if user has enabled mfa
+func ConnectorLogin(state string, code string, scopes ...string) (*LoginResult, error) {
+	if len(state) == 0 || len(code) == 0 {
+		return nil, ErrParamInvalid
+	}
+	scope, err := normalizeScopes(scopes)
+	if err != nil {
+		return nil, err
+	}
+	// state can only be used once
+	s := takeTempValue("connector_state@" + hashToken(state))
+	if len(s) == 0 {
+		return nil, ErrConnectorStateInvalid
+	}
+	var req ConnectorRequest
+	if err = json.Unmarshal([]byte(s), &req); err != nil {
+		return nil, ErrConnectorStateInvalid
+	}
+	c := getConnector(req.Connector)
+	if c == nil {
+		return nil, ErrConnectorInvalid
+	}
+	identity, err := c.Identity(&req, code)
+	if err != nil {
+		return nil, err
+	}
+	u, err := identityUser(req.Connector, identity)
+	if err != nil {
+		return nil, err
+	}
+	return loginUser(u, scope)
+}
+
+func getConnector(name string) Connector {
+	connectorsLock.RLock()
+	defer connectorsLock.RUnlock()
+	return connectors[name]
+}
+
+// identityUser user linked to identity, user is registered if not exist
+func identityUser(connector string, identity *ExternalIdentity) (*UserInfo, error) {
+	if len(identity.ID) == 0 {
+		return nil, ErrUpstreamFailed
+	}
+	id, err := identityUserID(connector, identity.ID)
+	if err != nil {
+		return nil, err
+	}
+	if id > 0 {
+		return getUserByID(id)
+	}
+	u, err := registerIdentityUser(connector, identity)
+	if err != nil {
+		// registered by concurrent login of the same identity
+		if id, e := identityUserID(connector, identity.ID); e == nil && id > 0 {
+			return getUserByID(id)
+		}
+		return nil, err
+	}
+	return u, nil
+}
+
+// identityUserID id of user linked to identity, 0 if not exist
+func identityUserID(connector string, externalID string) (int64, error) {
+	sql := "select user_id from " + Config.IdentityTableName +
+		" where connector = ? and external_id = ?"
+	rows, err := db.Query(sql, connector, externalID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var id int64
+	for rows.Next() {
+		if err = rows.Scan(&id); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// registerIdentityUser create user without password for identity,
+// name is UserName of identity or connector_ID, random suffix is added
+// if it has been used
+func registerIdentityUser(connector string, identity *ExternalIdentity) (*UserInfo, error) {
+	name := identity.UserName
+	if len(name) > 0 && len(accountKey("", name)) > 0 &&
+		len(name) <= maxIdentityNameLength {
+		if u, _ := getUserByName(name); u == nil {
+			return createIdentityUser(connector, name, identity)
+		}
+	}
+	name = connector + "_" + identity.ID
+	if len(name) > maxIdentityNameLength {
+		name = connector + "_" + hashToken(identity.ID)[:16]
+	}
+	if u, _ := getUserByName(name); u != nil {
+		suffix, err := randomToken(6)
+		if err != nil {
+			return nil, err
+		}
+		name += "_" + suffix
+	}
+	return createIdentityUser(connector, name, identity)
+}
+
+// createIdentityUser create user and link identity to it in one
+// transaction. link is inserted first, so concurrent login of the same
+// identity waits for the transaction and then fails by unique key
+func createIdentityUser(connector string, name string, identity *ExternalIdentity) (*UserInfo, error) {
+	user := UserInfo{UserName: name, Nickname: identity.Nickname}
+	// email of other user is not linked, user may not own it
+	if len(identity.Email) > 0 {
+		if _, err := getUserByEmail(identity.Email); err == ErrUserNotExist {
+			user.Email = identity.Email
+		}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	sql := "insert into " + Config.IdentityTableName +
+		"(connector, external_id, user_id) values(?, ?, 0)"
+	if _, err = tx.Exec(sql, connector, identity.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	ret, err := insertUser(tx.Exec, user)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	id, err := ret.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	sql = "update " + Config.IdentityTableName + " set user_id = ?" +
+		" where connector = ? and external_id = ?"
+	if _, err = tx.Exec(sql, id, connector, identity.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return getUserByID(id)
+}
+
+// connectorGet get json from provider
+func connectorGet(uri string, v interface{}) error {
+	resp, err := connectorClient.Get(uri)
+	if err != nil {
+		fmt.Println(err)
+		return ErrUpstreamFailed
+	}
+	return readConnectorResponse(resp, v)
+}
+
+// connectorPost post form to provider and get json
+func connectorPost(uri string, form url.Values, v interface{}) error {
+	resp, err := connectorClient.PostForm(uri, form)
+	if err != nil {
+		fmt.Println(err)
+		return ErrUpstreamFailed
+	}
+	return readConnectorResponse(resp, v)
+}
+
+func readConnectorResponse(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		fmt.Println(err)
+		return ErrUpstreamFailed
+	}
+	if resp.StatusCode != http.StatusOK {
+		fmt.Println("upstream provider error:", resp.StatusCode, string(b))
+		return ErrUpstreamFailed
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		fmt.Println(err)
+		return ErrUpstreamFailed
+	}
+	return nil
+}
+
+func createIdentityTable() error {
+	createStr := "create table " + Config.IdentityTableName + "(" +
+		"ID               bigint(20) unsigned NOT NULL AUTO_INCREMENT," +
+		"connector        varchar(32) NOT NULL DEFAULT ''," +
+		"external_id      varchar(191) NOT NULL DEFAULT ''," +
+		"user_id          bigint(20) unsigned NOT NULL," +
+		"created          datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`ID`), " +
+		"UNIQUE KEY `connector_external` (`connector`, `external_id`), " +
+		"KEY `user_id` (`user_id`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8"
+	_, err := db.Exec(createStr)
+	if err != nil {
+		return err
+	}
+	return nil
+}
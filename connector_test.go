@@ -0,0 +1,287 @@
+package ucenter
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newQQServer stand-in of QQ connect api, code "good" is valid
+func newQQServer(appID string, openID string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2.0/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good" || r.FormValue("client_id") != appID {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"error": 100019})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"access_token": "qq_token"})
+	})
+	mux.HandleFunc("/oauth2.0/me", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"client_id": appID,
+			"openid": openID})
+	})
+	mux.HandleFunc("/user/get_user_info", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ret": 0,
+			"nickname": "QQ User"})
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestQQConnector(t *testing.T) {
+	server := newQQServer("app", "OPENID")
+	defer server.Close()
+	c := &QQConnector{AppID: "app", AppKey: "key", BaseURL: server.URL}
+	req := &ConnectorRequest{State: "s", RedirectURI: "https://example.com/cb"}
+	uri, _ := c.AuthCodeURL(req)
+	u, _ := url.Parse(uri)
+	if u.Query().Get("client_id") != "app" || u.Query().Get("state") != "s" {
+		t.Error("auth code url error:", u)
+	}
+	identity, err := c.Identity(req, "good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.ID != "OPENID" || identity.Nickname != "QQ User" {
+		t.Error("identity error:", identity)
+	}
+	if _, err = c.Identity(req, "bad"); err != ErrUpstreamFailed {
+		t.Error("invalid code should fail:", err)
+	}
+	// token of other app
+	c.AppID = "other"
+	if _, err = c.Identity(req, "good"); err != ErrUpstreamFailed {
+		t.Error("token of other app should fail:", err)
+	}
+}
+
+func TestWeiboConnector(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/access_token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.PostFormValue("code") != "good" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"access_token": "wb_token",
+			"uid": "12345"})
+	})
+	mux.HandleFunc("/2/users/show.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":12345,"screen_name":"Weibo User"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	c := &WeiboConnector{AppKey: "app", AppSecret: "secret", BaseURL: server.URL}
+	req := &ConnectorRequest{State: "s", RedirectURI: "https://example.com/cb"}
+	identity, err := c.Identity(req, "good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.ID != "12345" || identity.Nickname != "Weibo User" {
+		t.Error("identity error:", identity)
+	}
+	if _, err = c.Identity(req, "bad"); err != ErrUpstreamFailed {
+		t.Error("invalid code should fail:", err)
+	}
+}
+
+func TestConnectorLogin(t *testing.T) {
+	requireMySQL(t)
+	openID, _ := randomToken(8)
+	server := newQQServer("app", openID)
+	defer server.Close()
+	RegisterConnector(&QQConnector{AppID: "app", AppKey: "key",
+		BaseURL: server.URL})
+	if _, err := ConnectorAuthURL("unknown", ""); err != ErrConnectorInvalid {
+		t.Fatal("connector should be registered:", err)
+	}
+	var names []string
+	for i := 0; i < 2; i++ {
+		uri, err := ConnectorAuthURL("qq", "https://example.com/cb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, _ := url.Parse(uri)
+		state := u.Query().Get("state")
+		ret, err := ConnectorLogin(state, "good")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ConnectorLogin(state, "good"); err != ErrConnectorStateInvalid {
+			t.Fatal("state can only be used once:", err)
+		}
+		p, err := Authenticate(ret.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, p.UserName)
+	}
+	// user is registered at first login and linked after
+	if names[0] != names[1] || names[0] != "qq_"+openID {
+		t.Fatal("identity should login as same user:", names)
+	}
+	info, err := GetUserInfo(names[0])
+	if err != nil || info.Nickname != "QQ User" {
+		t.Fatal("user should be registered:", err, info)
+	}
+	// concurrent first login register only one user
+	id, _ := randomToken(8)
+	users := make([]*UserInfo, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < len(users); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			users[i], _ = identityUser("qq", &ExternalIdentity{ID: id})
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < len(users); i++ {
+		if users[i] == nil || users[i].ID != users[0].ID {
+			t.Fatal("identity should be linked to one user:", users[i])
+		}
+	}
+}
+
+// oidcTestServer stand-in of OpenID Connect provider, client is "rp"
+// with secret "secret"
+type oidcTestServer struct {
+	*httptest.Server
+	key *managedKey
+	sub string
+	// codes authorization requests by code
+	codes map[string]url.Values
+}
+
+func newOIDCTestServer(sub string) *oidcTestServer {
+	s := &oidcTestServer{sub: sub, codes: map[string]url.Values{}}
+	s.key, _, _ = newManagedKey(JWTAlgEdDSA)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"issuer": s.URL,
+			"authorization_endpoint": s.URL + "/authorize",
+			"token_endpoint":         s.URL + "/token",
+			"jwks_uri":               s.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwk, _ := publicJWK(&s.key.signingKey)
+		writeJSON(w, http.StatusOK, JSONWebKeySet{[]JSONWebKey{jwk}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		q := s.codes[r.PostFormValue("code")]
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if id != "rp" || secret != "secret" || q == nil ||
+			q.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(sum[:]) ||
+			q.Get("redirect_uri") != r.PostFormValue("redirect_uri") {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		delete(s.codes, r.PostFormValue("code"))
+		now := time.Now().Unix()
+		token, _ := signJWT(&s.key.signingKey, jwtTypJWT, map[string]interface{}{
+			"iss": s.URL, "sub": s.sub, "aud": q.Get("client_id"),
+			"iat": now, "exp": now + 300, "nonce": q.Get("nonce"),
+			"preferred_username": "oidc_" + s.sub, "name": "OIDC User",
+			"email": s.sub + "@example.com", "email_verified": true})
+		writeJSON(w, http.StatusOK, map[string]string{"access_token": "x",
+			"token_type": "Bearer", "id_token": token})
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// authorize user login at provider by authorization url, it returns
+// state and code sent back to client
+func (s *oidcTestServer) authorize(uri string) (string, string) {
+	u, _ := url.Parse(uri)
+	code, _ := randomToken(16)
+	s.codes[code] = u.Query()
+	return u.Query().Get("state"), code
+}
+
+func TestOIDCConnector(t *testing.T) {
+	s := newOIDCTestServer("alice")
+	defer s.Close()
+	c := &OIDCConnector{ID: "corp", Issuer: s.URL, ClientID: "rp",
+		ClientSecret: "secret"}
+	req := &ConnectorRequest{State: "s", Nonce: "n",
+		CodeVerifier: strings.Repeat("v", 43),
+		RedirectURI:  "https://example.com/cb"}
+	uri, err := c.AuthCodeURL(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(uri)
+	if u.Query().Get("code_challenge_method") != pkceS256 ||
+		!strings.Contains(u.Query().Get("scope"), ScopeOpenID) {
+		t.Fatal("auth code url error:", uri)
+	}
+	_, code := s.authorize(uri)
+	identity, err := c.Identity(req, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.ID != "alice" || identity.UserName != "oidc_alice" ||
+		identity.Nickname != "OIDC User" ||
+		identity.Email != "alice@example.com" {
+		t.Fatal("identity error:", identity)
+	}
+
+	// nonce must match
+	_, code = s.authorize(uri)
+	req.Nonce = "other"
+	if _, err = c.Identity(req, code); err != ErrIDTokenInvalid {
+		t.Fatal("nonce should be checked:", err)
+	}
+	// id token of other client
+	_, code = s.authorize(strings.Replace(uri, "client_id=rp", "client_id=x", 1))
+	req.Nonce = "n"
+	if _, err = c.Identity(req, code); err == nil {
+		t.Fatal("audience should be checked")
+	}
+	// signed by unknown key
+	s.key, _, _ = newManagedKey(JWTAlgEdDSA)
+	_, code = s.authorize(uri)
+	if _, err = c.Identity(req, code); err != ErrIDTokenInvalid {
+		t.Fatal("signature should be checked:", err)
+	}
+}
+
+func TestOIDCConnectorLogin(t *testing.T) {
+	requireMySQL(t)
+	sub, _ := randomToken(8)
+	var names []string
+	// same sub of different providers are different users
+	for _, id := range []string{"corp_a", "corp_b"} {
+		s := newOIDCTestServer(sub)
+		defer s.Close()
+		RegisterConnector(&OIDCConnector{ID: id, Issuer: s.URL,
+			ClientID: "rp", ClientSecret: "secret"})
+		uri, err := ConnectorAuthURL(id, "https://example.com/cb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret, err := ConnectorLogin(s.authorize(uri))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := Authenticate(ret.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, p.UserName)
+	}
+	// preferred_username is used by first provider
+	if names[0] != "oidc_"+sub || names[1] == names[0] {
+		t.Fatal("users of providers error:", names)
+	}
+	info, err := GetUserInfo(names[0])
+	if err != nil || info.Email != sub+"@example.com" {
+		t.Fatal("claims should be mapped to user:", err, info)
+	}
+}
@@ -0,0 +1,139 @@
+package ucenter
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// randomBytes read n bytes from crypto/rand
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// randomToken unpredictable token which safe in url,
+// used for challenge, code and link
+func randomToken(n int) (string, error) {
+	b, err := randomBytes(n)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken hash high entropy token before save it
+func hashToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+// secretKey key derived from Config.SecretKey
+func secretKey() ([]byte, error) {
+	if len(Config.SecretKey) == 0 {
+		return nil, ErrSecretKeyNotSet
+	}
+	key := sha256.Sum256([]byte(Config.SecretKey))
+	return key[:], nil
+}
+
+// encryptSecret encrypt secret by AES-GCM before save in database
+// result is base64(nonce + ciphertext)
+func encryptSecret(plain []byte) (string, error) {
+	key, err := secretKey()
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomBytes(gcm.NonceSize())
+	if err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, plain, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret decrypt secret encrypted by encryptSecret
+func decryptSecret(s string) ([]byte, error) {
+	key, err := secretKey()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrDecryptSecret
+	}
+	nonce := sealed[:gcm.NonceSize()]
+	plain, err := gcm.Open(nil, nonce, sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrDecryptSecret
+	}
+	return plain, nil
+}
+
+// signPayload sign payload with key derived from Config.SecretKey,
+// purpose make the token can not be used for other purpose.
+// result is base64url(payload) + "." + base64url(signature)
+func signPayload(purpose string, payload []byte) (string, error) {
+	key, err := secretKey()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose + "\x00"))
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyPayload verify token created by signPayload and return payload
+func verifyPayload(purpose string, token string) ([]byte, error) {
+	key, err := secretKey()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrSignatureInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrSignatureInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrSignatureInvalid
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose + "\x00"))
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrSignatureInvalid
+	}
+	return payload, nil
+}
@@ -0,0 +1,369 @@
+package ucenter
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DeviceAuthorization response of device authorization request,
+// user enter UserCode at VerificationURI to approve the device
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// DeviceRequest device waiting for user to approve, shown to user
+// on verification page
+type DeviceRequest struct {
+	ClientID   string   `json:"client_id"`
+	ClientName string   `json:"client_name"`
+	Scopes     []string `json:"scopes"`
+}
+
+// deviceGrant saved with device code until tokens are issued, it is
+// only changed by user, poll of device is saved by pollDevice
+type deviceGrant struct {
+	ClientID  string `json:"client_id"`
+	Scope     string `json:"scope"`
+	UserCode  string `json:"user_code"`
+	Status    string `json:"status"`
+	UserName  string `json:"username,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// status of device grant
+const (
+	devicePending  = "pending"
+	deviceApproved = "approved"
+	deviceDenied   = "denied"
+)
+
+// DeviceCodeGrantType grant_type of device code on token endpoint
+const DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// userCodeChars no vowel to avoid words, no similar characters
+const userCodeChars = "BCDFGHJKLMNPQRSTVWXZ"
+
+// deviceVerifyMaxAttempts wrong user codes a user can enter
+// in Config.DeviceCodeExpiresIn
+const deviceVerifyMaxAttempts = 10
+
+// RequestDeviceAuthorization start device authorization for client,
+// device show UserCode to user and poll tokens by PollDeviceToken
+func RequestDeviceAuthorization(clientID string, scopes ...string) (*DeviceAuthorization, error) {
+	c, err := GetOAuthClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+	return requestDeviceAuthorization(c, scopes)
+}
+
+// GetDeviceRequest get the device request of user code for user who
+// has login, so he can check it before approve
+func GetDeviceRequest(userCode string, name string) (*DeviceRequest, error) {
+	_, g, err := findDeviceGrant(userCode, name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := GetOAuthClient(g.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceRequest{ClientID: c.ID, ClientName: c.Name,
+		Scopes: parseScope(g.Scope)}, nil
+}
+
+// ApproveDevice user approve the device to get his tokens
+func ApproveDevice(userCode string, name string) error {
+	return setDeviceStatus(userCode, name, deviceApproved)
+}
+
+// DenyDevice user deny the device request
+func DenyDevice(userCode string, name string) error {
+	return setDeviceStatus(userCode, name, deviceDenied)
+}
+
+// PollDeviceToken device get tokens after user approved, it returns
+// ErrAuthorizationPending before user approve and ErrSlowDown if it
+// polls faster than the interval
+func PollDeviceToken(clientID string, deviceCode string) (*LoginResult, error) {
+	hash := hashToken(deviceCode)
+	key := "device_code@" + hash
+	g, err := getDeviceGrant(key)
+	if err != nil {
+		return nil, err
+	}
+	if g.ClientID != clientID {
+		return nil, ErrDeviceCodeInvalid
+	}
+	now := time.Now().Unix()
+	if g.ExpiresAt <= now {
+		return nil, ErrDeviceCodeExpired
+	}
+	switch g.Status {
+	case deviceApproved:
+		// only one poll can get tokens
+		if len(takeTempValue(key)) == 0 {
+			return nil, ErrDeviceCodeInvalid
+		}
+		deleteTempValue("user_code@" + g.UserCode)
+		deleteTempValue("device_poll@" + hash)
+		return issueTokens(g.UserName, g.Scope, g.ClientID)
+	case deviceDenied:
+		deleteTempValue(key)
+		deleteTempValue("user_code@" + g.UserCode)
+		deleteTempValue("device_poll@" + hash)
+		return nil, ErrAccessDenied
+	}
+	slow, err := pollDevice("device_poll@"+hash, int(g.ExpiresAt-now))
+	if err != nil {
+		return nil, err
+	}
+	if slow {
+		return nil, ErrSlowDown
+	}
+	return nil, ErrAuthorizationPending
+}
+
+// pollDevice save interval and time of last poll in key, it returns
+// true if device polls faster than the interval, and the interval is
+// increased by 5 seconds. it is not saved in grant, so poll will not
+// overwrite the status set by user at the same time
+func pollDevice(key string, expire int) (bool, error) {
+	interval, last := Config.DeviceCodeInterval, int64(0)
+	if s := getTempValue(key); len(s) > 0 {
+		fmt.Sscan(s, &interval, &last)
+	}
+	now := time.Now().Unix()
+	slow := now-last < int64(interval)
+	if slow {
+		interval += 5
+	}
+	err := setTempValue(key, fmt.Sprintf("%d %d", interval, now), expire)
+	return slow, err
+}
+
+// DeviceAuthorizationHandler http handler of device authorization
+// endpoint, client authenticate as TokenHandler
+func DeviceAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeOAuthError(w, http.StatusMethodNotAllowed, "invalid_request",
+			"method must be POST")
+		return
+	}
+	clientID, secret, err := requestClient(r)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+	c, err := authenticateOAuthClient(clientID, secret)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+	ret, err := requestDeviceAuthorization(c, parseScope(r.PostForm.Get("scope")))
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, ret)
+}
+
+// DeviceVerificationHandler http api of verification page, user is got
+// by Config.OAuthUser. GET with user_code returns the DeviceRequest,
+// POST json body with user_code and action "approve" or "deny" answer
+// it, form of other sites can not post json so csrf is refused
+func DeviceVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	var name string
+	if Config.OAuthUser != nil {
+		name = Config.OAuthUser(r)
+	}
+	if len(name) == 0 {
+		writeOAuthError(w, http.StatusUnauthorized, "login_required", "")
+		return
+	}
+	var err error
+	if r.Method == "GET" {
+		var req *DeviceRequest
+		req, err = GetDeviceRequest(r.URL.Query().Get("user_code"), name)
+		if err == nil {
+			writeJSON(w, http.StatusOK, req)
+			return
+		}
+	} else {
+		var answer struct {
+			UserCode string `json:"user_code"`
+			Action   string `json:"action"`
+		}
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		b, readErr := io.ReadAll(io.LimitReader(r.Body, 1<<12))
+		if r.Method != "POST" || mediaType != "application/json" ||
+			readErr != nil || json.Unmarshal(b, &answer) != nil {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request",
+				"body must be json")
+			return
+		}
+		switch answer.Action {
+		case "approve":
+			err = ApproveDevice(answer.UserCode, name)
+		case "deny":
+			err = DenyDevice(answer.UserCode, name)
+		default:
+			err = ErrParamInvalid
+		}
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	code, status := oauthErrorCode(err)
+	if err == ErrDeviceCodeInvalid || err == ErrDeviceCodeExpired {
+		code, status = "invalid_user_code", http.StatusBadRequest
+	}
+	writeOAuthError(w, status, code, "")
+}
+
+func requestDeviceAuthorization(c *OAuthClient, scopes []string) (*DeviceAuthorization, error) {
+	if !c.allowGrantType(DeviceCodeGrantType) {
+		return nil, ErrUnauthorizedClient
+	}
+	scope, err := normalizeScopes(scopes)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Scopes) > 0 && !hasScopes(strings.Join(c.Scopes, " "),
+		parseScope(scope)) {
+		return nil, ErrScopeInvalid
+	}
+	deviceCode, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	userCode, err := newUserCode()
+	if err != nil {
+		return nil, err
+	}
+	key := "device_code@" + hashToken(deviceCode)
+	g := &deviceGrant{ClientID: c.ID, Scope: scope, UserCode: userCode,
+		Status:    devicePending,
+		ExpiresAt: time.Now().Unix() + int64(Config.DeviceCodeExpiresIn)}
+	if err = saveDeviceGrant(key, g); err != nil {
+		return nil, err
+	}
+	err = setTempValue("user_code@"+userCode, key, Config.DeviceCodeExpiresIn)
+	if err != nil {
+		return nil, err
+	}
+	display := userCode[:4] + "-" + userCode[4:]
+	ret := &DeviceAuthorization{DeviceCode: deviceCode, UserCode: display,
+		VerificationURI: Config.DeviceVerificationURI,
+		ExpiresIn:       Config.DeviceCodeExpiresIn,
+		Interval:        Config.DeviceCodeInterval}
+	if len(Config.DeviceVerificationURI) > 0 {
+		ret.VerificationURIComplete = addQuery(Config.DeviceVerificationURI,
+			"user_code", display)
+	}
+	return ret, nil
+}
+
+// findDeviceGrant find pending device grant by user code, user can
+// only try deviceVerifyMaxAttempts wrong codes
+func findDeviceGrant(userCode string, name string) (string, *deviceGrant, error) {
+	u, err := getUserByName(accountKey("", name))
+	if err != nil {
+		return "", nil, err
+	}
+	attempts := "device_verify_attempts@" + u.key()
+	if n, _ := incrTempValue(attempts, Config.DeviceCodeExpiresIn); n > deviceVerifyMaxAttempts {
+		return "", nil, ErrDeviceCodeInvalid
+	}
+	key := getTempValue("user_code@" + normalizeUserCode(userCode))
+	if len(key) == 0 {
+		return "", nil, ErrDeviceCodeInvalid
+	}
+	g, err := getDeviceGrant(key)
+	if err != nil {
+		return "", nil, err
+	}
+	if g.ExpiresAt <= time.Now().Unix() {
+		return "", nil, ErrDeviceCodeExpired
+	}
+	if g.Status != devicePending {
+		return "", nil, ErrDeviceCodeInvalid
+	}
+	deleteTempValue(attempts)
+	g.UserName = u.key()
+	return key, g, nil
+}
+
+func setDeviceStatus(userCode string, name string, status string) error {
+	key, g, err := findDeviceGrant(userCode, name)
+	if err != nil {
+		return err
+	}
+	g.Status = status
+	return saveDeviceGrant(key, g)
+}
+
+func getDeviceGrant(key string) (*deviceGrant, error) {
+	s := getTempValue(key)
+	if len(s) == 0 {
+		return nil, ErrDeviceCodeInvalid
+	}
+	var g deviceGrant
+	if err := json.Unmarshal([]byte(s), &g); err != nil {
+		return nil, ErrDeviceCodeInvalid
+	}
+	return &g, nil
+}
+
+// saveDeviceGrant save grant until it expired, it is kept for
+// another Config.DeviceCodeExpiresIn so expired_token can be returned
+func saveDeviceGrant(key string, g *deviceGrant) error {
+	b, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	expire := int(g.ExpiresAt-time.Now().Unix()) + Config.DeviceCodeExpiresIn
+	return setTempValue(key, string(b), expire)
+}
+
+// newUserCode 8 random characters of userCodeChars
+func newUserCode() (string, error) {
+	code := make([]byte, 0, 8)
+	b := make([]byte, 16)
+	for len(code) < cap(code) {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		for i := 0; i < len(b) && len(code) < cap(code); i++ {
+			// skip bytes not less than 240 to avoid bias, 240 = 20 * 12
+			if b[i] < 240 {
+				code = append(code, userCodeChars[int(b[i])%len(userCodeChars)])
+			}
+		}
+	}
+	return string(code), nil
+}
+
+// normalizeUserCode user may enter code in lower case and without "-"
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
@@ -0,0 +1,128 @@
+package ucenter
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// JWKSHandler http handler publish public keys of jwt
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	set, err := GetJWKS()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control",
+		"public, max-age="+strconv.Itoa(jwksMaxAge))
+	writeJSON(w, http.StatusOK, set)
+}
+
+// IntrospectionHandler http handler of token introspection (RFC 7662),
+// the caller must authenticate by a client in Config.IntrospectionClients
+func IntrospectionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeOAuthError(w, http.StatusMethodNotAllowed, "invalid_request",
+			"method must be POST")
+		return
+	}
+	if _, ok := authenticateClient(r); !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ucenter"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+	token := r.PostForm.Get("token")
+	if len(token) == 0 {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request",
+			"token is required")
+		return
+	}
+	// token_type_hint is optional, every type of token is searched
+	ret, err := IntrospectToken(token)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, ret)
+}
+
+// RevocationHandler http handler of token revocation (RFC 7009), used
+// by clients when user logout. the token must be issued to the client,
+// confidential client is authenticated and public client only sends
+// client_id. token issued to ucenter itself is revoked without client
+func RevocationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeOAuthError(w, http.StatusMethodNotAllowed, "invalid_request",
+			"method must be POST")
+		return
+	}
+	clientID, secret, err := requestClient(r)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+	if len(clientID) > 0 {
+		if _, err = authenticateOAuthClient(clientID, secret); err != nil {
+			writeTokenError(w, err)
+			return
+		}
+	} else if len(secret) > 0 {
+		writeTokenError(w, ErrOAuthClientInvalid)
+		return
+	}
+	token := r.PostForm.Get("token")
+	if len(token) == 0 {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request",
+			"token is required")
+		return
+	}
+	err = revokeToken(token, r.PostForm.Get("token_type_hint"), true, clientID)
+	if err == ErrUnsupportedTokenType {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_token_type", "")
+		return
+	}
+	if err == ErrUnauthorizedClient {
+		writeTokenError(w, err)
+		return
+	}
+	if err != nil {
+		writeOAuthError(w, http.StatusServiceUnavailable, "server_error", "")
+		return
+	}
+	// invalid token is also responded with 200
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// authenticateClient check client_id and client_secret in basic
+// authorization header or post form, it returns the client id
+func authenticateClient(r *http.Request) (string, bool) {
+	id, secret, err := requestClient(r)
+	if err != nil || len(id) == 0 || len(secret) == 0 {
+		return "", false
+	}
+	expected, ok := Config.IntrospectionClients[id]
+	if !ok || !hmac.Equal([]byte(hashToken(secret)),
+		[]byte(hashToken(expected))) {
+		return "", false
+	}
+	return id, true
+}
+
+// writeOAuthError write error response of oauth2
+func writeOAuthError(w http.ResponseWriter, status int, code string, desc string) {
+	ret := map[string]string{"error": code}
+	if len(desc) > 0 {
+		ret["error_description"] = desc
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, ret)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
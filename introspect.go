@@ -0,0 +1,224 @@
+package ucenter
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"time"
+)
+
+// TokenIntrospection information of token returned by IntrospectToken,
+// its json is the response of RFC 7662. only Active is set if the token
+// is not active
+type TokenIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	UserName  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	// Roles of user, it is not defined in RFC 7662
+	Roles []string `json:"roles,omitempty"`
+	// Tenant of user, empty for default tenant
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// token_type of introspection
+const (
+	introspectBearer  = "Bearer"
+	introspectRefresh = "refresh_token"
+)
+
+// IntrospectToken find the user of access token or refresh token and
+// check it is active, used by services which only have the token
+func IntrospectToken(token string) (*TokenIntrospection, error) {
+	if len(token) == 0 {
+		return nil, ErrParamInvalid
+	}
+	inactive := &TokenIntrospection{Active: false}
+	if ct, _ := getClientToken(token); ct != nil {
+		return clientTokenIntrospection(ct), nil
+	}
+	t, typ, claims, err := lookupToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return inactive, nil
+	}
+	iat, exp, err := tokenLifetime(t, typ)
+	if err == ErrTokenNotExist {
+		return inactive, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if exp > 0 && exp <= now {
+		return inactive, nil
+	}
+	ret := &TokenIntrospection{Active: true,
+		Scope:     tokenScope(t, typ),
+		UserName:  t.UserName,
+		Tenant:    t.Tenant,
+		TokenType: introspectBearer,
+		IssuedAt:  iat,
+		ExpiresAt: exp,
+		Issuer:    Config.JWTIssuer}
+	if typ == refreshToken {
+		ret.TokenType = introspectRefresh
+	}
+	ret.ClientID = t.ClientID
+	if claims != nil {
+		ret.IssuedAt = claims.IssuedAt
+		if typ == accessToken || claims.ExpiresAt < exp {
+			ret.ExpiresAt = claims.ExpiresAt
+		}
+	}
+	u, err := getUserByName(t.key())
+	if err != nil {
+		return nil, err
+	}
+	ret.Subject = strconv.FormatInt(u.ID, 10)
+	access, err := getUserAccess(t.key())
+	if err != nil {
+		return nil, err
+	}
+	ret.Roles = access.Roles
+	return ret, nil
+}
+
+// lookupToken find token in database or redis, jwt access token is
+// found by hash of its jti after verified. it returns nil if not found
+func lookupToken(token string) (*TokenInfo, TokenType, *AccessTokenClaims, error) {
+	stored := token
+	var claims *AccessTokenClaims
+	if Config.AccessTokenFormat == TokenFormatJWT && isJWT(token) {
+		header, _, _, err := splitJWT(token)
+		if err != nil {
+			return nil, "", nil, nil
+		}
+		key, err := verifyingKey(header.Kid)
+		if err != nil {
+			return nil, "", nil, nil
+		}
+		claims, err = parseAccessToken(token, key)
+		if err != nil {
+			return nil, "", nil, nil
+		}
+		stored = hashToken(claims.ID)
+	}
+	t, typ, err := findTokenOwner(stored)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	// access token must be jwt if it is the format
+	if t == nil || (claims != nil && typ == refreshToken) ||
+		(claims == nil && typ != refreshToken &&
+			Config.AccessTokenFormat == TokenFormatJWT) {
+		return nil, "", nil, nil
+	}
+	return t, typ, claims, nil
+}
+
+// tokenScope scopes granted to the token
+func tokenScope(t *TokenInfo, typ TokenType) string {
+	switch typ {
+	case accessToken:
+		return t.AccessScope
+	case preAccessToken:
+		return t.PreAccessScope
+	}
+	return t.Scope
+}
+
+// tokenLifetime issued time and expire time of token, 0 if unknown.
+// exp is less than now if token has expired
+func tokenLifetime(t *TokenInfo, typ TokenType) (int64, int64, error) {
+	c := tokenConfig(t.key(), t.ClientID)
+	now := time.Now().Unix()
+	if typ == refreshToken {
+		expired, err := refreshTokenExpired(t)
+		if err != nil {
+			return 0, 0, err
+		}
+		if expired {
+			return 0, now, nil
+		}
+	}
+	if redisPool != nil {
+		key := string(typ) + "@" + t.grantKey()
+		ttl, err := redisTTL(key)
+		if err != nil {
+			return 0, 0, err
+		}
+		if ttl < 0 {
+			// key never expire
+			ttl = 0
+		}
+		var iat, exp int64
+		if ttl > 0 {
+			exp = now + ttl
+		}
+		if typ == accessToken {
+			iat = exp - int64(c.TokenExpiresIn)
+		}
+		if typ == refreshToken {
+			exp = capSessionLifetime(t, exp)
+		}
+		return iat, exp, nil
+	}
+	switch typ {
+	case accessToken, preAccessToken:
+		created, err := parseDBTime(t.AccessTokenCreated)
+		if err != nil {
+			return 0, 0, err
+		}
+		if typ == preAccessToken {
+			// pre_access_token is valid for a while after refreshed
+			return 0, created.Unix() + int64(c.PreTokenExpireIn), nil
+		}
+		return created.Unix(),
+			created.Unix() + int64(c.TokenExpiresIn), nil
+	}
+	created, err := parseDBTime(t.RefreshTokenCreated)
+	if err != nil {
+		return 0, 0, err
+	}
+	var exp int64
+	if c.RefreshTokenExpiresIn > 0 {
+		exp = created.Unix() + int64(c.RefreshTokenExpiresIn)
+	}
+	return created.Unix(), capSessionLifetime(t, exp), nil
+}
+
+// capSessionLifetime refresh token can not used after the max
+// lifetime of session
+func capSessionLifetime(t *TokenInfo, exp int64) int64 {
+	lifetime := tenantConfig(t.key()).SessionMaxLifetime
+	if lifetime == 0 || t.SessionCreated == 0 {
+		return exp
+	}
+	end := t.SessionCreated + int64(lifetime)
+	if exp == 0 || end < exp {
+		return end
+	}
+	return exp
+}
+
+// redisTTL seconds before key expired, -1 if no expire
+func redisTTL(key string) (int64, error) {
+	c := redisPool.Get()
+	defer c.Close()
+	ttl, err := redis.Int64(c.Do("TTL", key))
+	if err != nil {
+		return 0, ErrGetRedis
+	}
+	if ttl == -2 {
+		// key not exist
+		return 0, ErrTokenNotExist
+	}
+	return ttl, nil
+}
@@ -0,0 +1,115 @@
+package ucenter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestIntrospectionClientAuth(t *testing.T) {
+	old := Config.IntrospectionClients
+	defer func() { Config.IntrospectionClients = old }()
+	Config.IntrospectionClients = map[string]string{"api": "secret"}
+
+	tests := []struct {
+		id, secret string
+		basic      bool
+		status     int
+	}{
+		{"", "", false, http.StatusUnauthorized},
+		{"api", "wrong", true, http.StatusUnauthorized},
+		{"other", "secret", false, http.StatusUnauthorized},
+		{"api", "secret", true, http.StatusBadRequest},
+		{"api", "secret", false, http.StatusBadRequest},
+	}
+	for i, test := range tests {
+		form := url.Values{}
+		if !test.basic {
+			form.Set("client_id", test.id)
+			form.Set("client_secret", test.secret)
+		}
+		r := httptest.NewRequest("POST", "/introspect",
+			strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.basic {
+			r.SetBasicAuth(test.id, test.secret)
+		}
+		w := httptest.NewRecorder()
+		IntrospectionHandler(w, r)
+		if w.Code != test.status {
+			t.Error(i, "status should be", test.status, "but", w.Code,
+				w.Body.String())
+		}
+	}
+}
+
+func revokeRequest(form url.Values, id string, secret string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/revoke",
+		strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(id) > 0 {
+		r.SetBasicAuth(id, secret)
+	}
+	w := httptest.NewRecorder()
+	RevocationHandler(w, r)
+	return w
+}
+
+func TestRevocationHandler(t *testing.T) {
+	tests := []struct {
+		form   url.Values
+		status int
+	}{
+		{url.Values{}, http.StatusBadRequest},
+		{url.Values{"token": {"a"}, "token_type_hint": {"id_token"}},
+			http.StatusBadRequest},
+		{url.Values{"token": {"a"}, "client_secret": {"secret"}},
+			http.StatusUnauthorized},
+	}
+	for i, test := range tests {
+		w := revokeRequest(test.form, "", "")
+		if w.Code != test.status {
+			t.Error(i, "status should be", test.status, "but", w.Code,
+				w.Body.String())
+		}
+	}
+}
+
+func TestRevocationClient(t *testing.T) {
+	requireMySQL(t)
+	client := &OAuthClient{Name: "test", Confidential: true,
+		RedirectURIs: []string{"https://app.example.com/cb"}}
+	if err := CreateOAuthClient(client); err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteOAuthClient(client.ID)
+	if w := revokeRequest(url.Values{"token": {"a"}}, client.ID,
+		"wrong"); w.Code != http.StatusUnauthorized {
+		t.Error("wrong secret should fail:", w.Code)
+	}
+	ret, err := UserLogin("sails", "twtpsu31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// token of user login by ucenter is not issued to the client
+	form := url.Values{"token": {ret.AccessToken}}
+	w := revokeRequest(form, client.ID, client.Secret)
+	if w.Code != http.StatusBadRequest {
+		t.Fatal("token of other client should not be revoked:", w.Code)
+	}
+	if err = CheckAccessToken("sails", ret.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+	if w = revokeRequest(form, "", ""); w.Code != http.StatusOK {
+		t.Fatal("token should be revoked:", w.Code, w.Body.String())
+	}
+	if CheckAccessToken("sails", ret.AccessToken) == nil {
+		t.Fatal("revoked token should be invalid")
+	}
+	if CheckAccessToken("sails", "nil") == nil ||
+		CheckAccessToken("sails", "") == nil {
+		t.Fatal("sentinel of cache should not be valid token")
+	}
+}
@@ -0,0 +1,328 @@
+package ucenter
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// algorithms of jwt
+const (
+	JWTAlgHS256 = "HS256"
+	JWTAlgRS256 = "RS256"
+	JWTAlgEdDSA = "EdDSA"
+)
+
+// TokenFormatJWT value of Config.AccessTokenFormat for jwt access token
+const TokenFormatJWT = "jwt"
+
+// typ in header of jwt, access token uses "at+jwt" of RFC 9068
+// so id token and other jwt can not be used as access token
+const (
+	jwtTypJWT         = "JWT"
+	jwtTypAccessToken = "at+jwt"
+)
+
+// AccessTokenClaims claims of jwt access token, Subject is id of user
+type AccessTokenClaims struct {
+	Issuer    string `json:"iss,omitempty"`
+	Subject   string `json:"sub"`
+	UserName  string `json:"name"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+	// Scope granted scopes split by space
+	Scope string `json:"scope,omitempty"`
+	// Tenant of user, empty for default tenant
+	Tenant string `json:"tenant,omitempty"`
+	// ClientID oauth client the token issued to
+	ClientID string `json:"client_id,omitempty"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// signingKey key to sign and verify jwt
+type signingKey struct {
+	ID      string
+	Alg     string
+	Secret  []byte        // HS256
+	Private crypto.Signer // RS256, EdDSA
+	Public  crypto.PublicKey
+}
+
+func (k *signingKey) sign(data []byte) ([]byte, error) {
+	switch k.Alg {
+	case JWTAlgHS256:
+		mac := hmac.New(sha256.New, k.Secret)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	case JWTAlgRS256:
+		hash := sha256.Sum256(data)
+		return k.Private.Sign(rand.Reader, hash[:], crypto.SHA256)
+	case JWTAlgEdDSA:
+		return k.Private.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	return nil, ErrJWTAlgorithm
+}
+
+func (k *signingKey) verify(data []byte, sig []byte) bool {
+	switch k.Alg {
+	case JWTAlgHS256:
+		mac := hmac.New(sha256.New, k.Secret)
+		mac.Write(data)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case JWTAlgRS256:
+		pub, ok := k.Public.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		hash := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig) == nil
+	case JWTAlgEdDSA:
+		pub, ok := k.Public.(ed25519.PublicKey)
+		if !ok {
+			return false
+		}
+		return ed25519.Verify(pub, data, sig)
+	}
+	return false
+}
+
+// newVerifyKey create key for verify jwt, key is []byte for HS256,
+// *rsa.PublicKey for RS256 and ed25519.PublicKey for EdDSA
+func newVerifyKey(key interface{}) (*signingKey, error) {
+	switch k := key.(type) {
+	case []byte:
+		return &signingKey{Alg: JWTAlgHS256, Secret: k}, nil
+	case *rsa.PublicKey:
+		return &signingKey{Alg: JWTAlgRS256, Public: k}, nil
+	case ed25519.PublicKey:
+		return &signingKey{Alg: JWTAlgEdDSA, Public: k}, nil
+	}
+	return nil, ErrJWTAlgorithm
+}
+
+// configSigningKey key configured by Config.JWTAlgorithm,
+// Config.JWTSecret and Config.JWTPrivateKey
+func configSigningKey() (*signingKey, error) {
+	switch Config.JWTAlgorithm {
+	case JWTAlgHS256:
+		if len(Config.JWTSecret) == 0 {
+			return nil, ErrJWTKeyNotSet
+		}
+		return &signingKey{Alg: JWTAlgHS256,
+			Secret: []byte(Config.JWTSecret)}, nil
+	case JWTAlgRS256, JWTAlgEdDSA:
+		if Config.JWTPrivateKey == nil {
+			return nil, ErrJWTKeyNotSet
+		}
+		k := &signingKey{Alg: Config.JWTAlgorithm,
+			Private: Config.JWTPrivateKey,
+			Public:  Config.JWTPrivateKey.Public()}
+		_, isRSA := k.Public.(*rsa.PublicKey)
+		_, isEd := k.Public.(ed25519.PublicKey)
+		if (k.Alg == JWTAlgRS256 && !isRSA) ||
+			(k.Alg == JWTAlgEdDSA && !isEd) {
+			return nil, ErrJWTAlgorithm
+		}
+		der, err := x509.MarshalPKIXPublicKey(k.Public)
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.Sum256(der)
+		k.ID = base64.RawURLEncoding.EncodeToString(hash[:12])
+		return k, nil
+	}
+	return nil, ErrJWTAlgorithm
+}
+
+// signJWT create jwt of the typ signed by the key
+func signJWT(key *signingKey, typ string, claims interface{}) (string, error) {
+	header, err := json.Marshal(jwtHeader{key.Alg, typ, key.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	sig, err := key.sign([]byte(signed))
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// splitJWT decode header and payload of jwt without verify it
+func splitJWT(token string) (*jwtHeader, []byte, []byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, nil, ErrJWTInvalid
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, nil, ErrJWTInvalid
+	}
+	var header jwtHeader
+	if err = json.Unmarshal(b, &header); err != nil {
+		return nil, nil, nil, ErrJWTInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, nil, ErrJWTInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, nil, ErrJWTInvalid
+	}
+	return &header, payload, sig, nil
+}
+
+// verifyJWT verify signature of jwt and return its payload,
+// algorithm in header must be the algorithm of key
+func verifyJWT(token string, key *signingKey) ([]byte, error) {
+	header, payload, sig, err := splitJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != key.Alg {
+		return nil, ErrJWTAlgorithm
+	}
+	signed := token[:strings.LastIndex(token, ".")]
+	if !key.verify([]byte(signed), sig) {
+		return nil, ErrSignatureInvalid
+	}
+	return payload, nil
+}
+
+// isJWT jwt has three parts but opaque token has only one
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// ParseAccessToken verify jwt access token offline, used by services
+// which not connect to database or redis of ucenter. key is []byte for
+// HS256, *rsa.PublicKey for RS256 and ed25519.PublicKey for EdDSA
+func ParseAccessToken(token string, key interface{}) (*AccessTokenClaims, error) {
+	k, err := newVerifyKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return parseAccessToken(token, k)
+}
+
+// parseAccessToken typ of access token must be "at+jwt", and it
+// can not have aud or nonce which are claims of id token
+func parseAccessToken(token string, key *signingKey) (*AccessTokenClaims, error) {
+	payload, err := verifyJWT(token, key)
+	if err != nil {
+		return nil, err
+	}
+	header, _, _, err := splitJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	typ := strings.TrimPrefix(strings.ToLower(header.Typ), "application/")
+	if typ != jwtTypAccessToken {
+		return nil, ErrJWTType
+	}
+	var idClaims struct {
+		Audience json.RawMessage `json:"aud"`
+		Nonce    json.RawMessage `json:"nonce"`
+	}
+	if err = json.Unmarshal(payload, &idClaims); err != nil {
+		return nil, ErrJWTInvalid
+	}
+	if idClaims.Audience != nil || idClaims.Nonce != nil {
+		return nil, ErrJWTType
+	}
+	var claims AccessTokenClaims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrJWTInvalid
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+	return &claims, nil
+}
+
+// newAccessToken create access token for user, the second value
+// is saved in database or redis, it is hash of jti if token is jwt,
+// so jti can not be used as an opaque token
+func newAccessToken(name string, scope string, client string) (string, string, error) {
+	if Config.AccessTokenFormat != TokenFormatJWT {
+		token, err := randomToken(32)
+		if err != nil {
+			return "", "", err
+		}
+		return token, token, nil
+	}
+	u, err := getUserByName(name)
+	if err != nil {
+		return "", "", err
+	}
+	key, err := currentSigningKey()
+	if err != nil {
+		return "", "", err
+	}
+	jti, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now().Unix()
+	claims := AccessTokenClaims{
+		Issuer:    Config.JWTIssuer,
+		Subject:   strconv.FormatInt(u.ID, 10),
+		UserName:  u.UserName,
+		IssuedAt:  now,
+		ExpiresAt: now + int64(tokenConfig(name, client).TokenExpiresIn),
+		ID:        jti,
+		Scope:     scope,
+		Tenant:    u.Tenant,
+		ClientID:  client,
+	}
+	token, err := signJWT(key, jwtTypAccessToken, claims)
+	if err != nil {
+		return "", "", err
+	}
+	return token, hashToken(claims.ID), nil
+}
+
+// checkJWTAccessToken check jwt access token without database or redis
+func checkJWTAccessToken(name string, token string) error {
+	header, _, _, err := splitJWT(token)
+	if err != nil {
+		return ErrAccessTokenInvalid
+	}
+	key, err := verifyingKey(header.Kid)
+	if err != nil {
+		return ErrAccessTokenInvalid
+	}
+	claims, err := parseAccessToken(token, key)
+	if err != nil {
+		if err == ErrTokenExpired {
+			return err
+		}
+		return ErrAccessTokenInvalid
+	}
+	if accountKey(claims.Tenant, claims.UserName) != name ||
+		(len(Config.JWTIssuer) > 0 && claims.Issuer != Config.JWTIssuer) {
+		return ErrAccessTokenInvalid
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package ucenter
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+)
+
+func TestJWTAccessToken(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []struct {
+		key    *signingKey
+		verify interface{}
+	}{
+		{&signingKey{Alg: JWTAlgHS256, Secret: []byte("secret")},
+			[]byte("secret")},
+		{&signingKey{Alg: JWTAlgRS256, Private: rsaKey,
+			Public: rsaKey.Public()}, rsaKey.Public()},
+		{&signingKey{Alg: JWTAlgEdDSA, Private: edKey, Public: edPub},
+			edPub},
+	}
+	now := time.Now().Unix()
+	for _, k := range keys {
+		claims := AccessTokenClaims{Subject: "1", UserName: "sails",
+			IssuedAt: now, ExpiresAt: now + 60, ID: "jti"}
+		token, err := signJWT(k.key, jwtTypAccessToken, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isJWT(token) {
+			t.Fatal("token should be jwt")
+		}
+		c, err := ParseAccessToken(token, k.verify)
+		if err != nil || c.UserName != "sails" || c.ID != "jti" {
+			t.Fatal("parse access token error", k.key.Alg, err)
+		}
+		if _, err = ParseAccessToken(token+"x", k.verify); err == nil {
+			t.Fatal("tampered token should be invalid", k.key.Alg)
+		}
+
+		claims.ExpiresAt = now - 1
+		token, _ = signJWT(k.key, jwtTypAccessToken, claims)
+		if _, err = ParseAccessToken(token, k.verify); err != ErrTokenExpired {
+			t.Fatal("expired token should be invalid", k.key.Alg)
+		}
+	}
+
+	// token of RS256 can not be verified as HS256 by public key
+	token, _ := signJWT(keys[1].key, jwtTypAccessToken, AccessTokenClaims{ExpiresAt: now + 60})
+	if _, err = ParseAccessToken(token, []byte("secret")); err != ErrJWTAlgorithm {
+		t.Fatal("algorithm should be checked")
+	}
+
+	// id token can not be used as access token
+	token, _ = signJWT(keys[2].key, jwtTypJWT,
+		AccessTokenClaims{UserName: "sails", ExpiresAt: now + 60})
+	if _, err = ParseAccessToken(token, keys[2].verify); err != ErrJWTType {
+		t.Fatal("typ should be checked")
+	}
+	token, _ = signJWT(keys[2].key, jwtTypAccessToken, map[string]interface{}{
+		"sub": "1", "name": "sails", "aud": "client", "exp": now + 60})
+	if _, err = ParseAccessToken(token, keys[2].verify); err != ErrJWTType {
+		t.Fatal("aud should be rejected")
+	}
+	token, _ = signJWT(keys[2].key, jwtTypAccessToken, map[string]interface{}{
+		"sub": "1", "name": "sails", "nonce": "n", "exp": now + 60})
+	if _, err = ParseAccessToken(token, keys[2].verify); err != ErrJWTType {
+		t.Fatal("nonce should be rejected")
+	}
+}
+
+func TestCheckJWTAccessToken(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	Config.AccessTokenFormat = TokenFormatJWT
+	Config.JWTAlgorithm = JWTAlgEdDSA
+	Config.JWTPrivateKey = edKey
+	defer func() {
+		Config.AccessTokenFormat = ""
+		Config.JWTPrivateKey = nil
+	}()
+	key, err := configSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	token, _ := signJWT(key, jwtTypAccessToken, AccessTokenClaims{UserName: "sails",
+		IssuedAt: now, ExpiresAt: now + 60})
+	if err = CheckAccessToken("sails", token); err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckAccessToken("other", token); err != ErrAccessTokenInvalid {
+		t.Fatal("name should be checked")
+	}
+}
@@ -0,0 +1,530 @@
+package ucenter
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// keyReloadInterval min seconds between reload keys for unknown kid,
+// and max seconds before reload the active key rotated by other instance
+const keyReloadInterval = 10
+
+// keyRotateLockTimeout seconds to wait for other instance rotating key
+const keyRotateLockTimeout = 10
+
+// jwksMaxAge seconds JWKS can be cached, new key is published that
+// long before it signs, so cached JWKS can verify tokens signed by it
+const jwksMaxAge = 300
+
+// managedKey signing key saved in database
+type managedKey struct {
+	signingKey
+	// Created time of key begin to sign, it is later than the time of
+	// rotation if there was an active key
+	Created int64
+	// Retired time of key is not used for signing, 0 if no key
+	// will replace it
+	Retired int64
+	// Expires time of key can be deleted, all tokens signed by it expired
+	Expires int64
+}
+
+// keyManager signing keys loaded from database, newest first
+type keyManager struct {
+	sync.RWMutex
+	keys   []*managedKey
+	loaded int64
+	// rotating only one goroutine rotate key, others wait for it
+	rotating sync.Mutex
+}
+
+var signingKeys keyManager
+
+// JSONWebKey public key in JWKS
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JSONWebKeySet document of JWKS
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// currentSigningKey key used to sign jwt, Config.JWTPrivateKey or
+// Config.JWTSecret is used if configured, otherwise the active key
+// in database, it will rotate if older than Config.JWTKeyRotateIn.
+// keys are reloaded every keyReloadInterval, so the key rotated by
+// other instance is used instead of rotating again
+func currentSigningKey() (*signingKey, error) {
+	if useConfigSigningKey() {
+		return configSigningKey()
+	}
+	k, err := signingKeys.active()
+	if err != nil {
+		return nil, err
+	}
+	if keyNeedRotate(k, time.Now().Unix()) {
+		if k, err = signingKeys.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return &k.signingKey, nil
+}
+
+// keyNeedRotate key is not set, not of Config.JWTAlgorithm
+// or older than Config.JWTKeyRotateIn, and no new key will replace it
+func keyNeedRotate(k *managedKey, now int64) bool {
+	if k == nil {
+		return true
+	}
+	return k.Retired == 0 && (k.Alg != Config.JWTAlgorithm ||
+		(Config.JWTKeyRotateIn > 0 &&
+			now-k.Created >= int64(Config.JWTKeyRotateIn)))
+}
+
+// verifyingKey find key to verify jwt by kid, retired keys are used
+// until all tokens signed by them expired
+func verifyingKey(kid string) (*signingKey, error) {
+	if useConfigSigningKey() {
+		return configSigningKey()
+	}
+	k, err := signingKeys.find(kid)
+	if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		return nil, ErrJWTKeyNotSet
+	}
+	return &k.signingKey, nil
+}
+
+func useConfigSigningKey() bool {
+	return Config.JWTPrivateKey != nil || len(Config.JWTSecret) > 0
+}
+
+// RotateSigningKey create a new signing key of Config.JWTAlgorithm,
+// it is published in JWKS jwksMaxAge seconds before it replaces the
+// old key, the old key is still used to verify tokens before they
+// expire. It returns kid of the new key
+func RotateSigningKey() (string, error) {
+	signingKeys.rotating.Lock()
+	defer signingKeys.rotating.Unlock()
+	unlock, err := lockSigningKeys()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	return rotateSigningKey()
+}
+
+// rotateSigningKey rotate key, caller must hold the locks
+func rotateSigningKey() (string, error) {
+	k, private, err := newManagedKey(Config.JWTAlgorithm)
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := encryptSecret(private)
+	if err != nil {
+		return "", err
+	}
+	var public string
+	if k.Public != nil {
+		der, err := x509.MarshalPKIXPublicKey(k.Public)
+		if err != nil {
+			return "", err
+		}
+		public = base64.StdEncoding.EncodeToString(der)
+	}
+	if err = signingKeys.load(); err != nil {
+		return "", err
+	}
+	now := time.Now().Unix()
+	// old key signs until cached JWKS has the new key
+	activated := now
+	if signingKeys.loadedActive() != nil {
+		activated = now + jwksMaxAge
+	}
+	sql := "insert into " + Config.SigningKeyTableName +
+		"(kid, alg, private_key, public_key, created, retired, expires)" +
+		" values(?, ?, ?, ?, ?, 0, 0)"
+	_, err = db.Exec(sql, k.ID, k.Alg, encrypted, public, activated)
+	if err != nil {
+		return "", err
+	}
+	sql = "update " + Config.SigningKeyTableName +
+		" set retired = ?, expires = ? where retired = 0 and kid != ?"
+	_, err = db.Exec(sql, activated,
+		activated+int64(signedTokenLifetime()), k.ID)
+	if err != nil {
+		return "", err
+	}
+	sql = "delete from " + Config.SigningKeyTableName +
+		" where expires > 0 and expires < ?"
+	_, err = db.Exec(sql, now)
+	if err != nil {
+		return "", err
+	}
+	if err = signingKeys.load(); err != nil {
+		return "", err
+	}
+	return k.ID, nil
+}
+
+// GetJWKS public keys used to verify jwt, for the services which
+// verify tokens offline, new key is included before it signs.
+// HS256 keys are not included
+func GetJWKS() (*JSONWebKeySet, error) {
+	var keys []*signingKey
+	if useConfigSigningKey() {
+		k, err := configSigningKey()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	} else {
+		if err := signingKeys.ensureFresh(); err != nil {
+			return nil, err
+		}
+		signingKeys.RLock()
+		for i := 0; i < len(signingKeys.keys); i++ {
+			keys = append(keys, &signingKeys.keys[i].signingKey)
+		}
+		signingKeys.RUnlock()
+	}
+	set := &JSONWebKeySet{Keys: []JSONWebKey{}}
+	for i := 0; i < len(keys); i++ {
+		jwk, ok := publicJWK(keys[i])
+		if ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set, nil
+}
+
+// ParseJWKS parse JWKS document, return public keys by kid which can
+// be used by ParseAccessToken
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set JSONWebKeySet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for i := 0; i < len(set.Keys); i++ {
+		pub, err := parseJWK(&set.Keys[i])
+		if err != nil {
+			continue
+		}
+		keys[set.Keys[i].Kid] = pub
+	}
+	return keys, nil
+}
+
+func publicJWK(k *signingKey) (JSONWebKey, bool) {
+	switch pub := k.Public.(type) {
+	case *rsa.PublicKey:
+		return JSONWebKey{Kty: "RSA", Kid: k.ID, Use: "sig", Alg: k.Alg,
+			N: base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(
+				big.NewInt(int64(pub.E)).Bytes())}, true
+	case ed25519.PublicKey:
+		return JSONWebKey{Kty: "OKP", Kid: k.ID, Use: "sig", Alg: k.Alg,
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(pub)}, true
+	}
+	return JSONWebKey{}, false
+}
+
+func parseJWK(jwk *JSONWebKey) (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, ErrJWTKeyInvalid
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || jwk.Crv != "Ed25519" ||
+			len(x) != ed25519.PublicKeySize {
+			return nil, ErrJWTKeyInvalid
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, ErrJWTKeyInvalid
+}
+
+// signedTokenLifetime the longest lifetime of tokens signed by key
+func signedTokenLifetime() int {
+	return maxTokenExpiresIn()
+}
+
+// newManagedKey generate key and its private part to save
+func newManagedKey(alg string) (*managedKey, []byte, error) {
+	kid, err := randomToken(12)
+	if err != nil {
+		return nil, nil, err
+	}
+	k := &managedKey{Created: time.Now().Unix()}
+	k.ID = kid
+	k.Alg = alg
+	switch alg {
+	case JWTAlgHS256:
+		k.Secret, err = randomBytes(32)
+		if err != nil {
+			return nil, nil, err
+		}
+		return k, k.Secret, nil
+	case JWTAlgRS256:
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, nil, err
+		}
+		k.Private = private
+	case JWTAlgEdDSA:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		k.Private = private
+	default:
+		return nil, nil, ErrJWTAlgorithm
+	}
+	k.Public = k.Private.Public()
+	der, err := x509.MarshalPKCS8PrivateKey(k.Private)
+	if err != nil {
+		return nil, nil, err
+	}
+	return k, der, nil
+}
+
+func (m *keyManager) ensureLoaded() error {
+	m.RLock()
+	loaded := m.loaded
+	m.RUnlock()
+	if loaded > 0 {
+		return nil
+	}
+	return m.load()
+}
+
+// ensureFresh reload keys if they are loaded keyReloadInterval ago,
+// so keys rotated by other instance are found
+func (m *keyManager) ensureFresh() error {
+	m.RLock()
+	loaded := m.loaded
+	m.RUnlock()
+	if time.Now().Unix()-loaded > keyReloadInterval {
+		return m.load()
+	}
+	return nil
+}
+
+// active the newest key which has begun and not retired
+func (m *keyManager) active() (*managedKey, error) {
+	if err := m.ensureFresh(); err != nil {
+		return nil, err
+	}
+	return m.loadedActive(), nil
+}
+
+func (m *keyManager) loadedActive() *managedKey {
+	m.RLock()
+	defer m.RUnlock()
+	now := time.Now().Unix()
+	for i := 0; i < len(m.keys); i++ {
+		k := m.keys[i]
+		if k.Created <= now && (k.Retired == 0 || k.Retired > now) {
+			return k
+		}
+	}
+	return nil
+}
+
+// rotate rotate key if the active key still need rotate, only one
+// goroutine of instance and one instance can rotate at the same time,
+// others use the key it created
+func (m *keyManager) rotate() (*managedKey, error) {
+	m.rotating.Lock()
+	defer m.rotating.Unlock()
+	// rotated by other goroutine while waiting
+	if k := m.loadedActive(); !keyNeedRotate(k, time.Now().Unix()) {
+		return k, nil
+	}
+	unlock, err := lockSigningKeys()
+	if err == ErrJWTKeyRotating {
+		// other instance is too slow, use the old key if it has
+		if err = m.load(); err != nil {
+			return nil, err
+		}
+		if k := m.loadedActive(); k != nil {
+			return k, nil
+		}
+		return nil, ErrJWTKeyRotating
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	// rotated by other instance while waiting
+	if err = m.load(); err != nil {
+		return nil, err
+	}
+	if k := m.loadedActive(); !keyNeedRotate(k, time.Now().Unix()) {
+		return k, nil
+	}
+	if _, err = rotateSigningKey(); err != nil {
+		return nil, err
+	}
+	if k := m.loadedActive(); k != nil {
+		return k, nil
+	}
+	return nil, ErrJWTKeyNotSet
+}
+
+// lockSigningKeys lock rotation between instances by named lock of
+// mysql, it returns function to release the lock
+func lockSigningKeys() (func(), error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	name := Config.SigningKeyTableName + "_rotate"
+	var ok int
+	err = conn.QueryRowContext(ctx, "select get_lock(?, ?)", name,
+		keyRotateLockTimeout).Scan(&ok)
+	if err != nil || ok != 1 {
+		conn.Close()
+		if err != nil {
+			fmt.Println(err)
+		}
+		return nil, ErrJWTKeyRotating
+	}
+	return func() {
+		var released int
+		err := conn.QueryRowContext(ctx, "select release_lock(?)",
+			name).Scan(&released)
+		if err != nil {
+			fmt.Println(err)
+		}
+		conn.Close()
+	}, nil
+}
+
+// find key by kid, reload keys if not found because other
+// instance may have rotated key
+func (m *keyManager) find(kid string) (*managedKey, error) {
+	if err := m.ensureLoaded(); err != nil {
+		return nil, err
+	}
+	k, loaded := m.get(kid)
+	if k == nil && time.Now().Unix()-loaded > keyReloadInterval {
+		if err := m.load(); err != nil {
+			return nil, err
+		}
+		k, _ = m.get(kid)
+	}
+	return k, nil
+}
+
+func (m *keyManager) get(kid string) (*managedKey, int64) {
+	m.RLock()
+	defer m.RUnlock()
+	now := time.Now().Unix()
+	for i := 0; i < len(m.keys); i++ {
+		k := m.keys[i]
+		if k.ID == kid && (k.Expires == 0 || k.Expires > now) {
+			return k, m.loaded
+		}
+	}
+	return nil, m.loaded
+}
+
+// load keys not expired from database
+func (m *keyManager) load() error {
+	sql := "select kid, alg, private_key, created, retired, expires from " +
+		Config.SigningKeyTableName +
+		" where expires = 0 or expires > ? order by created desc"
+	rows, err := db.Query(sql, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var keys []*managedKey
+	for rows.Next() {
+		var k managedKey
+		var encrypted string
+		if err = rows.Scan(&k.ID, &k.Alg, &encrypted, &k.Created,
+			&k.Retired, &k.Expires); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		private, err := decryptSecret(encrypted)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if k.Alg == JWTAlgHS256 {
+			k.Secret = private
+		} else {
+			parsed, err := x509.ParsePKCS8PrivateKey(private)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			signer, ok := parsed.(crypto.Signer)
+			if !ok {
+				continue
+			}
+			k.Private = signer
+			k.Public = signer.Public()
+		}
+		keys = append(keys, &k)
+	}
+	m.Lock()
+	m.keys = keys
+	m.loaded = time.Now().Unix()
+	m.Unlock()
+	return nil
+}
+
+// save signing keys, private key is encrypted by Config.SecretKey
+func createSigningKeyTable() error {
+	createStr := "create table " + Config.SigningKeyTableName + "(" +
+		"kid              varchar(64) NOT NULL," +
+		"alg              varchar(10) NOT NULL DEFAULT ''," +
+		"private_key      text NOT NULL," +
+		"public_key       text NOT NULL," +
+		"created          bigint(20) NOT NULL DEFAULT 0," +
+		"retired          bigint(20) NOT NULL DEFAULT 0," +
+		"expires          bigint(20) NOT NULL DEFAULT 0," +
+		"PRIMARY KEY (`kid`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8"
+	_, err := db.Exec(createStr)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package ucenter
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestJWKS(t *testing.T) {
+	now := time.Now().Unix()
+	for _, alg := range []string{JWTAlgRS256, JWTAlgEdDSA, JWTAlgHS256} {
+		k, _, err := newManagedKey(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jwk, ok := publicJWK(&k.signingKey)
+		if alg == JWTAlgHS256 {
+			if ok {
+				t.Fatal("secret key should not be published")
+			}
+			continue
+		}
+		data, _ := json.Marshal(JSONWebKeySet{[]JSONWebKey{jwk}})
+		keys, err := ParseJWKS(data)
+		if err != nil || keys[k.ID] == nil {
+			t.Fatal("parse jwks error", err)
+		}
+		token, err := signJWT(&k.signingKey, jwtTypAccessToken,
+			AccessTokenClaims{UserName: "sails", ExpiresAt: now + 60})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ParseAccessToken(token, keys[k.ID]); err != nil {
+			t.Fatal("verify by key of jwks error", alg, err)
+		}
+	}
+}
+
+func TestKeyNeedRotate(t *testing.T) {
+	old := Config.JWTKeyRotateIn
+	defer func() { Config.JWTKeyRotateIn = old }()
+	Config.JWTKeyRotateIn = 60
+	now := time.Now().Unix()
+	k := &managedKey{signingKey: signingKey{Alg: Config.JWTAlgorithm},
+		Created: now - 30}
+	if keyNeedRotate(k, now) {
+		t.Fatal("new key should not rotate")
+	}
+	if !keyNeedRotate(k, now+30) || !keyNeedRotate(nil, now) {
+		t.Fatal("old key or no key should rotate")
+	}
+	k.Retired = now + jwksMaxAge
+	if keyNeedRotate(k, now+30) {
+		t.Fatal("key should not rotate if new key is published")
+	}
+	k.Retired = 0
+	Config.JWTKeyRotateIn = 0
+	if keyNeedRotate(k, now+3600) {
+		t.Fatal("key should only rotate by RotateSigningKey")
+	}
+}
+
+func TestActiveKey(t *testing.T) {
+	now := time.Now().Unix()
+	next := &managedKey{Created: now + jwksMaxAge}
+	old := &managedKey{Created: now - 60, Retired: now + jwksMaxAge}
+	m := &keyManager{keys: []*managedKey{next, old}}
+	if m.loadedActive() != old {
+		t.Fatal("old key should sign before new key begin")
+	}
+	next.Created, old.Retired = now, now
+	if m.loadedActive() != next {
+		t.Fatal("new key should sign after it begin")
+	}
+}
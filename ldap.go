@@ -0,0 +1,542 @@
+package ucenter
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// LDAPConfig directory users login by, users found in directory are
+// authenticated by it and saved in user table, other users login by
+// password in user table
+type LDAPConfig struct {
+	// Addr host:port of ldap server
+	Addr string
+	// UseTLS connect by ldaps
+	UseTLS bool
+	// StartTLS upgrade plain connection to tls by StartTLS
+	StartTLS bool
+	// TLSConfig used by UseTLS and StartTLS, ServerName is host of Addr
+	// if it is not set
+	TLSConfig *tls.Config
+	// BindDN and BindPassword of account to search users, search
+	// anonymously if it is empty
+	BindDN       string
+	BindPassword string
+	// BaseDN users are searched under it
+	BaseDN string
+	// UserFilter filter to find user, %s is replaced by escaped user
+	// name, default is (uid=%s)
+	UserFilter string
+	// attributes mapped to UserInfo, default is cn, mail and mobile
+	NicknameAttribute string
+	EmailAttribute    string
+	MobileAttribute   string
+	// Timeout seconds of connection, default is 10
+	Timeout int
+}
+
+// ldapEntry entry found by search, names of attributes are lower case
+type ldapEntry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// ldapConn connection to ldap server
+type ldapConn struct {
+	conn  net.Conn
+	msgID int64
+}
+
+// tags of ldap messages (RFC 4511)
+const (
+	ldapBindRequest       = 0x60
+	ldapBindResponse      = 0x61
+	ldapUnbindRequest     = 0x42
+	ldapSearchRequest     = 0x63
+	ldapSearchResultEntry = 0x64
+	ldapSearchResultDone  = 0x65
+	ldapExtendedRequest   = 0x77
+	ldapExtendedResponse  = 0x78
+)
+
+// result codes of ldap
+const (
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+// ldapStartTLSOID name of StartTLS extended request
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// ldapConnector connector of identities linking users to directory,
+// external id is the user name
+const ldapConnector = "ldap"
+
+// LinkLDAPUser link local user to directory user of the same name, so
+// he can login by directory instead of local password. password is of
+// the directory user, caller must make sure the local user has been
+// authenticated
+func LinkLDAPUser(name string, password string) error {
+	if Config.LDAP == nil {
+		return ErrParamInvalid
+	}
+	u, err := getUserByName(accountKey("", name))
+	if err != nil {
+		return err
+	}
+	e, err := ldapAuthenticate(Config.LDAP, u.UserName, password)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return ErrUserNotExist
+	}
+	sql := "insert into " + Config.IdentityTableName +
+		"(connector, external_id, user_id) values(?, ?, ?)"
+	_, err = db.Exec(sql, ldapConnector, u.UserName, u.ID)
+	return err
+}
+
+// ldapLogin authenticate user by directory, the user linked to it is
+// created or updated by attributes. nil if user is not in directory.
+// local user of the same name not linked by LinkLDAPUser is refused
+func ldapLogin(name string, password string) (*UserInfo, error) {
+	e, err := ldapAuthenticate(Config.LDAP, name, password)
+	if err != nil || e == nil {
+		return nil, err
+	}
+	c := Config.LDAP
+	user := UserInfo{UserName: name,
+		Nickname: e.attribute(ldapAttributeName(c.NicknameAttribute, "cn")),
+		Email:    e.attribute(ldapAttributeName(c.EmailAttribute, "mail")),
+		Mobile:   e.attribute(ldapAttributeName(c.MobileAttribute, "mobile"))}
+	id, err := identityUserID(ldapConnector, name)
+	if err != nil {
+		return nil, err
+	}
+	var u *UserInfo
+	if id == 0 {
+		if _, err = getUserByName(name); err != ErrUserNotExist {
+			if err == nil {
+				err = ErrLDAPUserNotLinked
+			}
+			return nil, err
+		}
+		u, err = createIdentityUser(ldapConnector, name,
+			&ExternalIdentity{ID: name, UserName: name,
+				Nickname: user.Nickname, Email: user.Email})
+		if err != nil {
+			// created by concurrent login of the same user
+			if id, _ = identityUserID(ldapConnector, name); id == 0 {
+				return nil, err
+			}
+		}
+	}
+	if u == nil {
+		if u, err = getUserByID(id); err != nil {
+			return nil, err
+		}
+	}
+	if u.Nickname != user.Nickname || u.Email != user.Email ||
+		u.Mobile != user.Mobile {
+		user.ID = u.ID
+		if err = updateUserProfile(user); err != nil {
+			return nil, err
+		}
+		u.Nickname, u.Email, u.Mobile = user.Nickname, user.Email, user.Mobile
+	}
+	return u, nil
+}
+
+// ldapAuthenticate search user by account of config and bind as the
+// user to check password, nil if user is not found
+func ldapAuthenticate(c *LDAPConfig, name string, password string) (*ldapEntry, error) {
+	// bind without password is unauthenticated and always succeed
+	if len(name) == 0 || len(password) == 0 {
+		return nil, ErrParamInvalid
+	}
+	l, err := dialLDAP(c)
+	if err != nil {
+		fmt.Println(err)
+		return nil, ErrLDAPFailed
+	}
+	defer l.close()
+	if len(c.BindDN) > 0 {
+		if err = l.bind(c.BindDN, c.BindPassword); err != nil {
+			fmt.Println("ldap bind of search account failed:", err)
+			return nil, ErrLDAPFailed
+		}
+	}
+	filter := c.UserFilter
+	if len(filter) == 0 {
+		filter = "(uid=%s)"
+	}
+	filter = strings.ReplaceAll(filter, "%s", ldapEscape(name))
+	attrs := []string{ldapAttributeName(c.NicknameAttribute, "cn"),
+		ldapAttributeName(c.EmailAttribute, "mail"),
+		ldapAttributeName(c.MobileAttribute, "mobile")}
+	entries, err := l.search(c.BaseDN, filter, attrs)
+	if err != nil {
+		fmt.Println(err)
+		return nil, ErrLDAPFailed
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	if len(entries) > 1 {
+		fmt.Println("ldap filter matched more than one user:", filter)
+		return nil, ErrLDAPFailed
+	}
+	if err = l.bind(entries[0].DN, password); err != nil {
+		if err == ErrPwdInvalid {
+			return nil, err
+		}
+		fmt.Println(err)
+		return nil, ErrLDAPFailed
+	}
+	return &entries[0], nil
+}
+
+// dialLDAP connect to server, connection is closed after timeout
+func dialLDAP(c *LDAPConfig) (*ldapConn, error) {
+	timeout := time.Duration(c.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	conn, err := net.DialTimeout("tcp", c.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	l := &ldapConn{conn: conn}
+	if !c.UseTLS && !c.StartTLS {
+		return l, nil
+	}
+	if c.StartTLS {
+		if err = l.startTLS(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	cfg := &tls.Config{}
+	if c.TLSConfig != nil {
+		cfg = c.TLSConfig.Clone()
+	}
+	if len(cfg.ServerName) == 0 {
+		cfg.ServerName, _, _ = net.SplitHostPort(c.Addr)
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	l.conn = tlsConn
+	return l, nil
+}
+
+// startTLS send StartTLS request, tls handshake should start after it
+func (l *ldapConn) startTLS() error {
+	id, err := l.send(berConstructed(ldapExtendedRequest,
+		berString(0x80, ldapStartTLSOID)))
+	if err != nil {
+		return err
+	}
+	op, err := l.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.Tag != ldapExtendedResponse {
+		return ErrLDAPFailed
+	}
+	return ldapResult(op.Content)
+}
+
+// bind by simple authentication, ErrPwdInvalid if password is wrong
+func (l *ldapConn) bind(dn string, password string) error {
+	id, err := l.send(berConstructed(ldapBindRequest,
+		berInt(berInteger, 3), berString(berOctetString, dn),
+		berString(0x80, password)))
+	if err != nil {
+		return err
+	}
+	op, err := l.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.Tag != ldapBindResponse {
+		return ErrLDAPFailed
+	}
+	return ldapResult(op.Content)
+}
+
+// search entries in whole subtree of base
+func (l *ldapConn) search(base string, filter string, attrs []string) ([]ldapEntry, error) {
+	f, err := encodeLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var list [][]byte
+	for i := 0; i < len(attrs); i++ {
+		list = append(list, berString(berOctetString, attrs[i]))
+	}
+	id, err := l.send(berConstructed(ldapSearchRequest,
+		berString(berOctetString, base),
+		berInt(berEnumerated, 2), // whole subtree
+		berInt(berEnumerated, 0), // never deref aliases
+		berInt(berInteger, 2),    // two entries are enough to find duplicate
+		berInt(berInteger, 0), berBool(false), f,
+		berConstructed(berSequence, list...)))
+	if err != nil {
+		return nil, err
+	}
+	var entries []ldapEntry
+	for {
+		op, err := l.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.Tag {
+		case ldapSearchResultEntry:
+			e, err := parseLDAPEntry(op.Content)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, *e)
+		case ldapSearchResultDone:
+			if err = ldapResult(op.Content); err != nil {
+				return nil, err
+			}
+			return entries, nil
+		}
+		// search result reference is ignored
+	}
+}
+
+func (l *ldapConn) close() {
+	l.send(berEncode(ldapUnbindRequest, nil))
+	l.conn.Close()
+}
+
+// send message of operation, it returns the message id
+func (l *ldapConn) send(op []byte) (int64, error) {
+	l.msgID++
+	_, err := l.conn.Write(berConstructed(berSequence,
+		berInt(berInteger, l.msgID), op))
+	return l.msgID, err
+}
+
+// receive operation of response to message id
+func (l *ldapConn) receive(id int64) (*berElement, error) {
+	for {
+		b, err := berRead(l.conn)
+		if err != nil {
+			return nil, err
+		}
+		msg, _, err := berDecode(b)
+		if err != nil {
+			return nil, err
+		}
+		parts, err := berChildren(msg.Content)
+		if err != nil || len(parts) < 2 || parts[0].Tag != berInteger {
+			return nil, ErrBERInvalid
+		}
+		n, err := berParseInt(parts[0].Content)
+		if err != nil {
+			return nil, err
+		}
+		// unsolicited notification has id 0
+		if n == id {
+			return &parts[1], nil
+		}
+	}
+}
+
+// ldapResult error of LDAPResult in response
+func ldapResult(content []byte) error {
+	parts, err := berChildren(content)
+	if err != nil || len(parts) < 3 || parts[0].Tag != berEnumerated {
+		return ErrBERInvalid
+	}
+	code, err := berParseInt(parts[0].Content)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case ldapSuccess:
+		return nil
+	case ldapInvalidCredentials:
+		return ErrPwdInvalid
+	}
+	return fmt.Errorf("ldap error %d: %s", code, parts[2].Content)
+}
+
+func parseLDAPEntry(content []byte) (*ldapEntry, error) {
+	parts, err := berChildren(content)
+	if err != nil || len(parts) < 2 {
+		return nil, ErrBERInvalid
+	}
+	e := &ldapEntry{DN: string(parts[0].Content),
+		Attributes: map[string][]string{}}
+	attrs, err := berChildren(parts[1].Content)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(attrs); i++ {
+		attr, err := berChildren(attrs[i].Content)
+		if err != nil || len(attr) < 2 {
+			return nil, ErrBERInvalid
+		}
+		vals, err := berChildren(attr[1].Content)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(string(attr[0].Content))
+		for j := 0; j < len(vals); j++ {
+			e.Attributes[name] = append(e.Attributes[name],
+				string(vals[j].Content))
+		}
+	}
+	return e, nil
+}
+
+// attribute the first value of attribute
+func (e *ldapEntry) attribute(name string) string {
+	vals := e.Attributes[strings.ToLower(name)]
+	if len(vals) == 0 {
+		return ""
+	}
+	return vals[0]
+}
+
+// encodeLDAPFilter encode filter string (RFC 4515), and, or, not,
+// equality, presence and substrings are supported
+func encodeLDAPFilter(filter string) ([]byte, error) {
+	b, rest, err := parseLDAPFilter(filter, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, ErrLDAPFilterInvalid
+	}
+	return b, nil
+}
+
+func parseLDAPFilter(s string, depth int) ([]byte, string, error) {
+	if depth > 16 || len(s) < 3 || s[0] != '(' {
+		return nil, "", ErrLDAPFilterInvalid
+	}
+	s = s[1:]
+	switch s[0] {
+	case '&', '|':
+		tag := byte(0xa0)
+		if s[0] == '|' {
+			tag = 0xa1
+		}
+		s = s[1:]
+		var list [][]byte
+		for len(s) > 0 && s[0] == '(' {
+			b, rest, err := parseLDAPFilter(s, depth+1)
+			if err != nil {
+				return nil, "", err
+			}
+			list = append(list, b)
+			s = rest
+		}
+		if len(list) == 0 || len(s) == 0 || s[0] != ')' {
+			return nil, "", ErrLDAPFilterInvalid
+		}
+		return berConstructed(tag, list...), s[1:], nil
+	case '!':
+		b, rest, err := parseLDAPFilter(s[1:], depth+1)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(rest) == 0 || rest[0] != ')' {
+			return nil, "", ErrLDAPFilterInvalid
+		}
+		return berConstructed(0xa2, b), rest[1:], nil
+	}
+	end := strings.IndexByte(s, ')')
+	eq := strings.IndexByte(s, '=')
+	if end < 0 || eq <= 0 || eq > end {
+		return nil, "", ErrLDAPFilterInvalid
+	}
+	attr, value := s[:eq], s[eq+1:end]
+	if value == "*" {
+		return berString(0x87, attr), s[end+1:], nil
+	}
+	parts := strings.Split(value, "*")
+	if len(parts) == 1 {
+		v, err := ldapUnescape(value)
+		if err != nil {
+			return nil, "", err
+		}
+		return berConstructed(0xa3, berString(berOctetString, attr),
+			berString(berOctetString, v)), s[end+1:], nil
+	}
+	var subs [][]byte
+	for i := 0; i < len(parts); i++ {
+		if len(parts[i]) == 0 {
+			continue
+		}
+		v, err := ldapUnescape(parts[i])
+		if err != nil {
+			return nil, "", err
+		}
+		tag := byte(0x81) // any
+		if i == 0 {
+			tag = 0x80 // initial
+		} else if i == len(parts)-1 {
+			tag = 0x82 // final
+		}
+		subs = append(subs, berString(tag, v))
+	}
+	return berConstructed(0xa4, berString(berOctetString, attr),
+		berConstructed(berSequence, subs...)), s[end+1:], nil
+}
+
+// ldapEscape escape value in filter
+func ldapEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '*' || c == '(' || c == ')' || c == '\\' || c == 0 {
+			fmt.Fprintf(&b, "\\%02x", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// ldapUnescape decode \XX in value of filter
+func ldapUnescape(s string) (string, error) {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", ErrLDAPFilterInvalid
+		}
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", ErrLDAPFilterInvalid
+		}
+		b = append(b, c...)
+		i += 2
+	}
+	return string(b), nil
+}
+
+func ldapAttributeName(name string, def string) string {
+	if len(name) == 0 {
+		return def
+	}
+	return name
+}
@@ -0,0 +1,302 @@
+package ucenter
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLDAPServer in-process ldap server, users are found by equality
+// filter of uid
+type testLDAPServer struct {
+	ln  net.Listener
+	tls *tls.Config
+	sync.Mutex
+	// users attributes of entry by dn, password is userPassword
+	users map[string]map[string]string
+	// longLength encode length of messages in 4 bytes like active directory
+	longLength bool
+}
+
+// berLongLength encode length of the element in 4 bytes
+func berLongLength(b []byte) []byte {
+	e, _, _ := berDecode(b)
+	n := len(e.Content)
+	ret := []byte{e.Tag, 0x84, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	return append(ret, e.Content...)
+}
+
+func newTestLDAPServer(t *testing.T) *testLDAPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testLDAPServer{ln: ln, tls: testTLSConfig(t),
+		users: map[string]map[string]string{
+			"cn=admin,dc=example,dc=com": {"userPassword": "adminpwd"},
+			"uid=alice,ou=people,dc=example,dc=com": {"uid": "alice",
+				"userPassword": "alicepwd", "cn": "Alice",
+				"mail": "alice@example.com"},
+		}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testLDAPServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	for {
+		b, err := berRead(conn)
+		if err != nil {
+			return
+		}
+		msg, _, _ := berDecode(b)
+		parts, _ := berChildren(msg.Content)
+		id, _ := berParseInt(parts[0].Content)
+		op := parts[1]
+		write := func(op []byte) {
+			msg := berConstructed(berSequence, berInt(berInteger, id), op)
+			if s.longLength {
+				msg = berLongLength(berConstructed(berSequence,
+					berInt(berInteger, id), berLongLength(op)))
+			}
+			conn.Write(msg)
+		}
+		reply := func(tag byte, code int64, elements ...[]byte) {
+			result := append([][]byte{berInt(berEnumerated, code),
+				berString(berOctetString, ""), berString(berOctetString, "")},
+				elements...)
+			write(berConstructed(tag, result...))
+		}
+		fields, _ := berChildren(op.Content)
+		s.Lock()
+		switch op.Tag {
+		case ldapBindRequest:
+			u := s.users[string(fields[1].Content)]
+			if u == nil || u["userPassword"] != string(fields[2].Content) {
+				reply(ldapBindResponse, ldapInvalidCredentials)
+			} else {
+				reply(ldapBindResponse, ldapSuccess)
+			}
+		case ldapSearchRequest:
+			// filter is (uid=value)
+			ava, _ := berChildren(fields[6].Content)
+			for dn, u := range s.users {
+				if fields[6].Tag != 0xa3 || u["uid"] != string(ava[1].Content) {
+					continue
+				}
+				var attrs [][]byte
+				for _, name := range []string{"cn", "mail"} {
+					attrs = append(attrs, berConstructed(berSequence,
+						berString(berOctetString, name),
+						berConstructed(berSet, berString(berOctetString, u[name]))))
+				}
+				write(berConstructed(ldapSearchResultEntry,
+					berString(berOctetString, dn),
+					berConstructed(berSequence, attrs...)))
+			}
+			reply(ldapSearchResultDone, ldapSuccess)
+		case ldapExtendedRequest:
+			reply(ldapExtendedResponse, ldapSuccess)
+			tlsConn := tls.Server(conn, s.tls)
+			if tlsConn.Handshake() != nil {
+				s.Unlock()
+				return
+			}
+			conn = tlsConn
+		default:
+			s.Unlock()
+			return
+		}
+		s.Unlock()
+	}
+}
+
+// testTLSConfig self-signed certificate of 127.0.0.1, client trust it
+// by RootCAs
+func testTLSConfig(t *testing.T) *tls.Config {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject:     pkix.Name{CommonName: "ldap"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{
+		{Certificate: [][]byte{der}, PrivateKey: priv}}}
+}
+
+func TestBER(t *testing.T) {
+	for _, n := range []int64{0, 127, 128, 256, -1, -128, -129, 1 << 40} {
+		e, _, err := berDecode(berInt(berInteger, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := berParseInt(e.Content); v != n {
+			t.Error("integer error:", n, v)
+		}
+	}
+	long := bytes.Repeat([]byte("x"), 300)
+	b := berEncode(berOctetString, long)
+	e, rest, err := berDecode(b)
+	if err != nil || !bytes.Equal(e.Content, long) || len(rest) > 0 {
+		t.Error("long length error:", err)
+	}
+	if _, _, err = berDecode(b[:100]); err != ErrBERInvalid {
+		t.Error("truncated element should be invalid")
+	}
+	b = berLongLength(b)
+	e, _, err = berDecode(b)
+	if err != nil || !bytes.Equal(e.Content, long) {
+		t.Error("length of 4 bytes error:", err)
+	}
+	if r, err := berRead(bytes.NewReader(b)); err != nil || !bytes.Equal(r, b) {
+		t.Error("read length of 4 bytes error:", err)
+	}
+	b = []byte{berOctetString, 0x84, 0x7f, 0, 0, 0}
+	if _, err = berRead(bytes.NewReader(b)); err != ErrBERInvalid {
+		t.Error("too long element should be invalid")
+	}
+	b = []byte{berOctetString, 0x85, 0, 0, 0, 0, 1, 'x'}
+	if _, _, err = berDecode(b); err != ErrBERInvalid {
+		t.Error("length of 5 bytes should be invalid")
+	}
+}
+
+func TestLDAPFilter(t *testing.T) {
+	if s := ldapEscape(`a*(b)\`); s != `a\2a\28b\29\5c` {
+		t.Error("escape error:", s)
+	}
+	b, err := encodeLDAPFilter(`(&(objectClass=*)(uid=a\2ab))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := berConstructed(0xa0, berString(0x87, "objectClass"),
+		berConstructed(0xa3, berString(berOctetString, "uid"),
+			berString(berOctetString, "a*b")))
+	if !bytes.Equal(b, expected) {
+		t.Error("filter encoded error")
+	}
+	b, err = encodeLDAPFilter(`(cn=ab*c*d)`)
+	expected = berConstructed(0xa4, berString(berOctetString, "cn"),
+		berConstructed(berSequence, berString(0x80, "ab"),
+			berString(0x81, "c"), berString(0x82, "d")))
+	if err != nil || !bytes.Equal(b, expected) {
+		t.Error("substrings filter error", err)
+	}
+	for _, f := range []string{"uid=a", "(uid=a", "(&)", "(uid=a\\2)", "(!(a=b)"} {
+		if _, err = encodeLDAPFilter(f); err != ErrLDAPFilterInvalid {
+			t.Error("filter should be invalid:", f)
+		}
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	s := newTestLDAPServer(t)
+	defer s.ln.Close()
+	for _, startTLS := range []bool{false, true} {
+		c := &LDAPConfig{Addr: s.ln.Addr().String(), StartTLS: startTLS,
+			TLSConfig: &tls.Config{RootCAs: s.tls.RootCAs},
+			BindDN:    "cn=admin,dc=example,dc=com", BindPassword: "adminpwd",
+			BaseDN: "dc=example,dc=com"}
+		e, err := ldapAuthenticate(c, "alice", "alicepwd")
+		if err != nil || e == nil {
+			t.Fatal("user should be authenticated:", startTLS, err)
+		}
+		if e.attribute("mail") != "alice@example.com" ||
+			e.attribute("CN") != "Alice" {
+			t.Error("attributes error:", e.Attributes)
+		}
+		if _, err = ldapAuthenticate(c, "alice", "wrong"); err != ErrPwdInvalid {
+			t.Error("password should be invalid:", err)
+		}
+		if e, err = ldapAuthenticate(c, "*", "alicepwd"); e != nil || err != nil {
+			t.Error("user name should be escaped:", e, err)
+		}
+		c.BindPassword = "wrong"
+		if _, err = ldapAuthenticate(c, "alice", "alicepwd"); err != ErrLDAPFailed {
+			t.Error("search account should be checked:", err)
+		}
+	}
+
+	// active directory encodes length of every message in 4 bytes
+	s.Lock()
+	s.longLength = true
+	s.Unlock()
+	c := &LDAPConfig{Addr: s.ln.Addr().String(),
+		BindDN: "cn=admin,dc=example,dc=com", BindPassword: "adminpwd",
+		BaseDN: "dc=example,dc=com"}
+	e, err := ldapAuthenticate(c, "alice", "alicepwd")
+	if err != nil || e == nil || e.attribute("mail") != "alice@example.com" {
+		t.Fatal("user should be authenticated by long length:", err)
+	}
+}
+
+func TestLDAPLogin(t *testing.T) {
+	requireMySQL(t)
+	s := newTestLDAPServer(t)
+	defer s.ln.Close()
+	Config.LDAP = &LDAPConfig{Addr: s.ln.Addr().String(),
+		BaseDN: "dc=example,dc=com"}
+	defer func() { Config.LDAP = nil }()
+	if _, err := UserLogin("alice", "wrong"); err != ErrPwdInvalid {
+		t.Fatal("password should be checked by ldap:", err)
+	}
+	ret, err := UserLogin("alice", "alicepwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckAccessToken("alice", ret.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+	s.Lock()
+	s.users["uid=alice,ou=people,dc=example,dc=com"]["mail"] = "alice@corp.com"
+	s.Unlock()
+	if _, err = UserLogin("alice", "alicepwd"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := GetUserInfo("alice")
+	if err != nil || u.Email != "alice@corp.com" || u.Nickname != "Alice" {
+		t.Fatal("user should be updated by directory:", err, u)
+	}
+	// local user of the same name is not adopted until linked
+	name, _ := randomToken(6)
+	s.Lock()
+	s.users["uid="+name+",ou=people,dc=example,dc=com"] = map[string]string{
+		"uid": name, "userPassword": "dirpwd", "cn": "Local"}
+	s.Unlock()
+	UserRegister(UserInfo{UserName: name, Password: "localpwd"})
+	if _, err = UserLogin(name, "dirpwd"); err != ErrLDAPUserNotLinked {
+		t.Fatal("local user should not be adopted:", err)
+	}
+	if err = LinkLDAPUser(name, "wrong"); err != ErrPwdInvalid {
+		t.Fatal("link should check password of directory:", err)
+	}
+	if err = LinkLDAPUser(name, "dirpwd"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = UserLogin(name, "dirpwd"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,117 @@
+package ucenter
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// loginCodeDigits length of login code
+const loginCodeDigits = 6
+
+// SendLoginCode send a short numeric code to user for login without
+// password, identifier is email or mobile of user. nothing is sent
+// but no error returned if it is not of one user, so it can not be
+// used to find users, and it is limited even if no user has it
+func SendLoginCode(identifier string) error {
+	if len(identifier) == 0 {
+		return ErrParamInvalid
+	}
+	sender := Config.SMSSender
+	if isEmail(identifier) {
+		sender = Config.EmailSender
+	}
+	if sender == nil {
+		return ErrSenderNotSet
+	}
+	n, err := incrTempValue("login_code_sent@"+identifier,
+		Config.LoginCodeResendInterval)
+	if err != nil {
+		return err
+	}
+	if n > 1 {
+		return ErrLoginCodeTooFrequent
+	}
+	_, err = getUserByIdentifier(identifier)
+	if err == ErrUserNotExist || err == ErrUserAmbiguous {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	code, err := newLoginCode()
+	if err != nil {
+		return err
+	}
+	// attempts are kept until expired, so resend can not reset them
+	err = setTempValue("login_code@"+identifier,
+		hashToken(identifier+":"+code), Config.LoginCodeExpiresIn)
+	if err != nil {
+		return err
+	}
+	content := fmt.Sprintf("Your login code is %s, it will expire in %d minutes.",
+		code, (Config.LoginCodeExpiresIn+59)/60)
+	return sender.Send(identifier, "Login code", content)
+}
+
+// LoginWithCode login by the code sent by SendLoginCode, the code can
+// only be used once, and it will be invalid after too many wrong codes
+// in Config.LoginCodeExpiresIn seconds even if a new code is sent
+func LoginWithCode(identifier string, code string) (*LoginResult, error) {
+	if len(identifier) == 0 || len(code) == 0 {
+		return nil, ErrParamInvalid
+	}
+	key := "login_code@" + identifier
+	hash := getTempValue(key)
+	if len(hash) == 0 {
+		return nil, ErrLoginCodeInvalid
+	}
+	n, err := incrTempValue("login_code_attempts@"+identifier,
+		Config.LoginCodeExpiresIn)
+	if err != nil {
+		return nil, err
+	}
+	if n > Config.LoginCodeMaxAttempts {
+		deleteTempValue(key)
+		return nil, ErrLoginCodeInvalid
+	}
+	if !hmac.Equal([]byte(hashToken(identifier+":"+code)), []byte(hash)) {
+		return nil, ErrLoginCodeInvalid
+	}
+	// concurrent request with the same code only one will succeed
+	if takeTempValue(key) != hash {
+		return nil, ErrLoginCodeInvalid
+	}
+	deleteTempValue("login_code_attempts@" + identifier)
+	u, err := getUserByIdentifier(identifier)
+	if err != nil {
+		return nil, err
+	}
+	return loginUser(u, "")
+}
+
+func getUserByIdentifier(identifier string) (*UserInfo, error) {
+	if isEmail(identifier) {
+		return getUserByEmail(identifier)
+	}
+	return getUserByMobile(identifier)
+}
+
+func isEmail(identifier string) bool {
+	return strings.Contains(identifier, "@")
+}
+
+// newLoginCode random numeric code
+func newLoginCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < loginCodeDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", loginCodeDigits, n.Int64()), nil
+}
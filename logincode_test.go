@@ -0,0 +1,69 @@
+package ucenter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewLoginCode(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		code, err := newLoginCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != loginCodeDigits || isRecoveryCode(code) {
+			t.Fatal("login code format error: " + code)
+		}
+	}
+}
+
+func TestLoginWithCode(t *testing.T) {
+	sender := &MemorySender{}
+	Config.EmailSender = sender
+	requireMySQL(t)
+	user := UserInfo{UserName: "nopassword", Email: "nopassword@qq.com"}
+	UserRegister(user)
+
+	err := SendLoginCode(user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if SendLoginCode(user.Email) != ErrLoginCodeTooFrequent {
+		t.Fatal("send login code should be limited")
+	}
+	msg := sender.Last(user.Email)
+	if msg == nil {
+		t.Fatal("login code not sent")
+	}
+	code := strings.TrimPrefix(msg.Content, "Your login code is ")[:loginCodeDigits]
+	if _, err = LoginWithCode(user.Email, "000000x"); err != ErrLoginCodeInvalid {
+		t.Fatal("wrong code should fail")
+	}
+	loginRet, err := LoginWithCode(user.Email, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckAccessToken(user.UserName, loginRet.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoginWithCode(user.Email, code); err != ErrLoginCodeInvalid {
+		t.Fatal("login code should only be used once")
+	}
+	// email of two users can not identify the user
+	id, _ := randomToken(6)
+	email := "same" + id + "@qq.com"
+	UserRegister(UserInfo{UserName: "same1" + id, Email: email})
+	UserRegister(UserInfo{UserName: "same2" + id, Email: email})
+	if SendLoginCode(email) != nil || sender.Last(email) != nil {
+		t.Fatal("email of more than one user should be refused silently")
+	}
+	// unknown identifier looks the same as user, and is also limited
+	email = "nobody" + id + "@qq.com"
+	if SendLoginCode(email) != nil || sender.Last(email) != nil {
+		t.Fatal("unknown email should be refused silently")
+	}
+	if SendLoginCode(email) != ErrLoginCodeTooFrequent {
+		t.Fatal("unknown email should be limited")
+	}
+}
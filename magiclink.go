@@ -0,0 +1,178 @@
+package ucenter
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// MagicLink information of a magic link, used to show the confirm page
+type MagicLink struct {
+	Email     string
+	Redirect  string
+	ExpiresAt int64
+}
+
+// magicLinkPayload signed in the link token
+type magicLinkPayload struct {
+	ID       string `json:"id"`
+	Email    string `json:"email"`
+	Redirect string `json:"redirect"`
+	Exp      int64  `json:"exp"`
+}
+
+// SendMagicLink send a link for login to the email, redirect is the
+// page after login, it must be a path or a url in Config.MagicLinkRedirectHosts.
+// The returned binding should be saved in cookie of the browser who request
+// the link, and used by ConsumeMagicLinkInSession
+func SendMagicLink(email string, redirect string) (string, error) {
+	if len(email) == 0 || !isEmail(email) {
+		return "", ErrParamInvalid
+	}
+	if !magicLinkRedirectAllowed(redirect) {
+		return "", ErrRedirectInvalid
+	}
+	if Config.EmailSender == nil {
+		return "", ErrSenderNotSet
+	}
+	_, err := getUserByEmail(email)
+	if err != nil {
+		return "", err
+	}
+	id, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	binding, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(magicLinkPayload{id, email, redirect,
+		time.Now().Unix() + int64(Config.MagicLinkExpiresIn)})
+	if err != nil {
+		return "", err
+	}
+	token, err := signPayload("magic_link", payload)
+	if err != nil {
+		return "", err
+	}
+	err = setTempValue("magic_link@"+id, hashToken(binding),
+		Config.MagicLinkExpiresIn)
+	if err != nil {
+		return "", err
+	}
+	link := Config.MagicLinkURL
+	if strings.Contains(link, "?") {
+		link += "&token=" + url.QueryEscape(token)
+	} else {
+		link += "?token=" + url.QueryEscape(token)
+	}
+	content := "Click the link to login, it will expire in " +
+		(time.Duration(Config.MagicLinkExpiresIn) * time.Second).String() +
+		":\n" + link
+	err = Config.EmailSender.Send(email, "Login link", content)
+	if err != nil {
+		return "", err
+	}
+	return binding, nil
+}
+
+// CheckMagicLink check the link is valid but not use it. Mail scanners
+// may open the link, so the page of link should only show a confirm
+// button, and login by ConsumeMagicLink after user click it
+func CheckMagicLink(token string) (*MagicLink, error) {
+	p, err := parseMagicLink(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(getTempValue("magic_link@"+p.ID)) == 0 {
+		return nil, ErrMagicLinkInvalid
+	}
+	return &MagicLink{p.Email, p.Redirect, p.Exp}, nil
+}
+
+// ConsumeMagicLink login by magic link, every link can only used once.
+// it can not be used if Config.MagicLinkBindSession is true
+func ConsumeMagicLink(token string) (*LoginResult, error) {
+	if Config.MagicLinkBindSession {
+		return nil, ErrMagicLinkSession
+	}
+	return consumeMagicLink(token, "")
+}
+
+// ConsumeMagicLinkInSession login by magic link in the browser which
+// request it, binding is the value returned by SendMagicLink
+func ConsumeMagicLinkInSession(token string, binding string) (*LoginResult, error) {
+	if len(binding) == 0 {
+		return nil, ErrMagicLinkSession
+	}
+	return consumeMagicLink(token, binding)
+}
+
+func consumeMagicLink(token string, binding string) (*LoginResult, error) {
+	p, err := parseMagicLink(token)
+	if err != nil {
+		return nil, err
+	}
+	key := "magic_link@" + p.ID
+	bindingHash := getTempValue(key)
+	if len(bindingHash) == 0 {
+		return nil, ErrMagicLinkInvalid
+	}
+	if len(binding) > 0 &&
+		!hmac.Equal([]byte(hashToken(binding)), []byte(bindingHash)) {
+		return nil, ErrMagicLinkSession
+	}
+	if len(takeTempValue(key)) == 0 {
+		return nil, ErrMagicLinkInvalid
+	}
+	u, err := getUserByEmail(p.Email)
+	if err != nil {
+		return nil, err
+	}
+	return loginUser(u, "")
+}
+
+func parseMagicLink(token string) (*magicLinkPayload, error) {
+	payload, err := verifyPayload("magic_link", token)
+	if err != nil {
+		return nil, ErrMagicLinkInvalid
+	}
+	var p magicLinkPayload
+	if err = json.Unmarshal(payload, &p); err != nil {
+		return nil, ErrMagicLinkInvalid
+	}
+	if time.Now().Unix() > p.Exp {
+		return nil, ErrMagicLinkInvalid
+	}
+	return &p, nil
+}
+
+// magicLinkRedirectAllowed only path of this site or url of allowed
+// hosts can be used as redirect, so the link can not redirect to other site
+func magicLinkRedirectAllowed(redirect string) bool {
+	if len(redirect) == 0 {
+		return true
+	}
+	u, err := url.Parse(redirect)
+	if err != nil {
+		return false
+	}
+	if len(u.Scheme) == 0 && len(u.Host) == 0 {
+		// "//evil.com" and "/\evil.com" are treated as host by browser
+		return strings.HasPrefix(redirect, "/") &&
+			!strings.HasPrefix(redirect, "//") &&
+			!strings.HasPrefix(redirect, "/\\")
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return false
+	}
+	for i := 0; i < len(Config.MagicLinkRedirectHosts); i++ {
+		if u.Host == Config.MagicLinkRedirectHosts[i] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package ucenter
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMagicLinkRedirect(t *testing.T) {
+	Config.MagicLinkRedirectHosts = []string{"www.example.com"}
+	defer func() { Config.MagicLinkRedirectHosts = nil }()
+	allowed := []string{"", "/", "/user/home?tab=1",
+		"https://www.example.com/home"}
+	for _, r := range allowed {
+		if !magicLinkRedirectAllowed(r) {
+			t.Fatal("redirect should be allowed: " + r)
+		}
+	}
+	denied := []string{"//evil.com", "/\\evil.com", "https://evil.com/",
+		"javascript:alert(1)", "home"}
+	for _, r := range denied {
+		if magicLinkRedirectAllowed(r) {
+			t.Fatal("redirect should be denied: " + r)
+		}
+	}
+}
+
+func TestParseMagicLink(t *testing.T) {
+	Config.SecretKey = "test secret key"
+	defer func() { Config.SecretKey = "" }()
+	token, err := signPayload("magic_link",
+		[]byte(`{"id":"1","email":"sailsxu@qq.com","exp":`+
+			strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)+`}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := parseMagicLink(token)
+	if err != nil || p.Email != "sailsxu@qq.com" {
+		t.Fatal("parse magic link error", err)
+	}
+	if _, err = parseMagicLink(token + "x"); err != ErrMagicLinkInvalid {
+		t.Fatal("tampered link should be invalid")
+	}
+	token, _ = signPayload("magic_link",
+		[]byte(`{"id":"1","email":"sailsxu@qq.com","exp":1}`))
+	if _, err = parseMagicLink(token); err != ErrMagicLinkInvalid {
+		t.Fatal("expired link should be invalid")
+	}
+	token, _ = signPayload("other", []byte(`{"id":"1","exp":99999999999}`))
+	if _, err = parseMagicLink(token); err != ErrMagicLinkInvalid {
+		t.Fatal("token for other purpose should be invalid")
+	}
+}
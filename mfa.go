@@ -0,0 +1,248 @@
+package ucenter
+
+import (
+	"fmt"
+	"time"
+)
+
+// mfaMaxAttempts max wrong codes for one login challenge, or for
+// confirm enrollment in Config.MFAChallengeExpiresIn seconds
+const mfaMaxAttempts = 5
+
+// TOTPEnrollment returned when user begin to enroll totp,
+// URI used to create QR code, Secret used to input by hand
+type TOTPEnrollment struct {
+	Secret string
+	URI    string
+}
+
+// mfaInfo mfa settings of user saved in database
+type mfaInfo struct {
+	UserID      int64
+	TOTPSecret  string
+	TOTPEnabled bool
+	TOTPLast    int64
+}
+
+// EnrollTOTP create a new totp secret for user, the secret will be used
+// after user confirmed it by ConfirmTOTP
+func EnrollTOTP(name string) (*TOTPEnrollment, error) {
+	u, err := getUserByName(accountKey("", name))
+	if err != nil {
+		return nil, err
+	}
+	m, err := getMFAInfo(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil && m.TOTPEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptSecret([]byte(secret))
+	if err != nil {
+		return nil, err
+	}
+	sql := "replace into " + Config.MFATableName +
+		"(user_id, totp_secret, totp_enabled, totp_last_step, totp_created)" +
+		" values(?, ?, 0, 0, now())"
+	_, err = db.Exec(sql, u.ID, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	return &TOTPEnrollment{secret, totpURI(Config.MFAIssuer, name, secret)}, nil
+}
+
+// ConfirmTOTP enable totp after user input the first code from app,
+// it fails after too many wrong codes until the attempts expired,
+// enroll again will not reset them
+func ConfirmTOTP(name string, code string) error {
+	u, err := getUserByName(accountKey("", name))
+	if err != nil {
+		return err
+	}
+	m, err := getMFAInfo(u.ID)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return ErrMFANotEnrolled
+	}
+	if m.TOTPEnabled {
+		return ErrMFAAlreadyEnabled
+	}
+	attempts := "mfa_confirm_attempts@" + u.key()
+	n, err := incrTempValue(attempts, Config.MFAChallengeExpiresIn)
+	if err != nil {
+		return err
+	}
+	if n > mfaMaxAttempts {
+		return ErrMFACodeInvalid
+	}
+	err = useTOTPCode(m, code)
+	if err != nil {
+		return err
+	}
+	deleteTempValue(attempts)
+	sql := "update " + Config.MFATableName +
+		" set totp_enabled = 1 where user_id = ?"
+	_, err = db.Exec(sql, u.ID)
+	return err
+}
+
+// DisableTOTP remove totp and recovery codes of user,
+// caller must make sure the user has been authenticated
+func DisableTOTP(name string) error {
+	u, err := getUserByName(accountKey("", name))
+	if err != nil {
+		return err
+	}
+	err = deleteRecoveryCodes(u.ID)
+	if err != nil {
+		return err
+	}
+	sql := "delete from " + Config.MFATableName + " where user_id = ?"
+	_, err = db.Exec(sql, u.ID)
+	return err
+}
+
+// VerifyMFA second step of login, if the code is right
+// it will return tokens as UserLogin. code can be totp code
+// or one of the recovery codes
+func VerifyMFA(challenge string, code string) (*LoginResult, error) {
+	if len(challenge) == 0 || len(code) == 0 {
+		return nil, ErrParamInvalid
+	}
+	key := "mfa_challenge@" + challenge
+	scope, name := splitScopeValue(getTempValue(key))
+	if len(name) == 0 {
+		return nil, ErrMFAChallengeInvalid
+	}
+	n, err := incrTempValue("mfa_attempts@"+challenge,
+		Config.MFAChallengeExpiresIn)
+	if err != nil {
+		return nil, err
+	}
+	if n > mfaMaxAttempts {
+		deleteTempValue(key)
+		return nil, ErrMFAChallengeInvalid
+	}
+	u, err := getUserByName(name)
+	if err != nil {
+		return nil, err
+	}
+	m, err := getMFAInfo(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil || !m.TOTPEnabled {
+		return nil, ErrMFANotEnrolled
+	}
+	if isRecoveryCode(code) {
+		err = useRecoveryCode(u.ID, code)
+	} else {
+		err = useTOTPCode(m, code)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// challenge can only be used once
+	if len(takeTempValue(key)) == 0 {
+		return nil, ErrMFAChallengeInvalid
+	}
+	return newLoginResult(name, scope)
+}
+
+// mfaEnabled check user need the second step of login
+func mfaEnabled(userID int64) (bool, error) {
+	m, err := getMFAInfo(userID)
+	if err != nil {
+		return false, err
+	}
+	return m != nil && m.TOTPEnabled, nil
+}
+
+// newMFAChallenge create challenge for user who passed the first step
+func newMFAChallenge(name string, scope string) (string, error) {
+	challenge, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	err = setTempValue("mfa_challenge@"+challenge, joinScopeValue(scope, name),
+		Config.MFAChallengeExpiresIn)
+	if err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// useTOTPCode check the code and mark its step used,
+// so a code can not be used twice
+func useTOTPCode(m *mfaInfo, code string) error {
+	secret, err := decryptSecret(m.TOTPSecret)
+	if err != nil {
+		return err
+	}
+	step, ok := matchTOTP(string(secret), code, time.Now())
+	if !ok {
+		return ErrMFACodeInvalid
+	}
+	if step <= m.TOTPLast {
+		return ErrMFACodeReplayed
+	}
+	// compare and set, concurrent request with same code will fail
+	sql := "update " + Config.MFATableName +
+		" set totp_last_step = ? where user_id = ? and totp_last_step < ?"
+	ret, err := db.Exec(sql, step, m.UserID, step)
+	if err != nil {
+		return err
+	}
+	affected, err := ret.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrMFACodeReplayed
+	}
+	m.TOTPLast = step
+	return nil
+}
+
+func getMFAInfo(userID int64) (*mfaInfo, error) {
+	sql := "select user_id, totp_secret, totp_enabled, totp_last_step from " +
+		Config.MFATableName + " where user_id = ?"
+	rows, err := db.Query(sql, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m mfaInfo
+		if err = rows.Scan(&m.UserID, &m.TOTPSecret, &m.TOTPEnabled,
+			&m.TOTPLast); err == nil {
+			return &m, nil
+		}
+		fmt.Println(err)
+	}
+	return nil, nil
+}
+
+// save totp secret of user
+func createMFATable() error {
+	createStr := "create table " + Config.MFATableName + "(" +
+		"user_id          bigint(20) unsigned NOT NULL," +
+		"totp_secret      varchar(255) NOT NULL DEFAULT ''," +
+		"totp_enabled     tinyint(1) NOT NULL DEFAULT 0," +
+		"totp_last_step   bigint(20) NOT NULL DEFAULT 0," +
+		"totp_created     datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`user_id`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8"
+	_, err := db.Exec(createStr)
+	if err != nil {
+		return err
+	}
+	return nil
+}
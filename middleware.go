@@ -0,0 +1,71 @@
+package ucenter
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type principalKey struct{}
+
+type authOptions struct {
+	scopes []string
+}
+
+// AuthOption option of AuthMiddleware
+type AuthOption func(*authOptions)
+
+// WithScopes access token must have all the scopes
+func WithScopes(scopes ...string) AuthOption {
+	return func(o *authOptions) {
+		o.scopes = append(o.scopes, scopes...)
+	}
+}
+
+// AuthMiddleware check bearer access token in Authorization header,
+// the principal of token can be got by PrincipalFromContext in next
+func AuthMiddleware(next http.Handler, opts ...AuthOption) http.Handler {
+	var o authOptions
+	for i := 0; i < len(opts); i++ {
+		opts[i](&o)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if len(token) == 0 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ucenter"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		p, err := CheckAccessTokenScopes(token, o.scopes...)
+		if err == ErrScopeInsufficient {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ucenter", `+
+				`error="insufficient_scope", scope="`+
+				strings.Join(o.scopes, " ")+`"`)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate",
+				`Bearer realm="ucenter", error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), principalKey{}, p)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// PrincipalFromContext principal set by AuthMiddleware, nil if not exist
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// bearerToken access token in Authorization header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
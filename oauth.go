@@ -0,0 +1,684 @@
+package ucenter
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OAuthClient application which get tokens of users by oauth2
+type OAuthClient struct {
+	ID   string
+	Name string
+	// RedirectURIs authorization response can only be sent to them
+	RedirectURIs []string
+	// Scopes can be requested by client, any scope if it is empty
+	Scopes []string
+	// GrantTypes can be used by client, any grant type if it is empty
+	GrantTypes []string
+	// LogoURI logo of client shown to user when authorize
+	LogoURI string
+	// AccessTokenExpiresIn and RefreshTokenExpiresIn lifetime of tokens
+	// of users issued to client, they only take effect if shorter than
+	// lifetime of the tenant. 0 means lifetime of the tenant
+	AccessTokenExpiresIn  int
+	RefreshTokenExpiresIn int
+	// Confidential client has secret and can use client credentials
+	// grant, it need no redirect uri if only use that
+	Confidential bool
+	// Secret of confidential client, only set by CreateOAuthClient,
+	// it is saved as hash and can not be got again
+	Secret  string
+	Created string
+
+	secretHash       string
+	oldSecretHash    string
+	oldSecretExpires int64
+}
+
+// AuthorizeRequest authorization request of authorization code grant,
+// PKCE with S256 is required
+type AuthorizeRequest struct {
+	ClientID string
+	// RedirectURI in request, empty if client has only one
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	// Nonce of OpenID Connect, it is returned in id token
+	Nonce string
+}
+
+// authCode saved with authorization code until it is exchanged
+type authCode struct {
+	ClientID      string `json:"client_id"`
+	RedirectURI   string `json:"redirect_uri"`
+	UserName      string `json:"username"`
+	Scope         string `json:"scope"`
+	CodeChallenge string `json:"code_challenge"`
+	Nonce         string `json:"nonce,omitempty"`
+}
+
+// tokenResponse response of token endpoint
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// pkceS256 the only code_challenge_method supported
+const pkceS256 = "S256"
+
+// oauthGrantTypes grant types supported by token endpoint
+var oauthGrantTypes = []string{"authorization_code", "refresh_token",
+	"client_credentials", DeviceCodeGrantType}
+
+// oauthClientFields columns of client table
+const oauthClientFields = "client_id, client_name, redirect_uris, scope," +
+	" grant_types, logo_uri, access_token_expires_in," +
+	" refresh_token_expires_in, secret_hash, old_secret_hash," +
+	" old_secret_expires, created"
+
+// CreateOAuthClient register client, its ID and Secret are generated
+func CreateOAuthClient(c *OAuthClient) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	id, err := randomToken(16)
+	if err != nil {
+		return err
+	}
+	var secret, hash string
+	if c.Confidential {
+		if secret, err = randomToken(32); err != nil {
+			return err
+		}
+		hash = hashToken(secret)
+	}
+	sql := "insert into " + Config.OAuthClientTableName +
+		"(client_id, client_name, redirect_uris, scope, grant_types," +
+		" logo_uri, access_token_expires_in, refresh_token_expires_in," +
+		" secret_hash, created) values(?, ?, ?, ?, ?, ?, ?, ?, ?, now())"
+	_, err = db.Exec(sql, id, c.Name, strings.Join(c.RedirectURIs, "\n"),
+		strings.Join(c.Scopes, " "), strings.Join(c.GrantTypes, " "),
+		c.LogoURI, c.AccessTokenExpiresIn, c.RefreshTokenExpiresIn, hash)
+	if err != nil {
+		return err
+	}
+	c.ID = id
+	c.Secret = secret
+	return nil
+}
+
+// GetOAuthClient get client by id
+func GetOAuthClient(id string) (*OAuthClient, error) {
+	sql := "select " + oauthClientFields + " from " +
+		Config.OAuthClientTableName + " where client_id = ?"
+	rows, err := db.Query(sql, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		return scanOAuthClient(rows)
+	}
+	return nil, ErrOAuthClientInvalid
+}
+
+// GetOAuthClients get all clients
+func GetOAuthClients() ([]*OAuthClient, error) {
+	sql := "select " + oauthClientFields + " from " +
+		Config.OAuthClientTableName + " order by created"
+	rows, err := db.Query(sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var clients []*OAuthClient
+	for rows.Next() {
+		c, err := scanOAuthClient(rows)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		clients = append(clients, c)
+	}
+	return clients, nil
+}
+
+// UpdateOAuthClient update client of c.ID, all fields except ID,
+// Confidential and Secret are replaced. secret is changed by
+// RotateOAuthClientSecret
+func UpdateOAuthClient(c *OAuthClient) error {
+	old, err := GetOAuthClient(c.ID)
+	if err != nil {
+		return err
+	}
+	c.Confidential = old.Confidential
+	if err = c.validate(); err != nil {
+		return err
+	}
+	sql := "update " + Config.OAuthClientTableName + " set client_name = ?," +
+		" redirect_uris = ?, scope = ?, grant_types = ?, logo_uri = ?," +
+		" access_token_expires_in = ?, refresh_token_expires_in = ?" +
+		" where client_id = ?"
+	_, err = db.Exec(sql, c.Name, strings.Join(c.RedirectURIs, "\n"),
+		strings.Join(c.Scopes, " "), strings.Join(c.GrantTypes, " "),
+		c.LogoURI, c.AccessTokenExpiresIn, c.RefreshTokenExpiresIn, c.ID)
+	return err
+}
+
+func scanOAuthClient(rows *sql.Rows) (*OAuthClient, error) {
+	var c OAuthClient
+	var uris, scope, grantTypes string
+	err := rows.Scan(&c.ID, &c.Name, &uris, &scope, &grantTypes,
+		&c.LogoURI, &c.AccessTokenExpiresIn, &c.RefreshTokenExpiresIn,
+		&c.secretHash, &c.oldSecretHash, &c.oldSecretExpires, &c.Created)
+	if err != nil {
+		return nil, err
+	}
+	c.RedirectURIs = strings.Fields(uris)
+	c.Scopes = parseScope(scope)
+	c.GrantTypes = strings.Fields(grantTypes)
+	c.Confidential = len(c.secretHash) > 0
+	return &c, nil
+}
+
+// validate metadata of client, only confidential client can use
+// client credentials grant
+func (c *OAuthClient) validate() error {
+	if len(c.RedirectURIs) == 0 && !c.Confidential {
+		return ErrRedirectURIInvalid
+	}
+	for i := 0; i < len(c.RedirectURIs); i++ {
+		if !validRedirectURI(c.RedirectURIs[i]) {
+			return ErrRedirectURIInvalid
+		}
+	}
+	for i := 0; i < len(c.Scopes); i++ {
+		if !validScope(c.Scopes[i]) {
+			return ErrScopeInvalid
+		}
+	}
+	for i := 0; i < len(c.GrantTypes); i++ {
+		if !containsString(oauthGrantTypes, c.GrantTypes[i]) {
+			return ErrClientMetadataInvalid
+		}
+	}
+	if !c.Confidential && containsString(c.GrantTypes, "client_credentials") {
+		return ErrClientMetadataInvalid
+	}
+	if len(c.LogoURI) > 0 {
+		u, err := url.Parse(c.LogoURI)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") ||
+			len(u.Host) == 0 || len(c.LogoURI) > 1024 {
+			return ErrClientMetadataInvalid
+		}
+	}
+	if len(c.Name) > 255 || c.AccessTokenExpiresIn < 0 ||
+		c.RefreshTokenExpiresIn < 0 {
+		return ErrClientMetadataInvalid
+	}
+	return nil
+}
+
+// allowGrantType client can use the grant type
+func (c *OAuthClient) allowGrantType(grantType string) bool {
+	return len(c.GrantTypes) == 0 || containsString(c.GrantTypes, grantType)
+}
+
+// tokenConfig lifetime of tokens of user issued to client, lifetime
+// of client is used if it is shorter than the tenant
+func tokenConfig(name string, client string) TenantConfig {
+	tc := tenantConfig(name)
+	if len(client) == 0 {
+		return tc
+	}
+	// client has been deleted, tokens are valid until expired
+	c, err := GetOAuthClient(client)
+	if err != nil {
+		return tc
+	}
+	if c.AccessTokenExpiresIn > 0 && c.AccessTokenExpiresIn < tc.TokenExpiresIn {
+		tc.TokenExpiresIn = c.AccessTokenExpiresIn
+	}
+	if c.RefreshTokenExpiresIn > 0 && (tc.RefreshTokenExpiresIn == 0 ||
+		c.RefreshTokenExpiresIn < tc.RefreshTokenExpiresIn) {
+		tc.RefreshTokenExpiresIn = c.RefreshTokenExpiresIn
+	}
+	return tc
+}
+
+// DeleteOAuthClient delete client, tokens issued to it
+// are valid until expired
+func DeleteOAuthClient(id string) error {
+	sql := "delete from " + Config.OAuthClientTableName +
+		" where client_id = ?"
+	_, err := db.Exec(sql, id)
+	return err
+}
+
+// ParseAuthorizeRequest check authorization request, if it returns
+// ErrOAuthClientInvalid or ErrRedirectURIInvalid the error must be
+// shown to user, otherwise the error can be sent to client by
+// AuthorizeErrorURI
+func ParseAuthorizeRequest(r *http.Request) (*AuthorizeRequest, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, ErrParamInvalid
+	}
+	req := &AuthorizeRequest{ClientID: r.Form.Get("client_id"),
+		RedirectURI:         r.Form.Get("redirect_uri"),
+		Scope:               r.Form.Get("scope"),
+		State:               r.Form.Get("state"),
+		CodeChallenge:       r.Form.Get("code_challenge"),
+		CodeChallengeMethod: r.Form.Get("code_challenge_method"),
+		Nonce:               r.Form.Get("nonce")}
+	c, err := GetOAuthClient(req.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.RedirectURI) > 0 {
+		if !containsString(c.RedirectURIs, req.RedirectURI) {
+			return nil, ErrRedirectURIInvalid
+		}
+	} else if len(c.RedirectURIs) != 1 {
+		return nil, ErrRedirectURIInvalid
+	}
+	// redirect uri is valid, other errors can be sent to client
+	if r.Form.Get("response_type") != "code" {
+		return req, ErrUnsupportedResponseType
+	}
+	if !c.allowGrantType("authorization_code") {
+		return req, ErrUnauthorizedClient
+	}
+	if req.CodeChallengeMethod != pkceS256 ||
+		!validPKCEString(req.CodeChallenge) {
+		return req, ErrPKCEInvalid
+	}
+	if len(req.Nonce) > maxNonceLength {
+		return req, ErrParamInvalid
+	}
+	scope, err := normalizeScopes(parseScope(req.Scope))
+	if err != nil {
+		return req, err
+	}
+	if len(c.Scopes) > 0 && !hasScopes(strings.Join(c.Scopes, " "),
+		parseScope(scope)) {
+		return req, ErrScopeInvalid
+	}
+	req.Scope = scope
+	return req, nil
+}
+
+// Authorize issue authorization code to client for user who has login
+// and agreed, it returns the uri to redirect user back to client
+func Authorize(req *AuthorizeRequest, name string) (string, error) {
+	u, err := getUserByName(accountKey("", name))
+	if err != nil {
+		return "", err
+	}
+	code, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(&authCode{ClientID: req.ClientID,
+		RedirectURI: req.RedirectURI, UserName: u.key(),
+		Scope: req.Scope, CodeChallenge: req.CodeChallenge,
+		Nonce: req.Nonce})
+	if err != nil {
+		return "", err
+	}
+	err = setTempValue("oauth_code@"+hashToken(code), string(b),
+		Config.AuthorizationCodeExpiresIn)
+	if err != nil {
+		return "", err
+	}
+	uri, err := req.redirectURI()
+	if err != nil {
+		return "", err
+	}
+	return addQuery(uri, "code", code, "state", req.State), nil
+}
+
+// AuthorizeErrorURI uri to redirect user back to client with error,
+// such as user denied the request
+func AuthorizeErrorURI(req *AuthorizeRequest, err error) (string, error) {
+	uri, e := req.redirectURI()
+	if e != nil {
+		return "", e
+	}
+	code, _ := oauthErrorCode(err)
+	if err == ErrPKCEInvalid {
+		code = "invalid_request"
+	}
+	return addQuery(uri, "error", code, "state", req.State), nil
+}
+
+// ExchangeAuthorizationCode get tokens by authorization code, code can
+// only be used once. tokens are bound to the client and only replace
+// tokens of user issued to the same client before, so login of user in
+// ucenter and other clients are kept. id token is returned if scope
+// openid is granted
+func ExchangeAuthorizationCode(clientID string, code string,
+	redirectURI string, verifier string) (*LoginResult, error) {
+	if len(code) == 0 {
+		return nil, ErrAuthCodeInvalid
+	}
+	s := takeTempValue("oauth_code@" + hashToken(code))
+	if len(s) == 0 {
+		return nil, ErrAuthCodeInvalid
+	}
+	var a authCode
+	if err := json.Unmarshal([]byte(s), &a); err != nil {
+		return nil, ErrAuthCodeInvalid
+	}
+	if a.ClientID != clientID || a.RedirectURI != redirectURI {
+		return nil, ErrAuthCodeInvalid
+	}
+	if !checkPKCE(a.CodeChallenge, verifier) {
+		return nil, ErrPKCEInvalid
+	}
+	ret, err := issueTokens(a.UserName, a.Scope, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if hasScopes(a.Scope, []string{ScopeOpenID}) {
+		ret.IDToken, err = newIDToken(a.UserName, clientID, a.Scope, a.Nonce)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// RefreshOAuthToken refresh tokens issued to client by refresh token,
+// it works as ResetAccessToken
+func RefreshOAuthToken(clientID string, token string, scopes ...string) (*LoginResult, error) {
+	if len(token) == 0 {
+		return nil, ErrParamInvalid
+	}
+	var name string
+	t, typ, _, err := lookupToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if t != nil && typ == refreshToken {
+		if t.ClientID != clientID {
+			return nil, ErrRefreshTokenInvalid
+		}
+		name = t.key()
+	} else {
+		// rotated token, used again will revoke the family, but only
+		// the client it issued to can do it
+		var client string
+		_, client, name, err = getUsedRefreshToken(token)
+		if err != nil {
+			return nil, err
+		}
+		if client != clientID {
+			return nil, ErrRefreshTokenInvalid
+		}
+	}
+	if len(name) == 0 {
+		return nil, ErrRefreshTokenInvalid
+	}
+	return resetAccessToken(name, clientID, token, scopes)
+}
+
+// AuthorizeHandler http handler of authorization endpoint, user is
+// got by Config.OAuthUser and redirected to Config.OAuthLoginURL if
+// he has not login. consent of user should be checked by OAuthUser
+func AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := ParseAuthorizeRequest(r)
+	if req == nil {
+		if err == ErrOAuthClientInvalid || err == ErrRedirectURIInvalid ||
+			err == ErrParamInvalid {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request",
+				err.Error())
+			return
+		}
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	var uri string
+	if err == nil {
+		var name string
+		if Config.OAuthUser != nil {
+			name = Config.OAuthUser(r)
+		}
+		if len(name) == 0 && len(Config.OAuthLoginURL) > 0 {
+			http.Redirect(w, r, addQuery(Config.OAuthLoginURL,
+				"redirect", r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		if len(name) == 0 {
+			err = ErrOAuthLoginRequired
+		} else {
+			uri, err = Authorize(req, name)
+		}
+	}
+	if err != nil {
+		uri, err = AuthorizeErrorURI(req, err)
+		if err != nil {
+			writeOAuthError(w, http.StatusInternalServerError,
+				"server_error", "")
+			return
+		}
+	}
+	http.Redirect(w, r, uri, http.StatusFound)
+}
+
+// TokenHandler http handler of token endpoint, it supports grant_type
+// authorization_code, refresh_token, client_credentials and
+// DeviceCodeGrantType. confidential
+// client authenticate by basic authorization or client_secret in form
+func TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeOAuthError(w, http.StatusMethodNotAllowed, "invalid_request",
+			"method must be POST")
+		return
+	}
+	clientID, secret, err := requestClient(r)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+	client, err := authenticateOAuthClient(clientID, secret)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+	grantType := r.PostForm.Get("grant_type")
+	if containsString(oauthGrantTypes, grantType) &&
+		!client.allowGrantType(grantType) {
+		writeTokenError(w, ErrUnauthorizedClient)
+		return
+	}
+	var ret *LoginResult
+	switch grantType {
+	case "authorization_code":
+		ret, err = ExchangeAuthorizationCode(clientID,
+			r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"),
+			r.PostForm.Get("code_verifier"))
+	case "refresh_token":
+		ret, err = RefreshOAuthToken(clientID,
+			r.PostForm.Get("refresh_token"),
+			parseScope(r.PostForm.Get("scope"))...)
+	case "client_credentials":
+		ret, err = clientCredentialsToken(client,
+			parseScope(r.PostForm.Get("scope")))
+	case DeviceCodeGrantType:
+		ret, err = PollDeviceToken(client.ID, r.PostForm.Get("device_code"))
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+	w.Header().Set("Pragma", "no-cache")
+	writeJSON(w, http.StatusOK, newTokenResponse(ret))
+}
+
+func newTokenResponse(ret *LoginResult) *tokenResponse {
+	return &tokenResponse{AccessToken: ret.AccessToken,
+		TokenType:    introspectBearer,
+		ExpiresIn:    ret.AccessTokenExpiresIn,
+		RefreshToken: ret.RefreshToken,
+		Scope:        strings.Join(ret.Scopes, " "),
+		IDToken:      ret.IDToken}
+}
+
+// writeTokenError write error of token endpoint
+func writeTokenError(w http.ResponseWriter, err error) {
+	code, status := oauthErrorCode(err)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ucenter"`)
+	}
+	if status == http.StatusInternalServerError {
+		fmt.Println(err)
+	}
+	writeOAuthError(w, status, code, "")
+}
+
+// oauthErrorCode error code of oauth2 and http status for error
+func oauthErrorCode(err error) (string, int) {
+	switch err {
+	case ErrOAuthClientInvalid:
+		return "invalid_client", http.StatusUnauthorized
+	case ErrParamInvalid:
+		return "invalid_request", http.StatusBadRequest
+	case ErrAuthCodeInvalid, ErrPKCEInvalid, ErrRefreshTokenInvalid,
+		ErrRefreshTokenReused, ErrTokenExpired, ErrTokenNotExist,
+		ErrUserNotExist, ErrDeviceCodeInvalid:
+		return "invalid_grant", http.StatusBadRequest
+	case ErrScopeInvalid:
+		return "invalid_scope", http.StatusBadRequest
+	case ErrUnsupportedResponseType:
+		return "unsupported_response_type", http.StatusBadRequest
+	case ErrOAuthLoginRequired, ErrAccessDenied:
+		return "access_denied", http.StatusBadRequest
+	case ErrAuthorizationPending:
+		return "authorization_pending", http.StatusBadRequest
+	case ErrSlowDown:
+		return "slow_down", http.StatusBadRequest
+	case ErrDeviceCodeExpired:
+		return "expired_token", http.StatusBadRequest
+	case ErrUnauthorizedClient:
+		return "unauthorized_client", http.StatusBadRequest
+	}
+	return "server_error", http.StatusInternalServerError
+}
+
+// redirectURI the uri authorization response sent to
+func (req *AuthorizeRequest) redirectURI() (string, error) {
+	if len(req.RedirectURI) > 0 {
+		return req.RedirectURI, nil
+	}
+	c, err := GetOAuthClient(req.ClientID)
+	if err != nil {
+		return "", err
+	}
+	if len(c.RedirectURIs) != 1 {
+		return "", ErrRedirectURIInvalid
+	}
+	return c.RedirectURIs[0], nil
+}
+
+// validRedirectURI redirect uri must be absolute without fragment,
+// http is only allowed for loopback address used by native app
+func validRedirectURI(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil || !u.IsAbs() || len(u.Fragment) > 0 ||
+		strings.ContainsAny(s, " \n#") {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "javascript", "data", "file":
+		return false
+	case "http":
+		host := u.Hostname()
+		ip := net.ParseIP(host)
+		return host == "localhost" || (ip != nil && ip.IsLoopback())
+	}
+	return len(u.Host) > 0 || u.Scheme != "https"
+}
+
+// validPKCEString code challenge and verifier are 43-128 characters
+// of [A-Z] / [a-z] / [0-9] / "-" / "." / "_" / "~"
+func validPKCEString(s string) bool {
+	if len(s) < 43 || len(s) > 128 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' ||
+			c >= '0' && c <= '9' || c == '-' || c == '.' ||
+			c == '_' || c == '~') {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPKCE code challenge is BASE64URL(SHA256(code verifier))
+func checkPKCE(challenge string, verifier string) bool {
+	if !validPKCEString(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected),
+		[]byte(challenge)) == 1
+}
+
+// addQuery add parameters to query of uri, empty value is skipped
+func addQuery(uri string, kv ...string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	q := u.Query()
+	for i := 0; i+1 < len(kv); i += 2 {
+		if len(kv[i+1]) > 0 {
+			q.Set(kv[i], kv[i+1])
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func createOAuthClientTable() error {
+	createStr := "create table " + Config.OAuthClientTableName + "(" +
+		"client_id        varchar(64) NOT NULL," +
+		"client_name      varchar(255) NOT NULL DEFAULT ''," +
+		"redirect_uris    text NOT NULL," +
+		"scope            varchar(1024) NOT NULL DEFAULT ''," +
+		"grant_types      varchar(255) NOT NULL DEFAULT ''," +
+		"logo_uri         varchar(1024) NOT NULL DEFAULT ''," +
+		"access_token_expires_in int(11) NOT NULL DEFAULT 0," +
+		"refresh_token_expires_in int(11) NOT NULL DEFAULT 0," +
+		"secret_hash      varchar(64) NOT NULL DEFAULT ''," +
+		"old_secret_hash  varchar(64) NOT NULL DEFAULT ''," +
+		"old_secret_expires bigint(20) NOT NULL DEFAULT 0," +
+		"created          datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`client_id`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8"
+	_, err := db.Exec(createStr)
+	if err != nil {
+		return err
+	}
+	return nil
+}
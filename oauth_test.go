@@ -0,0 +1,315 @@
+package ucenter
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPKCE(t *testing.T) {
+	verifier := strings.Repeat("abc-._~", 7)
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	if !checkPKCE(challenge, verifier) {
+		t.Error("code verifier should match challenge")
+	}
+	if checkPKCE(challenge, verifier+"x") || checkPKCE(challenge, "short") {
+		t.Error("code verifier should not match challenge")
+	}
+}
+
+func TestValidRedirectURI(t *testing.T) {
+	valid := []string{"https://app.example.com/cb", "http://127.0.0.1:8080/cb",
+		"http://localhost/cb", "com.example.app:/oauth"}
+	for _, s := range valid {
+		if !validRedirectURI(s) {
+			t.Error("redirect uri should be valid:", s)
+		}
+	}
+	invalid := []string{"/cb", "http://app.example.com/cb",
+		"https://app.example.com/cb#x", "javascript:alert(1)", "https:/cb"}
+	for _, s := range invalid {
+		if validRedirectURI(s) {
+			t.Error("redirect uri should be invalid:", s)
+		}
+	}
+	uri := addQuery("https://app.example.com/cb?a=1", "code", "x", "state", "")
+	if uri != "https://app.example.com/cb?a=1&code=x" {
+		t.Error("add query error:", uri)
+	}
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	requireMySQL(t)
+	client := &OAuthClient{Name: "test",
+		RedirectURIs: []string{"https://app.example.com/cb"}}
+	if err := CreateOAuthClient(client); err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteOAuthClient(client.ID)
+	Config.OAuthUser = func(r *http.Request) string { return "sails" }
+	defer func() { Config.OAuthUser = nil }()
+	login, err := UserLogin("sails", "twtpsu31")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	q := url.Values{"response_type": {"code"}, "client_id": {client.ID},
+		"state": {"xyz"}, "code_challenge_method": {"S256"},
+		"code_challenge": {base64.RawURLEncoding.EncodeToString(sum[:])}}
+	w := httptest.NewRecorder()
+	AuthorizeHandler(w, httptest.NewRequest("GET", "/authorize?"+q.Encode(), nil))
+	if w.Code != http.StatusFound {
+		t.Fatal("authorize should redirect:", w.Code, w.Body.String())
+	}
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if loc.Query().Get("state") != "xyz" || len(loc.Query().Get("code")) == 0 {
+		t.Fatal("redirect should have code and state:", loc)
+	}
+	form := url.Values{"grant_type": {"authorization_code"},
+		"client_id": {client.ID}, "code": {loc.Query().Get("code")},
+		"code_verifier": {verifier}}
+	r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	TokenHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatal("token request failed:", w.Body.String())
+	}
+	var ret tokenResponse
+	json.Unmarshal(w.Body.Bytes(), &ret)
+	if err = CheckAccessToken("sails", login.AccessToken); err != nil {
+		t.Fatal("login in ucenter should be kept:", err)
+	}
+	if err = CheckAccessToken("sails", ret.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ResetAccessToken("sails", ret.RefreshToken); err == nil {
+		t.Fatal("refresh token of client should not be used by ucenter")
+	}
+	info, err := IntrospectToken(ret.AccessToken)
+	if err != nil || !info.Active || info.ClientID != client.ID {
+		t.Fatal("token should be bound to client:", err, info)
+	}
+	// code can only be used once
+	r = httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	TokenHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatal("code should be invalid after used:", w.Code)
+	}
+	if _, err = RefreshOAuthToken("other", ret.RefreshToken); err == nil {
+		t.Fatal("refresh token should be bound to client")
+	}
+	if _, err = RefreshOAuthToken(client.ID, ret.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	// rotated token used by other client does not revoke the family
+	if _, err = RefreshOAuthToken("other", ret.RefreshToken); err != ErrRefreshTokenInvalid {
+		t.Fatal("rotated token of other client should be invalid:", err)
+	}
+	if _, err = RefreshOAuthToken(client.ID, ret.RefreshToken); err != ErrRefreshTokenReused {
+		t.Fatal("rotated token should be found reused:", err)
+	}
+	if err = CheckAccessToken("sails", login.AccessToken); err != nil {
+		t.Fatal("login in ucenter should be kept after reuse:", err)
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	requireMySQL(t)
+	client := &OAuthClient{Name: "service", Confidential: true,
+		Scopes: []string{"read", "write"}}
+	if err := CreateOAuthClient(client); err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteOAuthClient(client.ID)
+	if _, err := ClientCredentialsToken(client.ID, "wrong"); err == nil {
+		t.Fatal("client secret should be checked")
+	}
+	if _, err := ClientCredentialsToken(client.ID, client.Secret,
+		"admin"); err != ErrScopeInvalid {
+		t.Fatal("scope should be registered by client:", err)
+	}
+	ret, err := ClientCredentialsToken(client.ID, client.Secret, "read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret.RefreshToken) > 0 {
+		t.Fatal("client token should not have refresh token")
+	}
+	p, err := CheckAccessTokenScopes(ret.AccessToken, "read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ClientID != client.ID || len(p.UserName) > 0 {
+		t.Fatal("principal should be the client:", p.ClientID, p.UserName)
+	}
+	// saved in token table, so other instances can check it
+	tempCache.Delete("client_token@" + hashToken(ret.AccessToken))
+	if _, err = Authenticate(ret.AccessToken); err != nil {
+		t.Fatal("client token should be saved:", err)
+	}
+	if err = RevokeToken(ret.AccessToken, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Authenticate(ret.AccessToken); err == nil {
+		t.Fatal("client token should be revoked")
+	}
+	secret, err := RotateOAuthClientSecret(client.ID, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ClientCredentialsToken(client.ID, client.Secret); err != nil {
+		t.Fatal("old secret should be valid in overlap:", err)
+	}
+	if _, err = RotateOAuthClientSecret(client.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ClientCredentialsToken(client.ID, secret); err == nil {
+		t.Fatal("old secret should be invalid without overlap")
+	}
+	if err = RevokeToken(ret.AccessToken, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Authenticate(ret.AccessToken); err == nil {
+		t.Fatal("client token should be revoked")
+	}
+}
+
+func TestUserCode(t *testing.T) {
+	code, err := newUserCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != 8 || strings.Trim(code, userCodeChars) != "" {
+		t.Error("user code error:", code)
+	}
+	if normalizeUserCode("bcdf-ghjk ") != "BCDFGHJK" {
+		t.Error("normalize user code error")
+	}
+}
+
+func TestDeviceAuthorization(t *testing.T) {
+	requireMySQL(t)
+	client := &OAuthClient{Name: "tv"}
+	if err := CreateOAuthClient(client); err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteOAuthClient(client.ID)
+	auth, err := RequestDeviceAuthorization(client.ID, "read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = PollDeviceToken(client.ID, auth.DeviceCode); err != ErrAuthorizationPending {
+		t.Fatal("device should wait for user:", err)
+	}
+	if _, err = PollDeviceToken(client.ID, auth.DeviceCode); err != ErrSlowDown {
+		t.Fatal("device should slow down:", err)
+	}
+	if _, err = GetDeviceRequest("wrong", "sails"); err != ErrDeviceCodeInvalid {
+		t.Fatal("user code should be invalid:", err)
+	}
+	req, err := GetDeviceRequest(strings.ToLower(auth.UserCode), "sails")
+	if err != nil || req.ClientID != client.ID {
+		t.Fatal("device request error:", err, req)
+	}
+	Config.OAuthUser = func(r *http.Request) string { return "sails" }
+	defer func() { Config.OAuthUser = nil }()
+	form := url.Values{"user_code": {auth.UserCode}, "action": {"approve"}}
+	r := httptest.NewRequest("POST", "/device", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	DeviceVerificationHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatal("form post should be refused:", w.Code)
+	}
+	body, _ := json.Marshal(map[string]string{"user_code": auth.UserCode,
+		"action": "approve"})
+	r = httptest.NewRequest("POST", "/device", strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	DeviceVerificationHandler(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatal("device should be approved:", w.Code, w.Body.String())
+	}
+	if _, err = PollDeviceToken("other", auth.DeviceCode); err != ErrDeviceCodeInvalid {
+		t.Fatal("device code should be bound to client:", err)
+	}
+	ret, err := PollDeviceToken(client.ID, auth.DeviceCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Authenticate(ret.AccessToken)
+	if err != nil || p.UserName != "sails" || p.ClientID != client.ID {
+		t.Fatal("token should be issued to user for client:", err, p)
+	}
+	if _, err = PollDeviceToken(client.ID, auth.DeviceCode); err == nil {
+		t.Fatal("device code can only be used once")
+	}
+}
+
+func TestOAuthClientManagement(t *testing.T) {
+	requireMySQL(t)
+	client := &OAuthClient{Name: "app", Confidential: true,
+		RedirectURIs: []string{"https://app.example.com/cb"},
+		GrantTypes:   []string{"authorization_code", "refresh_token"}}
+	if err := CreateOAuthClient(client); err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteOAuthClient(client.ID)
+	if _, err := ClientCredentialsToken(client.ID, client.Secret); err != ErrUnauthorizedClient {
+		t.Fatal("grant type should be registered by client:", err)
+	}
+	client.Name = "new app"
+	client.LogoURI = "https://app.example.com/logo.png"
+	client.GrantTypes = append(client.GrantTypes, "client_credentials")
+	client.AccessTokenExpiresIn = 60
+	if err := UpdateOAuthClient(client); err != nil {
+		t.Fatal(err)
+	}
+	c, err := GetOAuthClient(client.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "new app" || c.LogoURI != client.LogoURI ||
+		len(c.GrantTypes) != 3 || c.AccessTokenExpiresIn != 60 ||
+		!c.Confidential {
+		t.Fatal("client should be updated:", c)
+	}
+	ret, err := ClientCredentialsToken(client.ID, client.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.AccessTokenExpiresIn != 60 {
+		t.Fatal("lifetime of client should be used:", ret.AccessTokenExpiresIn)
+	}
+	clients, err := GetOAuthClients()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, c := range clients {
+		if c.ID == client.ID {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("client should be listed")
+	}
+	client.GrantTypes = []string{"password"}
+	if err = UpdateOAuthClient(client); err != ErrClientMetadataInvalid {
+		t.Fatal("unsupported grant type should fail:", err)
+	}
+	if err = UpdateOAuthClient(&OAuthClient{ID: "unknown"}); err != ErrOAuthClientInvalid {
+		t.Fatal("client should exist:", err)
+	}
+}
@@ -0,0 +1,218 @@
+package ucenter
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scopes defined by OpenID Connect, they are always allowed
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// maxNonceLength nonce longer than it is rejected
+const maxNonceLength = 255
+
+// IDTokenClaims claims of OpenID Connect id token, profile claims are
+// included if scope profile is granted, email if scope email is granted
+type IDTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Nonce     string `json:"nonce,omitempty"`
+	OIDCUserInfo
+}
+
+// OIDCUserInfo standard claims of user, response of userinfo endpoint
+type OIDCUserInfo struct {
+	Subject           string `json:"sub,omitempty"`
+	PreferredUserName string `json:"preferred_username,omitempty"`
+	Nickname          string `json:"nickname,omitempty"`
+	Email             string `json:"email,omitempty"`
+	// Tenant of user, empty for default tenant
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// OpenIDConfiguration discovery document of OpenID Connect provider
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint,omitempty"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint,omitempty"`
+	RevocationEndpoint                string   `json:"revocation_endpoint,omitempty"`
+	RegistrationEndpoint              string   `json:"registration_endpoint,omitempty"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// oidcEndpoints default path of endpoints under Config.JWTIssuer,
+// they can be changed by Config.OIDCEndpoints
+var oidcEndpoints = map[string]string{
+	"authorization_endpoint":        "/authorize",
+	"token_endpoint":                "/token",
+	"userinfo_endpoint":             "/userinfo",
+	"jwks_uri":                      "/jwks",
+	"device_authorization_endpoint": "/device_authorization",
+	"introspection_endpoint":        "/introspect",
+	"revocation_endpoint":           "/revoke",
+	"registration_endpoint":         "/register",
+}
+
+// GetOpenIDConfiguration discovery document, Config.JWTIssuer must be
+// the url of provider
+func GetOpenIDConfiguration() (*OpenIDConfiguration, error) {
+	if len(Config.JWTIssuer) == 0 {
+		return nil, ErrIssuerNotSet
+	}
+	scopes := []string{ScopeOpenID, ScopeProfile, ScopeEmail}
+	for i := 0; i < len(Config.Scopes); i++ {
+		if !containsString(scopes, Config.Scopes[i]) {
+			scopes = append(scopes, Config.Scopes[i])
+		}
+	}
+	return &OpenIDConfiguration{
+		Issuer:                      Config.JWTIssuer,
+		AuthorizationEndpoint:       oidcEndpoint("authorization_endpoint"),
+		TokenEndpoint:               oidcEndpoint("token_endpoint"),
+		UserInfoEndpoint:            oidcEndpoint("userinfo_endpoint"),
+		JWKSURI:                     oidcEndpoint("jwks_uri"),
+		DeviceAuthorizationEndpoint: oidcEndpoint("device_authorization_endpoint"),
+		IntrospectionEndpoint:       oidcEndpoint("introspection_endpoint"),
+		RevocationEndpoint:          oidcEndpoint("revocation_endpoint"),
+		RegistrationEndpoint:        oidcEndpoint("registration_endpoint"),
+		ScopesSupported:             scopes,
+		ResponseTypesSupported:      []string{"code"},
+		GrantTypesSupported: []string{"authorization_code", "refresh_token",
+			"client_credentials", DeviceCodeGrantType},
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: []string{Config.JWTAlgorithm},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic",
+			"client_secret_post", "none"},
+		CodeChallengeMethodsSupported: []string{pkceS256},
+		ClaimsSupported: []string{"iss", "sub", "aud", "iat", "exp",
+			"nonce", "preferred_username", "nickname", "email", "tenant"},
+	}, nil
+}
+
+// GetOIDCUserInfo claims of user by access token, the token must have
+// scope openid, other claims are returned by scope as id token
+func GetOIDCUserInfo(accessToken string) (*OIDCUserInfo, error) {
+	p, err := CheckAccessTokenScopes(accessToken, ScopeOpenID)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.UserName) == 0 {
+		// token of client itself
+		return nil, ErrAccessTokenInvalid
+	}
+	u, err := getUserByName(accountKey(p.Tenant, p.UserName))
+	if err != nil {
+		return nil, err
+	}
+	return oidcUserInfo(u, strings.Join(p.Scopes, " ")), nil
+}
+
+// OpenIDConfigurationHandler http handler of discovery document, it
+// should be served at /.well-known/openid-configuration under issuer
+func OpenIDConfigurationHandler(w http.ResponseWriter, r *http.Request) {
+	ret, err := GetOpenIDConfiguration()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, ret)
+}
+
+// UserInfoHandler http handler of userinfo endpoint, access token is
+// sent by Authorization header
+func UserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	token := bearerToken(r)
+	if len(token) == 0 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ucenter"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	ret, err := GetOIDCUserInfo(token)
+	if err == ErrScopeInsufficient {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ucenter", `+
+			`error="insufficient_scope", scope="openid"`)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		w.Header().Set("WWW-Authenticate",
+			`Bearer realm="ucenter", error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, ret)
+}
+
+// newIDToken create id token of user for client, HS256 is not
+// supported because client can not verify it by JWKS
+func newIDToken(name string, clientID string, scope string, nonce string) (string, error) {
+	if len(Config.JWTIssuer) == 0 {
+		return "", ErrIssuerNotSet
+	}
+	u, err := getUserByName(name)
+	if err != nil {
+		return "", err
+	}
+	key, err := currentSigningKey()
+	if err != nil {
+		return "", err
+	}
+	if key.Alg == JWTAlgHS256 {
+		return "", ErrJWTAlgorithm
+	}
+	now := time.Now().Unix()
+	claims := IDTokenClaims{
+		Issuer:       Config.JWTIssuer,
+		Subject:      strconv.FormatInt(u.ID, 10),
+		Audience:     clientID,
+		IssuedAt:     now,
+		ExpiresAt:    now + int64(tokenConfig(name, clientID).TokenExpiresIn),
+		Nonce:        nonce,
+		OIDCUserInfo: *oidcUserInfo(u, scope),
+	}
+	return signJWT(key, jwtTypJWT, claims)
+}
+
+// oidcUserInfo claims of user granted by scope
+func oidcUserInfo(u *UserInfo, scope string) *OIDCUserInfo {
+	ret := &OIDCUserInfo{Subject: strconv.FormatInt(u.ID, 10),
+		Tenant: u.Tenant}
+	if hasScopes(scope, []string{ScopeProfile}) {
+		ret.PreferredUserName = u.UserName
+		ret.Nickname = u.Nickname
+	}
+	if hasScopes(scope, []string{ScopeEmail}) {
+		ret.Email = u.Email
+	}
+	return ret
+}
+
+// oidcEndpoint url of endpoint in discovery document
+func oidcEndpoint(name string) string {
+	if uri, ok := Config.OIDCEndpoints[name]; ok {
+		return uri
+	}
+	return strings.TrimRight(Config.JWTIssuer, "/") + oidcEndpoints[name]
+}
@@ -0,0 +1,109 @@
+package ucenter
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenIDConfiguration(t *testing.T) {
+	old := Config
+	defer func() { Config = old }()
+	Config.JWTIssuer = ""
+	if _, err := GetOpenIDConfiguration(); err != ErrIssuerNotSet {
+		t.Fatal("issuer should be required:", err)
+	}
+	Config.JWTIssuer = "https://id.example.com/"
+	Config.OIDCEndpoints = map[string]string{
+		"userinfo_endpoint": "https://api.example.com/me"}
+	c, err := GetOpenIDConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.TokenEndpoint != "https://id.example.com/token" ||
+		c.UserInfoEndpoint != "https://api.example.com/me" {
+		t.Error("endpoints error:", c.TokenEndpoint, c.UserInfoEndpoint)
+	}
+	if !containsString(c.ScopesSupported, ScopeOpenID) {
+		t.Error("scope openid should be supported")
+	}
+}
+
+func TestOIDCUserInfoScopes(t *testing.T) {
+	u := &UserInfo{ID: 7, UserName: "sails", Nickname: "Sails",
+		Email: "sails@example.com"}
+	info := oidcUserInfo(u, "openid")
+	if info.Subject != "7" || len(info.PreferredUserName) > 0 ||
+		len(info.Email) > 0 {
+		t.Error("only sub should be returned:", info)
+	}
+	info = oidcUserInfo(u, "openid profile email")
+	if info.PreferredUserName != "sails" || info.Nickname != "Sails" ||
+		info.Email != u.Email {
+		t.Error("claims of scope should be returned:", info)
+	}
+}
+
+func TestOpenIDConnect(t *testing.T) {
+	requireMySQL(t)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	Config.JWTAlgorithm = JWTAlgEdDSA
+	Config.JWTPrivateKey = edKey
+	Config.JWTIssuer = "https://id.example.com"
+	defer func() {
+		Config.JWTPrivateKey = nil
+		Config.JWTIssuer = ""
+	}()
+	client := &OAuthClient{Name: "rp",
+		RedirectURIs: []string{"https://rp.example.com/cb"}}
+	if err := CreateOAuthClient(client); err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteOAuthClient(client.ID)
+
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	req := &AuthorizeRequest{ClientID: client.ID, Scope: "openid profile",
+		Nonce: "n-0S6_WzA2Mj", CodeChallengeMethod: pkceS256,
+		CodeChallenge: base64.RawURLEncoding.EncodeToString(sum[:])}
+	uri, err := Authorize(req, "sails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := uri[strings.Index(uri, "code=")+5:]
+	ret, err := ExchangeAuthorizationCode(client.ID, code, "", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := configSigningKey()
+	payload, err := verifyJWT(ret.IDToken, key)
+	if err != nil {
+		t.Fatal("id token should be signed:", err)
+	}
+	var claims IDTokenClaims
+	json.Unmarshal(payload, &claims)
+	if claims.Audience != client.ID || claims.Nonce != req.Nonce ||
+		claims.Issuer != Config.JWTIssuer ||
+		claims.PreferredUserName != "sails" || len(claims.Subject) == 0 {
+		t.Fatal("id token claims error:", claims)
+	}
+
+	r := httptest.NewRequest("GET", "/userinfo", nil)
+	r.Header.Set("Authorization", "Bearer "+ret.AccessToken)
+	w := httptest.NewRecorder()
+	UserInfoHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatal("userinfo request failed:", w.Code)
+	}
+	var info OIDCUserInfo
+	json.Unmarshal(w.Body.Bytes(), &info)
+	if info.Subject != claims.Subject || info.PreferredUserName != "sails" {
+		t.Fatal("userinfo error:", info)
+	}
+}
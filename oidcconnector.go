@@ -0,0 +1,269 @@
+package ucenter
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idTokenMaxSkew seconds of clock difference allowed with provider
+const idTokenMaxSkew = 60
+
+// OIDCConnector login by OpenID Connect provider of enterprise, such
+// as Okta, Keycloak or Azure AD. endpoints are got by discovery, code
+// flow with PKCE is used and id token is verified by JWKS. register
+// one connector for each provider with different ID
+type OIDCConnector struct {
+	// ID name of connector, users of it are linked by ID and sub
+	ID string
+	// Issuer url of provider, discovery document is got from
+	// Issuer/.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Scopes requested, default is openid profile email
+	Scopes []string
+	// UserNameClaim claim used as user name to register user, default
+	// is preferred_username
+	UserNameClaim string
+	// NicknameClaim claim used as nickname, default is name
+	NicknameClaim string
+	// EmailClaim claim used as email, it is only used if
+	// email_verified is true. default is email
+	EmailClaim string
+
+	lock     sync.Mutex
+	provider *oidcProvider
+	keys     map[string]crypto.PublicKey
+	// loaded time of keys, keys reload for unknown kid
+	loaded int64
+}
+
+// oidcProvider endpoints in discovery document of provider
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Name of connector is ID
+func (c *OIDCConnector) Name() string {
+	return c.ID
+}
+
+// AuthCodeURL url of login page of provider
+func (c *OIDCConnector) AuthCodeURL(req *ConnectorRequest) (string, error) {
+	p, err := c.getProvider()
+	if err != nil {
+		return "", err
+	}
+	scopes := c.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail}
+	}
+	sum := sha256.Sum256([]byte(req.CodeVerifier))
+	return addQuery(p.AuthorizationEndpoint, "response_type", "code",
+		"client_id", c.ClientID, "redirect_uri", req.RedirectURI,
+		"scope", strings.Join(scopes, " "), "state", req.State,
+		"nonce", req.Nonce,
+		"code_challenge", base64.RawURLEncoding.EncodeToString(sum[:]),
+		"code_challenge_method", pkceS256), nil
+}
+
+// Identity exchange code for id token and get user from its claims
+func (c *OIDCConnector) Identity(req *ConnectorRequest, code string) (*ExternalIdentity, error) {
+	p, err := c.getProvider()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{"grant_type": {"authorization_code"},
+		"code": {code}, "redirect_uri": {req.RedirectURI},
+		"code_verifier": {req.CodeVerifier}}
+	r, err := http.NewRequest("POST", p.TokenEndpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// client id and secret are form encoded in basic auth
+	r.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	resp, err := connectorClient.Do(r)
+	if err != nil {
+		fmt.Println(err)
+		return nil, ErrUpstreamFailed
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = readConnectorResponse(resp, &token); err != nil {
+		return nil, err
+	}
+	claims, err := c.verifyIDToken(p, token.IDToken, req.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	return c.identity(claims), nil
+}
+
+// verifyIDToken check signature, issuer, audience, expiry and nonce
+// of id token, it returns the claims
+func (c *OIDCConnector) verifyIDToken(p *oidcProvider, token string, nonce string) (map[string]interface{}, error) {
+	header, _, _, err := splitJWT(token)
+	if err != nil {
+		return nil, ErrIDTokenInvalid
+	}
+	var key *signingKey
+	if header.Alg == JWTAlgHS256 {
+		// signed by client secret, public client can not verify it
+		if len(c.ClientSecret) == 0 {
+			return nil, ErrIDTokenInvalid
+		}
+		key, err = newVerifyKey([]byte(c.ClientSecret))
+	} else {
+		var pub crypto.PublicKey
+		pub, err = c.getKey(p, header.Kid)
+		if err == nil {
+			key, err = newVerifyKey(pub)
+		}
+	}
+	if err != nil {
+		return nil, ErrIDTokenInvalid
+	}
+	payload, err := verifyJWT(token, key)
+	if err != nil {
+		return nil, ErrIDTokenInvalid
+	}
+	var claims map[string]interface{}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrIDTokenInvalid
+	}
+	now := time.Now().Unix()
+	exp, _ := claims["exp"].(float64)
+	iat, _ := claims["iat"].(float64)
+	if int64(exp)+idTokenMaxSkew < now || int64(iat)-idTokenMaxSkew > now {
+		return nil, ErrIDTokenInvalid
+	}
+	if iss, _ := claims["iss"].(string); iss != p.Issuer {
+		return nil, ErrIDTokenInvalid
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, ErrIDTokenInvalid
+	}
+	aud := claimStrings(claims["aud"])
+	if !containsString(aud, c.ClientID) {
+		return nil, ErrIDTokenInvalid
+	}
+	if azp, ok := claims["azp"].(string); (ok || len(aud) > 1) &&
+		azp != c.ClientID {
+		return nil, ErrIDTokenInvalid
+	}
+	if sub, _ := claims["sub"].(string); len(sub) == 0 {
+		return nil, ErrIDTokenInvalid
+	}
+	return claims, nil
+}
+
+// identity map claims of id token to identity
+func (c *OIDCConnector) identity(claims map[string]interface{}) *ExternalIdentity {
+	ret := &ExternalIdentity{}
+	ret.ID, _ = claims["sub"].(string)
+	ret.UserName, _ = claims[claimName(c.UserNameClaim, "preferred_username")].(string)
+	ret.Nickname, _ = claims[claimName(c.NicknameClaim, "name")].(string)
+	if verified, _ := claims["email_verified"].(bool); verified {
+		ret.Email, _ = claims[claimName(c.EmailClaim, "email")].(string)
+	}
+	return ret
+}
+
+// getProvider discovery document of provider, it is got once
+func (c *OIDCConnector) getProvider() (*oidcProvider, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.provider != nil {
+		return c.provider, nil
+	}
+	issuer := strings.TrimRight(c.Issuer, "/")
+	var p oidcProvider
+	err := connectorGet(issuer+"/.well-known/openid-configuration", &p)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(p.Issuer, "/") != issuer ||
+		len(p.AuthorizationEndpoint) == 0 || len(p.TokenEndpoint) == 0 ||
+		len(p.JWKSURI) == 0 {
+		fmt.Println("invalid discovery document of", c.Issuer)
+		return nil, ErrUpstreamFailed
+	}
+	c.provider = &p
+	return c.provider, nil
+}
+
+// getKey public key of provider by kid, JWKS is reloaded for unknown
+// kid at most once in keyReloadInterval
+func (c *OIDCConnector) getKey(p *oidcProvider, kid string) (crypto.PublicKey, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if key := findJWK(c.keys, kid); key != nil {
+		return key, nil
+	}
+	now := time.Now().Unix()
+	if now-c.loaded < keyReloadInterval {
+		return nil, ErrJWTKeyInvalid
+	}
+	c.loaded = now
+	var set json.RawMessage
+	if err := connectorGet(p.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys, err := ParseJWKS(set)
+	if err != nil {
+		return nil, ErrUpstreamFailed
+	}
+	c.keys = keys
+	if key := findJWK(c.keys, kid); key != nil {
+		return key, nil
+	}
+	return nil, ErrJWTKeyInvalid
+}
+
+// findJWK key of kid, the only key is used if token has no kid
+func findJWK(keys map[string]crypto.PublicKey, kid string) crypto.PublicKey {
+	if len(kid) == 0 && len(keys) == 1 {
+		for _, key := range keys {
+			return key
+		}
+	}
+	return keys[kid]
+}
+
+// claimStrings value of claim may be string or array of strings
+func claimStrings(v interface{}) []string {
+	switch s := v.(type) {
+	case string:
+		return []string{s}
+	case []interface{}:
+		var ret []string
+		for i := 0; i < len(s); i++ {
+			if str, ok := s[i].(string); ok {
+				ret = append(ret, str)
+			}
+		}
+		return ret
+	}
+	return nil
+}
+
+func claimName(name string, def string) string {
+	if len(name) == 0 {
+		return def
+	}
+	return name
+}
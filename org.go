@@ -0,0 +1,531 @@
+package ucenter
+
+import (
+	"fmt"
+	"time"
+)
+
+// roles of organization members
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+// Organization team of users
+type Organization struct {
+	ID          int64
+	Name        string
+	DisplayName string
+	Created     string
+}
+
+// OrganizationMember user in organization
+type OrganizationMember struct {
+	UserName string
+	Nickname string
+	Role     string
+	Joined   string
+}
+
+// OrganizationMembership organization of user and his role in it
+type OrganizationMembership struct {
+	Organization string `json:"organization"`
+	Role         string `json:"role"`
+}
+
+// OrganizationInvitation invitation for user to join organization,
+// user join it by AcceptInvitation
+type OrganizationInvitation struct {
+	ID           string
+	Organization string
+	UserName     string
+	Role         string
+	Inviter      string
+	ExpiresAt    int64
+}
+
+// CreateOrganization create organization, owner is the first member
+func CreateOrganization(name string, displayName string, owner string) error {
+	if !validRBACName(name) {
+		return ErrParamInvalid
+	}
+	owner = accountKey("", owner)
+	u, err := getUserByName(owner)
+	if err != nil {
+		return err
+	}
+	o, err := getOrganization(name)
+	if err != nil && err != ErrOrgNotExist {
+		return err
+	}
+	if o != nil {
+		return ErrOrgExist
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	sql := "insert into " + Config.OrganizationTableName +
+		"(name, display_name, created) values(?, ?, now())"
+	ret, err := tx.Exec(sql, name, displayName)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	id, err := ret.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	sql = "insert into " + Config.OrganizationMemberTableName +
+		"(org_id, user_id, role, created) values(?, ?, ?, now())"
+	if _, err = tx.Exec(sql, id, u.ID, OrgRoleOwner); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	deleteUserAccess(owner)
+	return nil
+}
+
+// GetOrganization get organization by name
+func GetOrganization(name string) (*Organization, error) {
+	return getOrganization(name)
+}
+
+// DeleteOrganization delete organization and its members,
+// only owner can do it
+func DeleteOrganization(name string, actor string) error {
+	o, err := getOrganization(name)
+	if err != nil {
+		return err
+	}
+	role, err := getMemberRole(o.ID, accountKey("", actor))
+	if err != nil {
+		return err
+	}
+	if role != OrgRoleOwner {
+		return ErrOrgForbidden
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	sqls := []string{
+		"delete from " + Config.OrganizationTableName + " where id = ?",
+		"delete from " + Config.OrganizationMemberTableName + " where org_id = ?",
+		"delete from " + Config.InvitationTableName + " where org_id = ?",
+	}
+	for i := 0; i < len(sqls); i++ {
+		if _, err = tx.Exec(sqls[i], o.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return changeRBACVersion()
+}
+
+// InviteMember invite an existing user to organization, invitee is
+// user name or email. admin can invite admin and member, only owner
+// can invite owner. invitee is notified by Config.EmailSender if set
+func InviteMember(org string, inviter string, invitee string, role string) (*OrganizationInvitation, error) {
+	if !validOrgRole(role) {
+		return nil, ErrOrgRoleInvalid
+	}
+	o, err := getOrganization(org)
+	if err != nil {
+		return nil, err
+	}
+	inviterRole, err := getMemberRole(o.ID, accountKey("", inviter))
+	if err != nil {
+		return nil, err
+	}
+	if !canManageMember(inviterRole, role) {
+		return nil, ErrOrgForbidden
+	}
+	var u *UserInfo
+	if isEmail(invitee) {
+		u, err = getUserByEmail(invitee)
+	} else {
+		u, err = getUserByName(accountKey("", invitee))
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = getMemberRole(o.ID, u.key())
+	if err == nil {
+		return nil, ErrMemberExist
+	}
+	if err != ErrNotOrgMember {
+		return nil, err
+	}
+	id, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	inv := &OrganizationInvitation{ID: id, Organization: o.Name,
+		UserName: u.UserName, Role: role, Inviter: inviter,
+		ExpiresAt: time.Now().Unix() + int64(Config.InvitationExpiresIn)}
+	sql := "insert into " + Config.InvitationTableName +
+		"(id, org_id, user_id, role, inviter, expires)" +
+		" values(?, ?, ?, ?, ?, ?)"
+	_, err = db.Exec(sql, id, o.ID, u.ID, role, inviter, inv.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if Config.EmailSender != nil && len(u.Email) > 0 {
+		content := inviter + " invited you to join " + o.Name + " as " + role
+		if err = Config.EmailSender.Send(u.Email, "Invitation", content); err != nil {
+			fmt.Println(err)
+		}
+	}
+	return inv, nil
+}
+
+// GetInvitations invitations of user not expired
+func GetInvitations(name string) ([]*OrganizationInvitation, error) {
+	u, err := getUserByName(accountKey("", name))
+	if err != nil {
+		return nil, err
+	}
+	sql := "select i.id, o.name, i.role, i.inviter, i.expires from " +
+		Config.InvitationTableName + " i join " + Config.OrganizationTableName +
+		" o on o.id = i.org_id where i.user_id = ? and i.expires > ?"
+	rows, err := db.Query(sql, u.ID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []*OrganizationInvitation
+	for rows.Next() {
+		inv := OrganizationInvitation{UserName: name}
+		if err = rows.Scan(&inv.ID, &inv.Organization, &inv.Role,
+			&inv.Inviter, &inv.ExpiresAt); err != nil {
+			return nil, err
+		}
+		ret = append(ret, &inv)
+	}
+	return ret, nil
+}
+
+// AcceptInvitation user join organization by the invitation
+func AcceptInvitation(id string, name string) error {
+	name = accountKey("", name)
+	inv, orgID, userID, err := takeInvitation(id, name)
+	if err != nil {
+		return err
+	}
+	sql := "insert ignore into " + Config.OrganizationMemberTableName +
+		"(org_id, user_id, role, created) values(?, ?, ?, now())"
+	if _, err = db.Exec(sql, orgID, userID, inv.Role); err != nil {
+		return err
+	}
+	deleteUserAccess(name)
+	return nil
+}
+
+// DeclineInvitation user refuse the invitation
+func DeclineInvitation(id string, name string) error {
+	_, _, _, err := takeInvitation(id, accountKey("", name))
+	return err
+}
+
+// GetUserOrganizations organizations of user and his roles
+func GetUserOrganizations(name string) ([]OrganizationMembership, error) {
+	a, err := getUserAccess(accountKey("", name))
+	if err != nil {
+		return nil, err
+	}
+	return a.Organizations, nil
+}
+
+// GetOrganizationMembers members of organization
+func GetOrganizationMembers(org string) ([]*OrganizationMember, error) {
+	o, err := getOrganization(org)
+	if err != nil {
+		return nil, err
+	}
+	sql := "select u.user_name, u.user_nicename, m.role, m.created from " +
+		Config.OrganizationMemberTableName + " m join " +
+		Config.UserTableName + " u on u.ID = m.user_id" +
+		" where m.org_id = ? order by m.created"
+	rows, err := db.Query(sql, o.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []*OrganizationMember
+	for rows.Next() {
+		var m OrganizationMember
+		if err = rows.Scan(&m.UserName, &m.Nickname, &m.Role,
+			&m.Joined); err != nil {
+			return nil, err
+		}
+		ret = append(ret, &m)
+	}
+	return ret, nil
+}
+
+// SetMemberRole change role of member, actor must be able to manage
+// both the old role and the new role
+func SetMemberRole(org string, actor string, member string, role string) error {
+	if !validOrgRole(role) {
+		return ErrOrgRoleInvalid
+	}
+	actor, member = accountKey("", actor), accountKey("", member)
+	o, old, err := checkManageMember(org, actor, member)
+	if err != nil {
+		return err
+	}
+	actorRole, _ := getMemberRole(o.ID, actor)
+	if !canManageMember(actorRole, role) {
+		return ErrOrgForbidden
+	}
+	if old == OrgRoleOwner && role != OrgRoleOwner {
+		if err = checkNotLastOwner(o.ID); err != nil {
+			return err
+		}
+	}
+	return updateMember(o.ID, member, role)
+}
+
+// RemoveMember remove member from organization, member can remove
+// himself. the last owner can not be removed
+func RemoveMember(org string, actor string, member string) error {
+	var o *Organization
+	var role string
+	var err error
+	actor, member = accountKey("", actor), accountKey("", member)
+	if actor == member {
+		if o, err = getOrganization(org); err != nil {
+			return err
+		}
+		role, err = getMemberRole(o.ID, member)
+	} else {
+		o, role, err = checkManageMember(org, actor, member)
+	}
+	if err != nil {
+		return err
+	}
+	if role == OrgRoleOwner {
+		if err = checkNotLastOwner(o.ID); err != nil {
+			return err
+		}
+	}
+	return updateMember(o.ID, member, "")
+}
+
+// checkManageMember actor can manage member, it returns role of member
+func checkManageMember(org string, actor string, member string) (*Organization, string, error) {
+	o, err := getOrganization(org)
+	if err != nil {
+		return nil, "", err
+	}
+	actorRole, err := getMemberRole(o.ID, actor)
+	if err != nil {
+		return nil, "", err
+	}
+	role, err := getMemberRole(o.ID, member)
+	if err != nil {
+		return nil, "", err
+	}
+	if !canManageMember(actorRole, role) {
+		return nil, "", ErrOrgForbidden
+	}
+	return o, role, nil
+}
+
+// canManageMember owner can manage all members, admin can manage
+// admins and members, member can not manage others
+func canManageMember(actorRole string, role string) bool {
+	switch actorRole {
+	case OrgRoleOwner:
+		return true
+	case OrgRoleAdmin:
+		return role != OrgRoleOwner
+	}
+	return false
+}
+
+func validOrgRole(role string) bool {
+	return role == OrgRoleOwner || role == OrgRoleAdmin || role == OrgRoleMember
+}
+
+func checkNotLastOwner(orgID int64) error {
+	var count int
+	sql := "select count(*) from " + Config.OrganizationMemberTableName +
+		" where org_id = ? and role = ?"
+	if err := db.QueryRow(sql, orgID, OrgRoleOwner).Scan(&count); err != nil {
+		return err
+	}
+	if count <= 1 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// updateMember set role of member, remove member if role is empty
+func updateMember(orgID int64, name string, role string) error {
+	u, err := getUserByName(name)
+	if err != nil {
+		return err
+	}
+	if len(role) == 0 {
+		sql := "delete from " + Config.OrganizationMemberTableName +
+			" where org_id = ? and user_id = ?"
+		_, err = db.Exec(sql, orgID, u.ID)
+	} else {
+		sql := "update " + Config.OrganizationMemberTableName +
+			" set role = ? where org_id = ? and user_id = ?"
+		_, err = db.Exec(sql, role, orgID, u.ID)
+	}
+	if err != nil {
+		return err
+	}
+	deleteUserAccess(name)
+	return nil
+}
+
+// takeInvitation delete invitation of user and return it
+func takeInvitation(id string, name string) (*OrganizationInvitation, int64, int64, error) {
+	u, err := getUserByName(name)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	var inv OrganizationInvitation
+	var orgID int64
+	sql := "select org_id, role, inviter, expires from " +
+		Config.InvitationTableName + " where id = ? and user_id = ?"
+	rows, err := db.Query(sql, id, u.ID)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	found := false
+	for rows.Next() {
+		if err = rows.Scan(&orgID, &inv.Role, &inv.Inviter,
+			&inv.ExpiresAt); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		found = true
+	}
+	rows.Close()
+	if !found {
+		return nil, 0, 0, ErrInvitationInvalid
+	}
+	sql = "delete from " + Config.InvitationTableName + " where id = ?"
+	ret, err := db.Exec(sql, id)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	// only one request can take it
+	if n, err := ret.RowsAffected(); err != nil || n == 0 {
+		return nil, 0, 0, ErrInvitationInvalid
+	}
+	if time.Now().Unix() > inv.ExpiresAt {
+		return nil, 0, 0, ErrInvitationInvalid
+	}
+	inv.ID = id
+	inv.UserName = name
+	return &inv, orgID, u.ID, nil
+}
+
+func getOrganization(name string) (*Organization, error) {
+	sql := "select id, name, display_name, created from " +
+		Config.OrganizationTableName + " where name = ?"
+	rows, err := db.Query(sql, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var o Organization
+		if err = rows.Scan(&o.ID, &o.Name, &o.DisplayName,
+			&o.Created); err != nil {
+			return nil, err
+		}
+		return &o, nil
+	}
+	return nil, ErrOrgNotExist
+}
+
+// getMemberRole role of user in organization, ErrNotOrgMember
+// if user is not member
+func getMemberRole(orgID int64, name string) (string, error) {
+	sql := "select m.role from " + Config.OrganizationMemberTableName +
+		" m join " + Config.UserTableName + " u on u.ID = m.user_id" +
+		" where m.org_id = ? and u.tenant_id = ? and u.user_name = ?"
+	tenant, user := splitAccountKey(name)
+	roles, err := queryStrings(sql, orgID, tenant, user)
+	if err != nil {
+		return "", err
+	}
+	if len(roles) == 0 {
+		return "", ErrNotOrgMember
+	}
+	return roles[0], nil
+}
+
+// getMemberships organizations of user, loaded with userAccess
+func getMemberships(userID int64) ([]OrganizationMembership, error) {
+	sql := "select o.name, m.role from " + Config.OrganizationMemberTableName +
+		" m join " + Config.OrganizationTableName + " o on o.id = m.org_id" +
+		" where m.user_id = ? order by o.name"
+	rows, err := db.Query(sql, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []OrganizationMembership{}
+	for rows.Next() {
+		var m OrganizationMembership
+		if err = rows.Scan(&m.Organization, &m.Role); err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+func createOrganizationTables() error {
+	createStrs := []string{
+		"create table " + Config.OrganizationTableName + "(" +
+			"id               bigint(20) unsigned NOT NULL AUTO_INCREMENT," +
+			"name             varchar(128) NOT NULL DEFAULT ''," +
+			"display_name     varchar(255) NOT NULL DEFAULT ''," +
+			"created          datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			"PRIMARY KEY (`id`), " +
+			"UNIQUE KEY `name` (`name`)" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+		"create table " + Config.OrganizationMemberTableName + "(" +
+			"org_id           bigint(20) unsigned NOT NULL," +
+			"user_id          bigint(20) unsigned NOT NULL," +
+			"role             varchar(20) NOT NULL DEFAULT ''," +
+			"created          datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			"PRIMARY KEY (`org_id`, `user_id`), " +
+			"KEY `user_id` (`user_id`)" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+		"create table " + Config.InvitationTableName + "(" +
+			"id               varchar(64) NOT NULL," +
+			"org_id           bigint(20) unsigned NOT NULL," +
+			"user_id          bigint(20) unsigned NOT NULL," +
+			"role             varchar(20) NOT NULL DEFAULT ''," +
+			"inviter          varchar(255) NOT NULL DEFAULT ''," +
+			"expires          bigint(20) NOT NULL DEFAULT 0," +
+			"PRIMARY KEY (`id`), " +
+			"KEY `user_id` (`user_id`)" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+	}
+	for i := 0; i < len(createStrs); i++ {
+		if _, err := db.Exec(createStrs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
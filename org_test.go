@@ -0,0 +1,57 @@
+package ucenter
+
+import (
+	"testing"
+)
+
+func TestOrganization(t *testing.T) {
+	requireMySQL(t)
+	owner := "sails"
+	member := "sails_member"
+	err := UserRegister(UserInfo{UserName: member, Password: "twtpsu31",
+		Email: "sails_member@example.com"})
+	if err != nil && err != ErrUserExist {
+		t.Fatal(err)
+	}
+	org := "test_org"
+	DeleteOrganization(org, owner)
+	if err = CreateOrganization(org, "Test", owner); err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteOrganization(org, owner)
+	inv, err := InviteMember(org, owner, "sails_member@example.com",
+		OrgRoleMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = InviteMember(org, member, owner, OrgRoleMember); err != ErrNotOrgMember {
+		t.Fatal("only member can invite", err)
+	}
+	if err = AcceptInvitation(inv.ID, owner); err != ErrInvitationInvalid {
+		t.Fatal("invitation of other user should be invalid", err)
+	}
+	if err = AcceptInvitation(inv.ID, member); err != nil {
+		t.Fatal(err)
+	}
+	orgs, err := GetUserOrganizations(member)
+	if err != nil || len(orgs) != 1 || orgs[0].Role != OrgRoleMember {
+		t.Fatal("member should be in organization", orgs, err)
+	}
+	members, err := GetOrganizationMembers(org)
+	if err != nil || len(members) != 2 {
+		t.Fatal("organization should have two members", members, err)
+	}
+	if err = SetMemberRole(org, member, owner, OrgRoleMember); err != ErrOrgForbidden {
+		t.Fatal("member can not change owner", err)
+	}
+	if err = RemoveMember(org, owner, owner); err != ErrLastOwner {
+		t.Fatal("last owner can not leave", err)
+	}
+	if err = RemoveMember(org, member, member); err != nil {
+		t.Fatal(err)
+	}
+	orgs, err = GetUserOrganizations(member)
+	if err != nil || len(orgs) != 0 {
+		t.Fatal("member should leave organization", orgs, err)
+	}
+}
@@ -0,0 +1,81 @@
+package ucenter
+
+import (
+	"strings"
+)
+
+// qqBaseURL url of QQ connect api
+const qqBaseURL = "https://graph.qq.com"
+
+// QQConnector login by QQ connect, ID of identity is openid of user
+type QQConnector struct {
+	AppID  string
+	AppKey string
+	// BaseURL of api, default is https://graph.qq.com
+	BaseURL string
+}
+
+// Name of connector is "qq"
+func (c *QQConnector) Name() string {
+	return "qq"
+}
+
+// AuthCodeURL url of QQ login page
+func (c *QQConnector) AuthCodeURL(req *ConnectorRequest) (string, error) {
+	return addQuery(c.baseURL()+"/oauth2.0/authorize",
+		"response_type", "code", "client_id", c.AppID,
+		"redirect_uri", req.RedirectURI, "state", req.State,
+		"scope", "get_user_info"), nil
+}
+
+// Identity get openid and nickname of user by code
+func (c *QQConnector) Identity(req *ConnectorRequest, code string) (*ExternalIdentity, error) {
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       int    `json:"error"`
+	}
+	err := connectorGet(addQuery(c.baseURL()+"/oauth2.0/token",
+		"grant_type", "authorization_code", "client_id", c.AppID,
+		"client_secret", c.AppKey, "code", code,
+		"redirect_uri", req.RedirectURI, "fmt", "json"), &token)
+	if err != nil {
+		return nil, err
+	}
+	if token.Error != 0 || len(token.AccessToken) == 0 {
+		return nil, ErrUpstreamFailed
+	}
+	var me struct {
+		ClientID string `json:"client_id"`
+		OpenID   string `json:"openid"`
+	}
+	err = connectorGet(addQuery(c.baseURL()+"/oauth2.0/me",
+		"access_token", token.AccessToken, "fmt", "json"), &me)
+	if err != nil {
+		return nil, err
+	}
+	// token must be issued to this app
+	if me.ClientID != c.AppID || len(me.OpenID) == 0 {
+		return nil, ErrUpstreamFailed
+	}
+	var info struct {
+		Ret      int    `json:"ret"`
+		Nickname string `json:"nickname"`
+	}
+	err = connectorGet(addQuery(c.baseURL()+"/user/get_user_info",
+		"access_token", token.AccessToken, "oauth_consumer_key", c.AppID,
+		"openid", me.OpenID), &info)
+	if err != nil {
+		return nil, err
+	}
+	if info.Ret != 0 {
+		return nil, ErrUpstreamFailed
+	}
+	return &ExternalIdentity{ID: me.OpenID, Nickname: info.Nickname}, nil
+}
+
+func (c *QQConnector) baseURL() string {
+	if len(c.BaseURL) == 0 {
+		return qqBaseURL
+	}
+	return strings.TrimRight(c.BaseURL, "/")
+}
@@ -0,0 +1,607 @@
+package ucenter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Role role with its permissions, user has all permissions of his
+// roles and the roles they inherit
+type Role struct {
+	ID int64
+	// Tenant of role, empty for default tenant, user can only have
+	// roles of his tenant
+	Tenant      string
+	Name        string
+	Description string
+	// Parents roles inherited by this role
+	Parents     []string
+	Permissions []string
+}
+
+// userAccess effective roles, permissions and organizations of user, cached
+type userAccess struct {
+	Roles         []string                 `json:"roles"`
+	Permissions   []string                 `json:"permissions"`
+	Organizations []OrganizationMembership `json:"organizations"`
+}
+
+// rbacVersion changed when roles or organizations changed, so cached
+// access of all users are invalid. it is saved in redis if redis is used
+var rbacVersion int64
+
+// CreateRole create a role of default tenant, name must be unique
+// in the tenant
+func CreateRole(name string, description string) error {
+	return createRole("", name, description)
+}
+
+func createRole(tenant string, name string, description string) error {
+	if len(tenant) > 0 && !validTenant(tenant) {
+		return ErrTenantInvalid
+	}
+	if !validRBACName(name) {
+		return ErrParamInvalid
+	}
+	r, err := getRoleByName(tenant, name)
+	if err != nil && err != ErrRoleNotExist {
+		return err
+	}
+	if r != nil {
+		return ErrRoleExist
+	}
+	sql := "insert into " + Config.RoleTableName +
+		"(tenant_id, name, description, created) values(?, ?, ?, now())"
+	_, err = db.Exec(sql, tenant, name, description)
+	return err
+}
+
+// DeleteRole delete role and its permissions, users and roles
+// have it will lose it
+func DeleteRole(name string) error {
+	return deleteRole("", name)
+}
+
+func deleteRole(tenant string, name string) error {
+	r, err := getRoleByName(tenant, name)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	sqls := []string{
+		"delete from " + Config.RoleTableName + " where id = ?",
+		"delete from " + Config.RolePermissionTableName + " where role_id = ?",
+		"delete from " + Config.UserRoleTableName + " where role_id = ?",
+		"delete from " + Config.RoleParentTableName + " where role_id = ?",
+		"delete from " + Config.RoleParentTableName + " where parent_id = ?",
+	}
+	for i := 0; i < len(sqls); i++ {
+		if _, err = tx.Exec(sqls[i], r.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return changeRBACVersion()
+}
+
+// GetRole get role with its parents and permissions
+func GetRole(name string) (*Role, error) {
+	return getRole("", name)
+}
+
+func getRole(tenant string, name string) (*Role, error) {
+	r, err := getRoleByName(tenant, name)
+	if err != nil {
+		return nil, err
+	}
+	parents, err := queryStrings("select r.name from "+
+		Config.RoleParentTableName+" p join "+Config.RoleTableName+
+		" r on r.id = p.parent_id where p.role_id = ? order by r.name", r.ID)
+	if err != nil {
+		return nil, err
+	}
+	perms, err := queryStrings("select permission from "+
+		Config.RolePermissionTableName+
+		" where role_id = ? order by permission", r.ID)
+	if err != nil {
+		return nil, err
+	}
+	r.Parents = parents
+	r.Permissions = perms
+	return r, nil
+}
+
+// GetRoles get all roles of default tenant, parents and permissions
+// are not included
+func GetRoles() ([]*Role, error) {
+	return getRoles("")
+}
+
+func getRoles(tenant string) ([]*Role, error) {
+	sql := "select id, tenant_id, name, description from " +
+		Config.RoleTableName + " where tenant_id = ? order by name"
+	rows, err := db.Query(sql, tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var roles []*Role
+	for rows.Next() {
+		var r Role
+		if err = rows.Scan(&r.ID, &r.Tenant, &r.Name,
+			&r.Description); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		roles = append(roles, &r)
+	}
+	return roles, nil
+}
+
+// AddRoleParent role inherit all permissions of parent,
+// it returns ErrRoleCycle if parent has inherited role
+func AddRoleParent(role string, parent string) error {
+	return addRoleParent("", role, parent)
+}
+
+func addRoleParent(tenant string, role string, parent string) error {
+	r, err := getRoleByName(tenant, role)
+	if err != nil {
+		return err
+	}
+	p, err := getRoleByName(tenant, parent)
+	if err != nil {
+		return err
+	}
+	ancestors, err := roleAncestors([]int64{p.ID})
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(ancestors); i++ {
+		if ancestors[i] == r.ID {
+			return ErrRoleCycle
+		}
+	}
+	sql := "insert ignore into " + Config.RoleParentTableName +
+		"(role_id, parent_id) values(?, ?)"
+	if _, err = db.Exec(sql, r.ID, p.ID); err != nil {
+		return err
+	}
+	return changeRBACVersion()
+}
+
+// RemoveRoleParent role not inherit parent any more
+func RemoveRoleParent(role string, parent string) error {
+	return removeRoleParent("", role, parent)
+}
+
+func removeRoleParent(tenant string, role string, parent string) error {
+	r, err := getRoleByName(tenant, role)
+	if err != nil {
+		return err
+	}
+	p, err := getRoleByName(tenant, parent)
+	if err != nil {
+		return err
+	}
+	sql := "delete from " + Config.RoleParentTableName +
+		" where role_id = ? and parent_id = ?"
+	if _, err = db.Exec(sql, r.ID, p.ID); err != nil {
+		return err
+	}
+	return changeRBACVersion()
+}
+
+// GrantPermission add permission to role
+func GrantPermission(role string, permission string) error {
+	return grantPermission("", role, permission)
+}
+
+func grantPermission(tenant string, role string, permission string) error {
+	if !validRBACName(permission) {
+		return ErrPermissionInvalid
+	}
+	r, err := getRoleByName(tenant, role)
+	if err != nil {
+		return err
+	}
+	sql := "insert ignore into " + Config.RolePermissionTableName +
+		"(role_id, permission) values(?, ?)"
+	if _, err = db.Exec(sql, r.ID, permission); err != nil {
+		return err
+	}
+	return changeRBACVersion()
+}
+
+// RevokePermission remove permission from role
+func RevokePermission(role string, permission string) error {
+	return revokePermission("", role, permission)
+}
+
+func revokePermission(tenant string, role string, permission string) error {
+	r, err := getRoleByName(tenant, role)
+	if err != nil {
+		return err
+	}
+	sql := "delete from " + Config.RolePermissionTableName +
+		" where role_id = ? and permission = ?"
+	if _, err = db.Exec(sql, r.ID, permission); err != nil {
+		return err
+	}
+	return changeRBACVersion()
+}
+
+// AssignRole give role to user
+func AssignRole(name string, role string) error {
+	return assignRole(accountKey("", name), role)
+}
+
+// assignRole give role to user by account key, the role must be
+// in the tenant of user
+func assignRole(name string, role string) error {
+	u, err := getUserByName(name)
+	if err != nil {
+		return err
+	}
+	r, err := getRoleByName(u.Tenant, role)
+	if err != nil {
+		return err
+	}
+	sql := "insert ignore into " + Config.UserRoleTableName +
+		"(user_id, role_id, created) values(?, ?, now())"
+	if _, err = db.Exec(sql, u.ID, r.ID); err != nil {
+		return err
+	}
+	deleteUserAccess(name)
+	return nil
+}
+
+// UnassignRole take role from user
+func UnassignRole(name string, role string) error {
+	return unassignRole(accountKey("", name), role)
+}
+
+func unassignRole(name string, role string) error {
+	u, err := getUserByName(name)
+	if err != nil {
+		return err
+	}
+	r, err := getRoleByName(u.Tenant, role)
+	if err != nil {
+		return err
+	}
+	sql := "delete from " + Config.UserRoleTableName +
+		" where user_id = ? and role_id = ?"
+	if _, err = db.Exec(sql, u.ID, r.ID); err != nil {
+		return err
+	}
+	deleteUserAccess(name)
+	return nil
+}
+
+// GetUserRoles roles assigned to user and the roles they inherit
+func GetUserRoles(name string) ([]string, error) {
+	return getUserRoles(accountKey("", name))
+}
+
+func getUserRoles(name string) ([]string, error) {
+	a, err := getUserAccess(name)
+	if err != nil {
+		return nil, err
+	}
+	return a.Roles, nil
+}
+
+// GetUserPermissions all permissions user has by his roles
+func GetUserPermissions(name string) ([]string, error) {
+	return getUserPermissions(accountKey("", name))
+}
+
+func getUserPermissions(name string) ([]string, error) {
+	a, err := getUserAccess(name)
+	if err != nil {
+		return nil, err
+	}
+	return a.Permissions, nil
+}
+
+// HasPermission user has the permission by his roles, result is
+// cached until roles of user or permissions of roles changed
+func HasPermission(name string, permission string) (bool, error) {
+	return hasPermission(accountKey("", name), permission)
+}
+
+// hasPermission check permission of user by account key
+func hasPermission(name string, permission string) (bool, error) {
+	a, err := getUserAccess(name)
+	if err != nil {
+		return false, err
+	}
+	return containsString(a.Permissions, permission), nil
+}
+
+// CreateRole create a role of the tenant
+func (t Tenant) CreateRole(name string, description string) error {
+	return createRole(string(t), name, description)
+}
+
+// DeleteRole delete role of the tenant
+func (t Tenant) DeleteRole(name string) error {
+	return deleteRole(string(t), name)
+}
+
+// GetRole get role of the tenant with its parents and permissions
+func (t Tenant) GetRole(name string) (*Role, error) {
+	return getRole(string(t), name)
+}
+
+// GetRoles get all roles of the tenant
+func (t Tenant) GetRoles() ([]*Role, error) {
+	return getRoles(string(t))
+}
+
+// AddRoleParent role of the tenant inherit parent of the same tenant
+func (t Tenant) AddRoleParent(role string, parent string) error {
+	return addRoleParent(string(t), role, parent)
+}
+
+// RemoveRoleParent role of the tenant not inherit parent any more
+func (t Tenant) RemoveRoleParent(role string, parent string) error {
+	return removeRoleParent(string(t), role, parent)
+}
+
+// GrantPermission add permission to role of the tenant
+func (t Tenant) GrantPermission(role string, permission string) error {
+	return grantPermission(string(t), role, permission)
+}
+
+// RevokePermission remove permission from role of the tenant
+func (t Tenant) RevokePermission(role string, permission string) error {
+	return revokePermission(string(t), role, permission)
+}
+
+// AssignRole give role of the tenant to user in the tenant
+func (t Tenant) AssignRole(name string, role string) error {
+	return assignRole(t.key(name), role)
+}
+
+// UnassignRole take role from user in the tenant
+func (t Tenant) UnassignRole(name string, role string) error {
+	return unassignRole(t.key(name), role)
+}
+
+// GetUserRoles roles of user in the tenant
+func (t Tenant) GetUserRoles(name string) ([]string, error) {
+	return getUserRoles(t.key(name))
+}
+
+// GetUserPermissions permissions of user in the tenant
+func (t Tenant) GetUserPermissions(name string) ([]string, error) {
+	return getUserPermissions(t.key(name))
+}
+
+// HasPermission user in the tenant has the permission by his roles
+func (t Tenant) HasPermission(name string, permission string) (bool, error) {
+	return hasPermission(t.key(name), permission)
+}
+
+// getUserAccess get roles and permissions of user from cache,
+// load from database if not cached
+func getUserAccess(name string) (*userAccess, error) {
+	key := userAccessKey(name)
+	var a userAccess
+	if s := getTempValue(key); len(s) > 0 {
+		if err := json.Unmarshal([]byte(s), &a); err == nil {
+			return &a, nil
+		}
+	}
+	u, err := getUserByName(name)
+	if err != nil {
+		return nil, err
+	}
+	direct, err := queryInt64s("select ur.role_id from "+
+		Config.UserRoleTableName+" ur join "+Config.RoleTableName+
+		" r on r.id = ur.role_id where ur.user_id = ? and r.tenant_id = ?",
+		u.ID, u.Tenant)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := roleAncestors(direct)
+	if err != nil {
+		return nil, err
+	}
+	a.Organizations, err = getMemberships(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	a.Roles = []string{}
+	a.Permissions = []string{}
+	if len(ids) > 0 {
+		in := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+		args := make([]interface{}, len(ids))
+		for i := 0; i < len(ids); i++ {
+			args[i] = ids[i]
+		}
+		a.Roles, err = queryStrings("select name from "+
+			Config.RoleTableName+" where id in ("+in+") order by name",
+			args...)
+		if err != nil {
+			return nil, err
+		}
+		a.Permissions, err = queryStrings("select distinct permission from "+
+			Config.RolePermissionTableName+" where role_id in ("+in+
+			") order by permission", args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	b, err := json.Marshal(&a)
+	if err != nil {
+		return nil, err
+	}
+	setTempValue(key, string(b), Config.InMemoryCacheExpireIn)
+	return &a, nil
+}
+
+// roleAncestors roles and all roles inherited by them
+func roleAncestors(ids []int64) ([]int64, error) {
+	var ret []int64
+	seen := make(map[int64]bool)
+	queue := append([]int64{}, ids...)
+	sql := "select parent_id from " + Config.RoleParentTableName +
+		" where role_id = ?"
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ret = append(ret, id)
+		parents, err := queryInt64s(sql, id)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, parents...)
+	}
+	return ret, nil
+}
+
+// userAccessKey cache key of user access, it contains the version
+// so cache of all users are invalid after roles changed
+func userAccessKey(name string) string {
+	var version int64
+	if redisPool == nil {
+		version = atomic.LoadInt64(&rbacVersion)
+	} else {
+		c := redisPool.Get()
+		version, _ = redis.Int64(c.Do("GET", "rbac_version"))
+		c.Close()
+	}
+	return "user_access@" + strconv.FormatInt(version, 10) + "@" + name
+}
+
+func deleteUserAccess(name string) {
+	deleteTempValue(userAccessKey(name))
+}
+
+// changeRBACVersion make cached access of all users invalid
+func changeRBACVersion() error {
+	if redisPool == nil {
+		atomic.AddInt64(&rbacVersion, 1)
+		return nil
+	}
+	c := redisPool.Get()
+	defer c.Close()
+	_, err := c.Do("INCR", "rbac_version")
+	if err != nil {
+		fmt.Println(err)
+		return ErrSetRedis
+	}
+	return nil
+}
+
+// validRBACName name of role and permission has no space
+func validRBACName(s string) bool {
+	return len(s) > 0 && len(s) <= 128 && validScope(s)
+}
+
+func getRoleByName(tenant string, name string) (*Role, error) {
+	sql := "select id, tenant_id, name, description from " +
+		Config.RoleTableName + " where tenant_id = ? and name = ?"
+	rows, err := db.Query(sql, tenant, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r Role
+		if err = rows.Scan(&r.ID, &r.Tenant, &r.Name,
+			&r.Description); err != nil {
+			return nil, err
+		}
+		return &r, nil
+	}
+	return nil, ErrRoleNotExist
+}
+
+func queryStrings(sql string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []string{}
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+func queryInt64s(sql string, args ...interface{}) ([]int64, error) {
+	rows, err := db.Query(sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []int64
+	for rows.Next() {
+		var n int64
+		if err = rows.Scan(&n); err != nil {
+			return nil, err
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+func createRoleTables() error {
+	createStrs := []string{
+		"create table " + Config.RoleTableName + "(" +
+			"id               bigint(20) unsigned NOT NULL AUTO_INCREMENT," +
+			"tenant_id        varchar(64) NOT NULL DEFAULT ''," +
+			"name             varchar(128) NOT NULL DEFAULT ''," +
+			"description      varchar(255) NOT NULL DEFAULT ''," +
+			"created          datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			"PRIMARY KEY (`id`), " +
+			"UNIQUE KEY `tenant_name` (`tenant_id`, `name`)" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+		"create table " + Config.RoleParentTableName + "(" +
+			"role_id          bigint(20) unsigned NOT NULL," +
+			"parent_id        bigint(20) unsigned NOT NULL," +
+			"PRIMARY KEY (`role_id`, `parent_id`)" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+		"create table " + Config.RolePermissionTableName + "(" +
+			"role_id          bigint(20) unsigned NOT NULL," +
+			"permission       varchar(128) NOT NULL DEFAULT ''," +
+			"PRIMARY KEY (`role_id`, `permission`)" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+		"create table " + Config.UserRoleTableName + "(" +
+			"user_id          bigint(20) unsigned NOT NULL," +
+			"role_id          bigint(20) unsigned NOT NULL," +
+			"created          datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			"PRIMARY KEY (`user_id`, `role_id`), " +
+			"KEY `role_id` (`role_id`)" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+	}
+	for i := 0; i < len(createStrs); i++ {
+		if _, err := db.Exec(createStrs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package ucenter
+
+import (
+	"testing"
+)
+
+func TestRBAC(t *testing.T) {
+	requireMySQL(t)
+	name := "sails"
+	for _, role := range []string{"test_viewer", "test_editor"} {
+		DeleteRole(role)
+		if err := CreateRole(role, ""); err != nil {
+			t.Fatal(err)
+		}
+		defer DeleteRole(role)
+	}
+	if err := CreateRole("test_viewer", ""); err != ErrRoleExist {
+		t.Fatal("role should exist", err)
+	}
+	if err := GrantPermission("test_viewer", "doc:read"); err != nil {
+		t.Fatal(err)
+	}
+	if err := GrantPermission("test_editor", "doc:write"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddRoleParent("test_editor", "test_viewer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddRoleParent("test_viewer", "test_editor"); err != ErrRoleCycle {
+		t.Fatal("inherit cycle should be found", err)
+	}
+	if err := AssignRole(name, "test_editor"); err != nil {
+		t.Fatal(err)
+	}
+	ok, err := HasPermission(name, "doc:read")
+	if err != nil || !ok {
+		t.Fatal("inherited permission should be found", err)
+	}
+	roles, err := GetUserRoles(name)
+	if err != nil || !containsString(roles, "test_viewer") {
+		t.Fatal("inherited role should be found", roles, err)
+	}
+	if err = RevokePermission("test_viewer", "doc:read"); err != nil {
+		t.Fatal(err)
+	}
+	ok, err = HasPermission(name, "doc:read")
+	if err != nil || ok {
+		t.Fatal("cache should be invalid after permission revoked", err)
+	}
+	if err = UnassignRole(name, "test_editor"); err != nil {
+		t.Fatal(err)
+	}
+	ok, err = HasPermission(name, "doc:write")
+	if err != nil || ok {
+		t.Fatal("cache should be invalid after role unassigned", err)
+	}
+}
+
+func TestTenantRoles(t *testing.T) {
+	requireMySQL(t)
+	a, b := Tenant("tenant_a"), Tenant("tenant_b")
+	for _, tenant := range []Tenant{a, b} {
+		err := tenant.UserRegister(UserInfo{UserName: "sails",
+			Password: "pwd_" + string(tenant)})
+		if err != nil && err != ErrUserExist {
+			t.Fatal(err)
+		}
+		tenant.DeleteRole("test_admin")
+		if err = tenant.CreateRole("test_admin", ""); err != nil {
+			t.Fatal("role name should be unique in tenant:", err)
+		}
+		defer tenant.DeleteRole("test_admin")
+	}
+	if err := a.GrantPermission("test_admin", "doc:delete"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AssignRole("sails", "test_admin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetRole("test_admin"); err != ErrRoleNotExist {
+		t.Fatal("role of tenant should not be in default tenant:", err)
+	}
+	ok, err := a.HasPermission("sails", "doc:delete")
+	if err != nil || !ok {
+		t.Fatal("permission of tenant role should be found", err)
+	}
+	ok, err = b.HasPermission("sails", "doc:delete")
+	if err != nil || ok {
+		t.Fatal("permission of other tenant should not be found", err)
+	}
+	key := accountKey("tenant_a", "sails")
+	if ok, _ = HasPermission(key, "doc:delete"); ok {
+		t.Fatal("account key should not be accepted as user name")
+	}
+}
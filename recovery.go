@@ -0,0 +1,199 @@
+package ucenter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+const (
+	// recoveryCodeCount codes created every time
+	recoveryCodeCount = 10
+	// recoveryCodeLength chars of a code, without "-"
+	recoveryCodeLength = 10
+	// no "l" and "o" which are confused with "1" and "0"
+	recoveryCodeChars = "abcdefghijkmnpqrstuvwxyz23456789"
+)
+
+// SecurityInfo security settings of user
+type SecurityInfo struct {
+	MFAEnabled             bool
+	RecoveryCodesRemaining int
+	Passkeys               int
+}
+
+// GenerateRecoveryCodes create new recovery codes for user who has
+// enabled mfa, old codes will be invalid. The codes only return this
+// time and save hashed, so they must show to user at once
+func GenerateRecoveryCodes(name string) ([]string, error) {
+	u, err := getUserByName(accountKey("", name))
+	if err != nil {
+		return nil, err
+	}
+	enabled, err := mfaEnabled(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, ErrMFANotEnrolled
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		hash, err := hashRecoveryCode(u.ID, code)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, hash)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	sql := "delete from " + Config.RecoveryCodeTableName +
+		" where user_id = ?"
+	if _, err = tx.Exec(sql, u.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	sql = "insert into " + Config.RecoveryCodeTableName +
+		"(user_id, code_hash, created) values(?, ?, now())"
+	for i := 0; i < len(hashes); i++ {
+		if _, err = tx.Exec(sql, u.ID, hashes[i]); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// GetSecurityInfo get mfa status and count of recovery codes not used
+func GetSecurityInfo(name string) (*SecurityInfo, error) {
+	u, err := getUserByName(accountKey("", name))
+	if err != nil {
+		return nil, err
+	}
+	var info SecurityInfo
+	info.MFAEnabled, err = mfaEnabled(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	sql := "select count(*) from " + Config.RecoveryCodeTableName +
+		" where user_id = ? and used = 0"
+	err = db.QueryRow(sql, u.ID).Scan(&info.RecoveryCodesRemaining)
+	if err != nil {
+		return nil, err
+	}
+	info.Passkeys, err = countPasskeys(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// isRecoveryCode recovery code is not all digits as totp code
+func isRecoveryCode(code string) bool {
+	if len(code) != totpDigits {
+		return true
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return true
+		}
+	}
+	return false
+}
+
+// useRecoveryCode mark recovery code used, every code can use once
+func useRecoveryCode(userID int64, code string) error {
+	hash, err := hashRecoveryCode(userID, code)
+	if err != nil {
+		return err
+	}
+	sql := "update " + Config.RecoveryCodeTableName +
+		" set used = 1, used_time = now()" +
+		" where user_id = ? and code_hash = ? and used = 0"
+	ret, err := db.Exec(sql, userID, hash)
+	if err != nil {
+		return err
+	}
+	affected, err := ret.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrMFACodeInvalid
+	}
+	return nil
+}
+
+func deleteRecoveryCodes(userID int64) error {
+	sql := "delete from " + Config.RecoveryCodeTableName +
+		" where user_id = ?"
+	_, err := db.Exec(sql, userID)
+	return err
+}
+
+// newRecoveryCode code like "k7rmd-2xq9a"
+func newRecoveryCode() (string, error) {
+	b, err := randomBytes(recoveryCodeLength)
+	if err != nil {
+		return "", err
+	}
+	code := make([]byte, 0, recoveryCodeLength+1)
+	for i := 0; i < len(b); i++ {
+		if i == recoveryCodeLength/2 {
+			code = append(code, '-')
+		}
+		code = append(code, recoveryCodeChars[int(b[i])%len(recoveryCodeChars)])
+	}
+	return string(code), nil
+}
+
+// normalizeRecoveryCode user may input code in upper case or without "-"
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "-", "", -1)
+	return strings.Replace(code, " ", "", -1)
+}
+
+// hashRecoveryCode recovery code is short, so hash it with
+// Config.SecretKey and user id
+func hashRecoveryCode(userID int64, code string) (string, error) {
+	key, err := secretKey()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d:%s", userID, normalizeRecoveryCode(code))
+	return fmt.Sprintf("%x", mac.Sum(nil)), nil
+}
+
+// save hash of recovery codes
+func createRecoveryCodeTable() error {
+	createStr := "create table " + Config.RecoveryCodeTableName + "(" +
+		"ID               bigint(20) unsigned NOT NULL AUTO_INCREMENT," +
+		"user_id          bigint(20) unsigned NOT NULL," +
+		"code_hash        varchar(64) NOT NULL DEFAULT ''," +
+		"used             tinyint(1) NOT NULL DEFAULT 0," +
+		"used_time        datetime NULL DEFAULT NULL," +
+		"created          datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`ID`), " +
+		"KEY `user_id` (`user_id`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8"
+	_, err := db.Exec(createStr)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+package ucenter
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultUsedRefreshTokenKeepIn seconds to remember rotated refresh
+// tokens if refresh token never expire
+const defaultUsedRefreshTokenKeepIn = 30 * 24 * 60 * 60 // a month
+
+// SecurityEventRefreshTokenReused refresh token used twice, it may
+// have been stolen, all tokens of the login are revoked
+const SecurityEventRefreshTokenReused = "refresh_token_reused"
+
+// SecurityEventPasskeyCloned sign count of passkey not increase,
+// the authenticator may have been cloned
+const SecurityEventPasskeyCloned = "passkey_cloned"
+
+// SecurityEvent something may be an attack happened,
+// handled by Config.SecurityEventHandler
+type SecurityEvent struct {
+	Type     string
+	UserName string
+	Time     time.Time
+	Detail   string
+}
+
+// reportSecurityEvent call Config.SecurityEventHandler or print it
+func reportSecurityEvent(typ string, name string, detail string) {
+	e := SecurityEvent{typ, name, time.Now(), detail}
+	if Config.SecurityEventHandler != nil {
+		Config.SecurityEventHandler(e)
+		return
+	}
+	fmt.Println("security event:", e.Type, e.UserName, e.Detail)
+}
+
+// newRefreshFamily every login start a new family of refresh
+// tokens, tokens rotated from it are in the same family
+func newRefreshFamily() (string, error) {
+	return randomToken(16)
+}
+
+// setRefreshFamily set family of the current refresh token of user
+// issued to client, created is the unix time of login
+func setRefreshFamily(name string, client string, family string, created int64) error {
+	if redisPool == nil {
+		tenant, user := splitAccountKey(name)
+		sql := "update " + Config.TokenTablename +
+			" set refresh_family = ?, family_created = ?" + tokenWhere
+		_, err := db.Exec(sql, family, created, tenant, user, client)
+		if err != nil {
+			fmt.Println(err)
+			return ErrSetRefreshToken
+		}
+		return nil
+	}
+	c := redisPool.Get()
+	defer c.Close()
+	args := []interface{}{"refresh_family@" + grantKey(name, client),
+		family + " " + strconv.FormatInt(created, 10)}
+	if lifetime := tenantConfig(name).SessionMaxLifetime; lifetime > 0 {
+		args = append(args, "EX", strconv.Itoa(lifetime))
+	}
+	_, err := c.Do("SET", args...)
+	if err != nil {
+		fmt.Println(err)
+		return ErrSetRefreshToken
+	}
+	return nil
+}
+
+// rotateRefreshToken replace refresh token of user issued to client
+// only if it is still old, so only one of the requests using the same
+// token will succeed. expire is the lifetime of new token in redis
+func rotateRefreshToken(name string, client string, old string, token string, expire int) (bool, error) {
+	if redisPool == nil {
+		tenant, user := splitAccountKey(name)
+		sql := "update " + Config.TokenTablename +
+			" set refresh_token = ?, rtoken_created = now()" + tokenWhere +
+			" and refresh_token = ?"
+		ret, err := db.Exec(sql, token, tenant, user, client, old)
+		if err != nil {
+			fmt.Println(err)
+			return false, ErrSetRefreshToken
+		}
+		affected, err := ret.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		return affected > 0, nil
+	}
+	c := redisPool.Get()
+	defer c.Close()
+	key := grantKey(name, client)
+	n, err := redis.Int(rotateScript.Do(c, "refresh_token@"+key, old, token,
+		expire))
+	if err != nil {
+		fmt.Println(err)
+		return false, ErrSetRefreshToken
+	}
+	if n == 1 {
+		if err = setTokenOwner(c, token, key, expire); err != nil {
+			return false, ErrSetRefreshToken
+		}
+	}
+	return n == 1, nil
+}
+
+var rotateScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	if tonumber(ARGV[3]) > 0 then
+		redis.call("SET", KEYS[1], ARGV[2], "EX", ARGV[3])
+	else
+		redis.call("SET", KEYS[1], ARGV[2])
+	end
+	return 1
+end
+return 0`)
+
+// refreshTokenLifetime seconds the refresh token of user issued to
+// client can be used, it is RefreshTokenExpiresIn but not after the max
+// lifetime of the session. 0 means never expire
+func refreshTokenLifetime(name string, client string, sessionCreated int64) int {
+	c := tokenConfig(name, client)
+	lifetime := c.RefreshTokenExpiresIn
+	if c.SessionMaxLifetime > 0 && sessionCreated > 0 {
+		left := int(sessionCreated + int64(c.SessionMaxLifetime) -
+			time.Now().Unix())
+		if left <= 0 {
+			return -1
+		}
+		if lifetime == 0 || left < lifetime {
+			lifetime = left
+		}
+	}
+	return lifetime
+}
+
+// refreshTokenExpired check refresh token by the time it created
+// and the time of login
+func refreshTokenExpired(t *TokenInfo) (bool, error) {
+	c := tokenConfig(t.key(), t.ClientID)
+	if c.SessionMaxLifetime > 0 && t.SessionCreated > 0 &&
+		time.Now().Unix()-t.SessionCreated > int64(c.SessionMaxLifetime) {
+		return true, nil
+	}
+	// token expired in redis has been deleted
+	if redisPool != nil || c.RefreshTokenExpiresIn == 0 {
+		return false, nil
+	}
+	created, err := parseDBTime(t.RefreshTokenCreated)
+	if err != nil {
+		return false, err
+	}
+	return time.Now().Unix()-created.Unix() >
+		int64(c.RefreshTokenExpiresIn), nil
+}
+
+// usedRefreshTokenKeepIn rotated token older than it has expired,
+// so no need to remember it
+func usedRefreshTokenKeepIn() int {
+	if n := maxRefreshTokenExpiresIn(); n > 0 {
+		return n
+	}
+	return defaultUsedRefreshTokenKeepIn
+}
+
+// usedRefreshTokenPurged unix time of the last purge of rotated
+// tokens in database
+var usedRefreshTokenPurged int64
+
+// purgeUsedRefreshTokens delete expired rotated tokens at most once a
+// minute, and only some of them each time so refresh is not blocked
+func purgeUsedRefreshTokens(now int64) {
+	last := atomic.LoadInt64(&usedRefreshTokenPurged)
+	if now-last < 60 ||
+		!atomic.CompareAndSwapInt64(&usedRefreshTokenPurged, last, now) {
+		return
+	}
+	sql := "delete from " + Config.RefreshTokenTableName +
+		" where created < ? limit 1000"
+	_, err := db.Exec(sql, now-int64(usedRefreshTokenKeepIn()))
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// saveUsedRefreshToken remember the rotated token of user issued to
+// client, if it is used again the family will be revoked. false is
+// returned if the token has been saved, it is used by other request
+func saveUsedRefreshToken(name string, client string, family string, token string) (bool, error) {
+	hash := hashToken(token)
+	if redisPool == nil {
+		now := time.Now().Unix()
+		sql := "insert ignore into " + Config.RefreshTokenTableName +
+			"(token_hash, family, client_id, user_name, created)" +
+			" values(?, ?, ?, ?, ?)"
+		ret, err := db.Exec(sql, hash, family, client, name, now)
+		if err != nil {
+			fmt.Println(err)
+			return false, ErrSetRefreshToken
+		}
+		affected, err := ret.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		purgeUsedRefreshTokens(now)
+		return affected > 0, nil
+	}
+	c := redisPool.Get()
+	defer c.Close()
+	// client id has no space, user name is the last
+	ret, err := c.Do("SET", "used_refresh_token@"+hash,
+		family+" "+client+" "+name,
+		"EX", strconv.Itoa(usedRefreshTokenKeepIn()), "NX")
+	if err != nil {
+		fmt.Println(err)
+		return false, ErrSetRefreshToken
+	}
+	return ret != nil, nil
+}
+
+// getUsedRefreshToken return family, client and user of rotated
+// token, empty if the token is never used
+func getUsedRefreshToken(token string) (string, string, string, error) {
+	hash := hashToken(token)
+	if redisPool == nil {
+		sql := "select family, client_id, user_name from " +
+			Config.RefreshTokenTableName + " where token_hash = ?"
+		rows, err := db.Query(sql, hash)
+		if err != nil {
+			return "", "", "", err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var family, client, name string
+			if err = rows.Scan(&family, &client, &name); err == nil {
+				return family, client, name, nil
+			}
+			fmt.Println(err)
+		}
+		return "", "", "", nil
+	}
+	c := redisPool.Get()
+	defer c.Close()
+	s, err := redis.String(c.Do("GET", "used_refresh_token@"+hash))
+	if err == redis.ErrNil {
+		return "", "", "", nil
+	}
+	if err != nil {
+		fmt.Println("redis get failed:", err)
+		return "", "", "", ErrGetRedis
+	}
+	parts := strings.SplitN(s, " ", 3)
+	if len(parts) != 3 {
+		return "", "", "", nil
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// checkRefreshTokenReused the token is not the current refresh token
+// of t, if it is rotated from the current token, the family is revoked
+func checkRefreshTokenReused(name string, t *TokenInfo, token string) error {
+	family, client, user, err := getUsedRefreshToken(token)
+	if err != nil {
+		return err
+	}
+	if len(family) == 0 || user != name || client != t.ClientID ||
+		family != t.RefreshFamily {
+		return ErrRefreshTokenInvalid
+	}
+	revokeGrantTokens(name, client)
+	reportSecurityEvent(SecurityEventRefreshTokenReused, name,
+		"refresh token family "+family+" revoked")
+	return ErrRefreshTokenReused
+}
+
+// revokeUserTokens delete tokens of user issued to ucenter and all
+// clients, and session of user
+func revokeUserTokens(name string) {
+	clients, err := getTokenClients(name)
+	if err != nil {
+		fmt.Println(err)
+	}
+	revokeGrantTokens(name, "")
+	for i := 0; i < len(clients); i++ {
+		revokeGrantTokens(name, clients[i])
+	}
+}
+
+// revokeGrantTokens delete tokens of user issued to client, session
+// of user is deleted with tokens of ucenter itself
+func revokeGrantTokens(name string, client string) {
+	key := grantKey(name, client)
+	if redisPool == nil {
+		tenant, user := splitAccountKey(name)
+		sql := "update " + Config.TokenTablename +
+			" set refresh_token = '', refresh_family = ''," +
+			" family_created = 0, access_token = '', pre_access_token = ''," +
+			" scope = '', access_scope = '', pre_access_scope = ''" +
+			tokenWhere
+		if _, err := db.Exec(sql, tenant, user, client); err != nil {
+			fmt.Println(err)
+		}
+		accessTokenCache.Delete(key)
+		preAccessTokenCache.Delete(key)
+		if len(client) == 0 {
+			sessionCache.Delete(name)
+		}
+		return
+	}
+	c := redisPool.Get()
+	defer c.Close()
+	keys := []interface{}{"refresh_token@" + key, "refresh_family@" + key,
+		"access_token@" + key, "pre_access_token@" + key, "scope@" + key,
+		"access_scope@" + key, "pre_access_scope@" + key}
+	if len(client) == 0 {
+		keys = append(keys, "session@"+name)
+	}
+	c.Send("MULTI")
+	c.Send("DEL", keys...)
+	if len(client) > 0 {
+		c.Send("SREM", "token_clients@"+name, client)
+	}
+	if _, err := c.Do("EXEC"); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// save refresh tokens have been rotated, used to find token reuse
+func createRefreshTokenTable() error {
+	createStr := "create table " + Config.RefreshTokenTableName + "(" +
+		"token_hash       varchar(64) NOT NULL," +
+		"family           varchar(64) NOT NULL DEFAULT ''," +
+		"client_id        varchar(64) NOT NULL DEFAULT ''," +
+		"user_name        varchar(255) NOT NULL DEFAULT ''," +
+		"created          bigint(20) NOT NULL DEFAULT 0," +
+		"PRIMARY KEY (`token_hash`), " +
+		"KEY `created` (`created`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8"
+	_, err := db.Exec(createStr)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package ucenter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefreshTokenLifetime(t *testing.T) {
+	old := Config
+	defer func() { Config = old }()
+	Config.RefreshTokenExpiresIn = 100
+	Config.SessionMaxLifetime = 1000
+	now := time.Now().Unix()
+	if n := refreshTokenLifetime("", "", now); n != 100 {
+		t.Error("lifetime should be RefreshTokenExpiresIn:", n)
+	}
+	if n := refreshTokenLifetime("", "", now-950); n <= 0 || n > 50 {
+		t.Error("lifetime should not after session max lifetime:", n)
+	}
+	if n := refreshTokenLifetime("", "", now-1001); n >= 0 {
+		t.Error("session should expired:", n)
+	}
+	Config.RefreshTokenExpiresIn = 0
+	Config.SessionMaxLifetime = 0
+	if n := refreshTokenLifetime("", "", now-1001); n != 0 {
+		t.Error("token should never expire:", n)
+	}
+	expired, err := refreshTokenExpired(&TokenInfo{SessionCreated: now})
+	if err != nil || expired {
+		t.Error("token should not expire", err)
+	}
+}
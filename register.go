@@ -0,0 +1,163 @@
+package ucenter
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ClientRegistration client metadata of dynamic client registration
+// (RFC 7591), it is both the request and the response
+type ClientRegistration struct {
+	ClientID         string `json:"client_id,omitempty"`
+	ClientSecret     string `json:"client_secret,omitempty"`
+	ClientIDIssuedAt int64  `json:"client_id_issued_at,omitempty"`
+	// ClientSecretExpiresAt is 0 because secret never expire, it is
+	// only returned with secret
+	ClientSecretExpiresAt *int64   `json:"client_secret_expires_at,omitempty"`
+	RedirectURIs          []string `json:"redirect_uris,omitempty"`
+	// TokenEndpointAuthMethod "none" for public client, otherwise
+	// "client_secret_basic" (default) or "client_secret_post"
+	TokenEndpointAuthMethod string `json:"token_endpoint_auth_method,omitempty"`
+	// GrantTypes default is authorization_code
+	GrantTypes    []string `json:"grant_types,omitempty"`
+	ResponseTypes []string `json:"response_types,omitempty"`
+	ClientName    string   `json:"client_name,omitempty"`
+	LogoURI       string   `json:"logo_uri,omitempty"`
+	Scope         string   `json:"scope,omitempty"`
+}
+
+// NewInitialAccessToken create token for developer to register one
+// client by RegisterClient, it expired after expire seconds
+func NewInitialAccessToken(expire int) (string, error) {
+	if expire <= 0 {
+		return "", ErrParamInvalid
+	}
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	err = setTempValue("initial_access_token@"+hashToken(token), "1", expire)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RegisterClient register client by its metadata, initialAccessToken
+// is created by NewInitialAccessToken and can only be used once.
+// token lifetimes of client can only be set by UpdateOAuthClient
+func RegisterClient(initialAccessToken string, reg *ClientRegistration) (*ClientRegistration, error) {
+	key := "initial_access_token@" + hashToken(initialAccessToken)
+	if len(initialAccessToken) == 0 || len(getTempValue(key)) == 0 {
+		return nil, ErrInitialAccessTokenInvalid
+	}
+	c, err := registrationClient(reg)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.validate(); err != nil {
+		return nil, err
+	}
+	// token is only used by valid request
+	if len(takeTempValue(key)) == 0 {
+		return nil, ErrInitialAccessTokenInvalid
+	}
+	if err = CreateOAuthClient(c); err != nil {
+		return nil, err
+	}
+	ret := *reg
+	ret.ClientID = c.ID
+	ret.ClientIDIssuedAt = time.Now().Unix()
+	ret.RedirectURIs = c.RedirectURIs
+	ret.GrantTypes = c.GrantTypes
+	ret.ResponseTypes = []string{"code"}
+	ret.Scope = strings.Join(c.Scopes, " ")
+	if len(ret.TokenEndpointAuthMethod) == 0 {
+		ret.TokenEndpointAuthMethod = "client_secret_basic"
+	}
+	ret.ClientSecret = c.Secret
+	ret.ClientSecretExpiresAt = nil
+	if c.Confidential {
+		var never int64
+		ret.ClientSecretExpiresAt = &never
+	}
+	return &ret, nil
+}
+
+// RegistrationHandler http handler of client registration endpoint,
+// initial access token is sent as bearer token
+func RegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeOAuthError(w, http.StatusMethodNotAllowed, "invalid_request",
+			"method must be POST")
+		return
+	}
+	var reg ClientRegistration
+	b, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil || json.Unmarshal(b, &reg) != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_client_metadata", "")
+		return
+	}
+	ret, err := RegisterClient(bearerToken(r), &reg)
+	switch err {
+	case nil:
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusCreated, ret)
+	case ErrInitialAccessTokenInvalid:
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "")
+	case ErrRedirectURIInvalid:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_redirect_uri", "")
+	case ErrClientMetadataInvalid, ErrScopeInvalid:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_client_metadata", "")
+	default:
+		writeTokenError(w, err)
+	}
+}
+
+// registrationClient client of registration metadata, only response
+// type code is supported. scopes are limited by Config.RegistrationScopes
+// because client without scope can request any scope
+func registrationClient(reg *ClientRegistration) (*OAuthClient, error) {
+	c := &OAuthClient{Name: reg.ClientName, LogoURI: reg.LogoURI,
+		RedirectURIs: reg.RedirectURIs, Scopes: parseScope(reg.Scope),
+		GrantTypes: reg.GrantTypes}
+	switch reg.TokenEndpointAuthMethod {
+	case "none":
+	case "", "client_secret_basic", "client_secret_post":
+		c.Confidential = true
+	default:
+		return nil, ErrClientMetadataInvalid
+	}
+	if len(c.GrantTypes) == 0 {
+		c.GrantTypes = []string{"authorization_code"}
+	}
+	if containsString(c.GrantTypes, "client_credentials") &&
+		!Config.RegistrationClientCredentials {
+		return nil, ErrClientMetadataInvalid
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = append([]string{}, Config.RegistrationScopes...)
+	}
+	if len(c.Scopes) == 0 {
+		return nil, ErrScopeInvalid
+	}
+	for i := 0; i < len(c.Scopes); i++ {
+		if !containsString(Config.RegistrationScopes, c.Scopes[i]) {
+			return nil, ErrScopeInvalid
+		}
+	}
+	for i := 0; i < len(reg.ResponseTypes); i++ {
+		if reg.ResponseTypes[i] != "code" {
+			return nil, ErrClientMetadataInvalid
+		}
+	}
+	if containsString(c.GrantTypes, "authorization_code") &&
+		len(c.RedirectURIs) == 0 {
+		return nil, ErrRedirectURIInvalid
+	}
+	return c, nil
+}
@@ -0,0 +1,118 @@
+package ucenter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientMetadata(t *testing.T) {
+	for _, reg := range []*ClientRegistration{
+		{TokenEndpointAuthMethod: "private_key_jwt",
+			RedirectURIs: []string{"https://app.example.com/cb"}},
+		{RedirectURIs: []string{"https://app.example.com/cb"},
+			ResponseTypes: []string{"token"}},
+	} {
+		if _, err := registrationClient(reg); err != ErrClientMetadataInvalid {
+			t.Error("invalid metadata should fail:", reg, err)
+		}
+	}
+	if _, err := registrationClient(&ClientRegistration{}); err != ErrRedirectURIInvalid {
+		t.Error("authorization code client need redirect uri:", err)
+	}
+	old := Config
+	defer func() { Config = old }()
+	Config.RegistrationScopes = []string{"openid", "read", "write"}
+	uris := []string{"https://app.example.com/cb"}
+	if _, err := registrationClient(&ClientRegistration{RedirectURIs: uris,
+		Scope: "read admin"}); err != ErrScopeInvalid {
+		t.Error("scope not allowed should fail:", err)
+	}
+	reg := &ClientRegistration{GrantTypes: []string{"client_credentials"}}
+	if _, err := registrationClient(reg); err != ErrClientMetadataInvalid {
+		t.Error("client credentials should be disabled:", err)
+	}
+	Config.RegistrationClientCredentials = true
+	if _, err := registrationClient(reg); err != nil {
+		t.Error("client credentials should be enabled:", err)
+	}
+	c, err := registrationClient(&ClientRegistration{RedirectURIs: uris})
+	if err != nil || len(c.Scopes) != 3 {
+		t.Fatal("client should have all registration scopes:", c, err)
+	}
+	Config.RegistrationScopes = nil
+	if _, err = registrationClient(&ClientRegistration{
+		RedirectURIs: uris}); err != ErrScopeInvalid {
+		t.Error("client should not have any scope:", err)
+	}
+	Config.RegistrationScopes = []string{"openid", "read", "write"}
+	c, err = registrationClient(&ClientRegistration{TokenEndpointAuthMethod: "none",
+		RedirectURIs: []string{"http://127.0.0.1:8000/cb"}, Scope: "read write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Confidential || len(c.Scopes) != 2 || !c.allowGrantType("authorization_code") ||
+		c.allowGrantType("client_credentials") {
+		t.Error("client error:", c)
+	}
+	if err = c.validate(); err != nil {
+		t.Error(err)
+	}
+	c.GrantTypes = []string{"client_credentials"}
+	if err = c.validate(); err != ErrClientMetadataInvalid {
+		t.Error("public client can not use client credentials:", err)
+	}
+	c = &OAuthClient{Confidential: true, LogoURI: "javascript:alert(1)"}
+	if err = c.validate(); err != ErrClientMetadataInvalid {
+		t.Error("logo uri should be http url:", err)
+	}
+}
+
+func TestClientRegistration(t *testing.T) {
+	requireMySQL(t)
+	register := func(token string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/register", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if len(token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		RegistrationHandler(w, r)
+		return w
+	}
+	body := `{"client_name":"app","redirect_uris":["https://app.example.com/cb"],` +
+		`"grant_types":["authorization_code","refresh_token"],"scope":"openid"}`
+	if w := register("", body); w.Code != http.StatusUnauthorized {
+		t.Fatal("initial access token should be required:", w.Code)
+	}
+	token, err := NewInitialAccessToken(60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := register(token, `{"redirect_uris":["https://app.example.com/cb#frag"]}`)
+	if w.Code != http.StatusBadRequest ||
+		!strings.Contains(w.Body.String(), "invalid_redirect_uri") {
+		t.Fatal("invalid redirect uri should fail:", w.Code, w.Body.String())
+	}
+	// token is not used by invalid request
+	if w = register(token, body); w.Code != http.StatusCreated {
+		t.Fatal("register failed:", w.Code, w.Body.String())
+	}
+	var ret ClientRegistration
+	if err = json.Unmarshal(w.Body.Bytes(), &ret); err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteOAuthClient(ret.ClientID)
+	if len(ret.ClientSecret) == 0 || ret.ClientSecretExpiresAt == nil ||
+		ret.TokenEndpointAuthMethod != "client_secret_basic" {
+		t.Fatal("confidential client should get secret:", w.Body.String())
+	}
+	if _, err = authenticateOAuthClient(ret.ClientID, ret.ClientSecret); err != nil {
+		t.Fatal(err)
+	}
+	if w = register(token, body); w.Code != http.StatusUnauthorized {
+		t.Fatal("initial access token can only be used once:", w.Code)
+	}
+}
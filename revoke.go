@@ -0,0 +1,104 @@
+package ucenter
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+)
+
+// token type hints of RevokeToken
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+)
+
+// RevokeToken revoke an access token or refresh token, hint is
+// "access_token", "refresh_token" or empty, every type of token is
+// searched whatever the hint is. revoke refresh token will also revoke
+// access tokens created by it. it returns nil if the token not exist,
+// so the caller can not know whether a token is valid by it.
+// jwt access token checked offline is valid until expired
+func RevokeToken(token string, hint string) error {
+	return revokeToken(token, hint, false, "")
+}
+
+// revokeToken revoke token, if checkClient is true the token must be
+// issued to client, empty client is ucenter itself
+func revokeToken(token string, hint string, checkClient bool, client string) error {
+	if len(token) == 0 {
+		return ErrParamInvalid
+	}
+	if len(hint) > 0 && hint != TokenTypeHintAccessToken &&
+		hint != TokenTypeHintRefreshToken {
+		return ErrUnsupportedTokenType
+	}
+	if ct, hash := getClientToken(token); ct != nil {
+		if checkClient && ct.ClientID != client {
+			return ErrUnauthorizedClient
+		}
+		return deleteClientToken(hash)
+	}
+	t, typ, _, err := lookupToken(token)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return nil
+	}
+	if checkClient && t.ClientID != client {
+		return ErrUnauthorizedClient
+	}
+	// only tokens of the client are revoked
+	key := t.grantKey()
+	switch typ {
+	case refreshToken:
+		revokeGrantTokens(t.key(), t.ClientID)
+	case accessToken:
+		if redisPool != nil {
+			return deleteRedisToken("access_token@"+key, t.AccessToken)
+		}
+		// keep atoken_created, or pre_access_token will be valid longer
+		sql := "update " + Config.TokenTablename +
+			" set access_token = ''" + tokenWhere + " and access_token = ?"
+		_, err = db.Exec(sql, t.Tenant, t.UserName, t.ClientID,
+			t.AccessToken)
+		if err != nil {
+			fmt.Println(err)
+			return ErrSetAccessToken
+		}
+		accessTokenCache.Delete(key)
+	case preAccessToken:
+		if redisPool != nil {
+			return deleteRedisToken("pre_access_token@"+key,
+				t.PreAccessToken)
+		}
+		sql := "update " + Config.TokenTablename +
+			" set pre_access_token = ''" + tokenWhere +
+			" and pre_access_token = ?"
+		_, err = db.Exec(sql, t.Tenant, t.UserName, t.ClientID,
+			t.PreAccessToken)
+		if err != nil {
+			fmt.Println(err)
+			return ErrSetPreAccessToken
+		}
+		preAccessTokenCache.Delete(key)
+	}
+	return nil
+}
+
+// deleteRedisToken delete token saved in key if it is not replaced
+// by a new one
+func deleteRedisToken(key string, token string) error {
+	c := redisPool.Get()
+	defer c.Close()
+	if _, err := deleteTokenScript.Do(c, key, token); err != nil {
+		fmt.Println(err)
+		return ErrSetRedis
+	}
+	return nil
+}
+
+var deleteTokenScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
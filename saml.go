@@ -0,0 +1,387 @@
+package ucenter
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"time"
+)
+
+// namespaces, bindings and formats of SAML 2.0
+const (
+	samlNS              = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlpNS             = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlHTTPPostBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlBearer          = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	samlStatusSuccess   = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlTransientNameID = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+
+	// SAMLNameIDUnspecified default NameIDFormat of service provider
+	SAMLNameIDUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+	// SAMLNameIDEmail NameID is email of user
+	SAMLNameIDEmail = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	// SAMLNameIDPersistent NameID is opaque id of user
+	SAMLNameIDPersistent = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+)
+
+// samlMaxSkew seconds of clock difference allowed with identity provider
+const samlMaxSkew = 60
+
+// samlTimeFormat format of xs:dateTime in SAML, it must be UTC
+const samlTimeFormat = "2006-01-02T15:04:05Z"
+
+// SAMLServiceProvider login by SAML 2.0 identity provider of
+// enterprise. AuthnRequest is sent by HTTP-Redirect binding and
+// response is received by HTTP-POST binding at ACSURL, the assertion
+// or the response must be signed by IdPCertificate. responses not for
+// AuthnRequest of ucenter (idp initiated login) are not accepted
+type SAMLServiceProvider struct {
+	// ID name of provider, users of it are linked by ID and NameID.
+	// it must be different with names of connectors
+	ID string
+	// EntityID of ucenter as service provider, it is the audience of
+	// assertions
+	EntityID string
+	// ACSURL assertion consumer service url which receive SAMLResponse
+	ACSURL string
+	// IdPEntityID issuer of responses and assertions
+	IdPEntityID string
+	// IdPSSOURL single sign on url of HTTP-Redirect binding
+	IdPSSOURL string
+	// IdPCertificate certificate of signing key of identity provider,
+	// KeyInfo in signature is never trusted
+	IdPCertificate *x509.Certificate
+	// NameIDFormat requested, default is SAMLNameIDUnspecified.
+	// transient NameID is not accepted because it can not link user
+	NameIDFormat string
+	// UserNameAttribute attribute used as user name to register user,
+	// NameID is used if it is empty
+	UserNameAttribute string
+	// NicknameAttribute attribute used as nickname, default is displayName
+	NicknameAttribute string
+	// EmailAttribute attribute used as email, default is email
+	EmailAttribute string
+}
+
+// samlAssertion validated assertion of response
+type samlAssertion struct {
+	ID           string
+	InResponseTo string
+	// NotOnOrAfter the assertion can not be used after it
+	NotOnOrAfter time.Time
+	NameID       string
+	Attributes   map[string][]string
+}
+
+type samlEntityDescriptor struct {
+	XMLName    xml.Name            `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID   string              `xml:"entityID,attr"`
+	Descriptor samlSPSSODescriptor `xml:"SPSSODescriptor"`
+}
+
+type samlSPSSODescriptor struct {
+	AuthnRequestsSigned        bool         `xml:"AuthnRequestsSigned,attr"`
+	WantAssertionsSigned       bool         `xml:"WantAssertionsSigned,attr"`
+	ProtocolSupportEnumeration string       `xml:"protocolSupportEnumeration,attr"`
+	NameIDFormat               string       `xml:"NameIDFormat"`
+	AssertionConsumerService   samlEndpoint `xml:"AssertionConsumerService"`
+}
+
+type samlEndpoint struct {
+	Binding   string `xml:"Binding,attr"`
+	Location  string `xml:"Location,attr"`
+	Index     int    `xml:"index,attr"`
+	IsDefault bool   `xml:"isDefault,attr"`
+}
+
+// Metadata metadata of service provider to register at identity provider
+func (sp *SAMLServiceProvider) Metadata() ([]byte, error) {
+	if len(sp.EntityID) == 0 || len(sp.ACSURL) == 0 {
+		return nil, ErrParamInvalid
+	}
+	m := samlEntityDescriptor{EntityID: sp.EntityID,
+		Descriptor: samlSPSSODescriptor{WantAssertionsSigned: true,
+			ProtocolSupportEnumeration: samlpNS,
+			NameIDFormat:               sp.nameIDFormat(),
+			AssertionConsumerService: samlEndpoint{
+				Binding: samlHTTPPostBinding, Location: sp.ACSURL,
+				IsDefault: true}}}
+	b, err := xml.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// AuthnRequestURL url to redirect user to login at identity provider,
+// relayState is sent back with SAMLResponse
+func (sp *SAMLServiceProvider) AuthnRequestURL(relayState string) (string, error) {
+	if len(sp.ID) == 0 || len(sp.IdPSSOURL) == 0 {
+		return "", ErrParamInvalid
+	}
+	token, err := randomToken(20)
+	if err != nil {
+		return "", err
+	}
+	// ID must not start with digit or '-'
+	id := "_" + token
+	var req bytes.Buffer
+	req.WriteString(`<samlp:AuthnRequest xmlns:samlp="` + samlpNS +
+		`" xmlns:saml="` + samlNS + `" ID="` + id + `" Version="2.0"`)
+	req.WriteString(` IssueInstant="` + time.Now().UTC().Format(samlTimeFormat) + `"`)
+	req.WriteString(` Destination="` + escapeC14NAttr(sp.IdPSSOURL) + `"`)
+	req.WriteString(` AssertionConsumerServiceURL="` + escapeC14NAttr(sp.ACSURL) + `"`)
+	req.WriteString(` ProtocolBinding="` + samlHTTPPostBinding + `">`)
+	req.WriteString(`<saml:Issuer>` + escapeC14NText(sp.EntityID) + `</saml:Issuer>`)
+	req.WriteString(`<samlp:NameIDPolicy Format="` + escapeC14NAttr(sp.nameIDFormat()) +
+		`" AllowCreate="true"/></samlp:AuthnRequest>`)
+
+	var deflated bytes.Buffer
+	w, err := flate.NewWriter(&deflated, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	w.Write(req.Bytes())
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	// response must be in response to the request
+	err = setTempValue("saml_request@"+id, sp.ID, Config.ConnectorStateExpiresIn)
+	if err != nil {
+		return "", err
+	}
+	return addQuery(sp.IdPSSOURL,
+		"SAMLRequest", base64.StdEncoding.EncodeToString(deflated.Bytes()),
+		"RelayState", relayState), nil
+}
+
+// Login login user by SAMLResponse posted to ACSURL, user is registered
+// at first login. it returns MFAChallenge as UserLogin if user has
+// enabled mfa
+func (sp *SAMLServiceProvider) Login(samlResponse string, scopes ...string) (*LoginResult, error) {
+	if len(sp.ID) == 0 || sp.IdPCertificate == nil {
+		return nil, ErrParamInvalid
+	}
+	scope, err := normalizeScopes(scopes)
+	if err != nil {
+		return nil, err
+	}
+	data, err := decodeXMLBase64(samlResponse)
+	if err != nil {
+		return nil, ErrSAMLInvalid
+	}
+	root, err := parseXML(data)
+	if err != nil {
+		return nil, ErrSAMLInvalid
+	}
+	now := time.Now()
+	a, err := sp.parseResponse(root, now)
+	if err != nil {
+		return nil, err
+	}
+	// assertion can only be used once before it expired
+	expire := int(a.NotOnOrAfter.Sub(now)/time.Second) + samlMaxSkew
+	n, err := incrTempValue("saml_assertion@"+sp.ID+"@"+a.ID, expire)
+	if err != nil {
+		return nil, err
+	}
+	if n > 1 {
+		return nil, ErrSAMLReplay
+	}
+	if takeTempValue("saml_request@"+a.InResponseTo) != sp.ID {
+		return nil, ErrSAMLInvalid
+	}
+	u, err := identityUser(sp.ID, sp.identity(a))
+	if err != nil {
+		return nil, err
+	}
+	return loginUser(u, scope)
+}
+
+// parseResponse validate signature, issuer, subject and conditions of
+// response, the signed assertion is returned
+func (sp *SAMLServiceProvider) parseResponse(root *xmlNode, now time.Time) (*samlAssertion, error) {
+	if !root.is(samlpNS, "Response") || root.attr("Version") != "2.0" {
+		return nil, ErrSAMLInvalid
+	}
+	if d := root.attr("Destination"); len(d) > 0 && d != sp.ACSURL {
+		return nil, ErrSAMLInvalid
+	}
+	if issuer := root.child(samlNS, "Issuer"); issuer != nil &&
+		issuer.text() != sp.IdPEntityID {
+		return nil, ErrSAMLInvalid
+	}
+	status := root.child(samlpNS, "Status")
+	if status == nil {
+		return nil, ErrSAMLInvalid
+	}
+	code := status.child(samlpNS, "StatusCode")
+	if code == nil || code.attr("Value") != samlStatusSuccess {
+		if code != nil {
+			fmt.Println("saml response status:", code.attr("Value"))
+		}
+		return nil, ErrSAMLInvalid
+	}
+	// encrypted assertion is not supported
+	assertions := root.children(samlNS, "Assertion")
+	if len(assertions) != 1 || len(root.children(samlNS, "EncryptedAssertion")) > 0 {
+		return nil, ErrSAMLInvalid
+	}
+	assertion := assertions[0]
+
+	// the response or the assertion must be signed, only elements in
+	// the signed element are used
+	signed := false
+	for _, e := range []*xmlNode{root, assertion} {
+		if e.child(dsigNS, "Signature") == nil {
+			continue
+		}
+		if err := verifyXMLSignature(e, sp.IdPCertificate); err != nil {
+			return nil, ErrSAMLSignatureInvalid
+		}
+		signed = true
+	}
+	if !signed {
+		return nil, ErrSAMLSignatureInvalid
+	}
+
+	ret := &samlAssertion{ID: assertion.attr("ID"),
+		Attributes: map[string][]string{}}
+	if len(ret.ID) == 0 || assertion.attr("Version") != "2.0" {
+		return nil, ErrSAMLInvalid
+	}
+	issuer := assertion.child(samlNS, "Issuer")
+	if issuer == nil || issuer.text() != sp.IdPEntityID {
+		return nil, ErrSAMLInvalid
+	}
+	if err := sp.checkSubject(assertion, ret, now); err != nil {
+		return nil, err
+	}
+	if r := root.attr("InResponseTo"); len(r) > 0 && r != ret.InResponseTo {
+		return nil, ErrSAMLInvalid
+	}
+	if err := sp.checkConditions(assertion, ret, now); err != nil {
+		return nil, err
+	}
+	for _, s := range assertion.children(samlNS, "AttributeStatement") {
+		for _, attr := range s.children(samlNS, "Attribute") {
+			name := attr.attr("Name")
+			for _, v := range attr.children(samlNS, "AttributeValue") {
+				ret.Attributes[name] = append(ret.Attributes[name], v.text())
+			}
+		}
+	}
+	return ret, nil
+}
+
+// checkSubject NameID and bearer confirmation of subject, the
+// confirmation must be for ACSURL and in response to a request
+func (sp *SAMLServiceProvider) checkSubject(assertion *xmlNode, a *samlAssertion, now time.Time) error {
+	subject := assertion.child(samlNS, "Subject")
+	if subject == nil {
+		return ErrSAMLInvalid
+	}
+	nameID := subject.child(samlNS, "NameID")
+	if nameID == nil || len(nameID.text()) == 0 {
+		return ErrSAMLInvalid
+	}
+	if nameID.attr("Format") == samlTransientNameID {
+		fmt.Println("transient NameID can not link user, use other format")
+		return ErrSAMLInvalid
+	}
+	a.NameID = nameID.text()
+	for _, c := range subject.children(samlNS, "SubjectConfirmation") {
+		data := c.child(samlNS, "SubjectConfirmationData")
+		if c.attr("Method") != samlBearer || data == nil ||
+			data.attr("Recipient") != sp.ACSURL ||
+			len(data.attr("InResponseTo")) == 0 {
+			continue
+		}
+		notOnOrAfter, err := parseSAMLTime(data.attr("NotOnOrAfter"))
+		if err != nil || !now.Before(notOnOrAfter.Add(samlMaxSkew*time.Second)) {
+			continue
+		}
+		a.InResponseTo = data.attr("InResponseTo")
+		a.NotOnOrAfter = notOnOrAfter
+		return nil
+	}
+	return ErrSAMLInvalid
+}
+
+// checkConditions validity period and audience of assertion
+func (sp *SAMLServiceProvider) checkConditions(assertion *xmlNode, a *samlAssertion, now time.Time) error {
+	conditions := assertion.child(samlNS, "Conditions")
+	if conditions == nil {
+		return ErrSAMLInvalid
+	}
+	skew := samlMaxSkew * time.Second
+	if s := conditions.attr("NotBefore"); len(s) > 0 {
+		t, err := parseSAMLTime(s)
+		if err != nil || now.Add(skew).Before(t) {
+			return ErrSAMLInvalid
+		}
+	}
+	if s := conditions.attr("NotOnOrAfter"); len(s) > 0 {
+		t, err := parseSAMLTime(s)
+		if err != nil || !now.Before(t.Add(skew)) {
+			return ErrSAMLInvalid
+		}
+		if t.Before(a.NotOnOrAfter) {
+			a.NotOnOrAfter = t
+		}
+	}
+	// every restriction must contain the entity id
+	restrictions := conditions.children(samlNS, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return ErrSAMLInvalid
+	}
+	for _, r := range restrictions {
+		found := false
+		for _, audience := range r.children(samlNS, "Audience") {
+			if audience.text() == sp.EntityID {
+				found = true
+			}
+		}
+		if !found {
+			return ErrSAMLInvalid
+		}
+	}
+	return nil
+}
+
+// identity map NameID and attributes of assertion to identity
+func (sp *SAMLServiceProvider) identity(a *samlAssertion) *ExternalIdentity {
+	ret := &ExternalIdentity{ID: a.NameID, UserName: a.NameID}
+	// external_id is varchar(191)
+	if len(ret.ID) > 191 {
+		ret.ID = hashToken(a.NameID)
+	}
+	if len(sp.UserNameAttribute) > 0 {
+		ret.UserName = firstString(a.Attributes[sp.UserNameAttribute])
+	}
+	ret.Nickname = firstString(a.Attributes[claimName(sp.NicknameAttribute, "displayName")])
+	ret.Email = firstString(a.Attributes[claimName(sp.EmailAttribute, "email")])
+	return ret
+}
+
+func (sp *SAMLServiceProvider) nameIDFormat() string {
+	if len(sp.NameIDFormat) == 0 {
+		return SAMLNameIDUnspecified
+	}
+	return sp.NameIDFormat
+}
+
+// parseSAMLTime parse xs:dateTime, fractional seconds is allowed
+func parseSAMLTime(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func firstString(list []string) string {
+	if len(list) == 0 {
+		return ""
+	}
+	return list[0]
+}
@@ -0,0 +1,288 @@
+package ucenter
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestC14N(t *testing.T) {
+	doc := `<?xml version="1.0"?>
+<a:root xmlns:a="urn:a" xmlns:b="urn:b" xmlns:c="urn:c" z="1" b:y="2"><!-- comment -->` +
+		`<child xmlns="urn:d" attr='x"&lt;&#9;'>t&amp;&gt;&#13;<e/></child><a:e xml:lang="en"/></a:root>`
+	root, err := parseXML([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<a:root xmlns:a="urn:a" xmlns:b="urn:b" z="1" b:y="2">` +
+		`<child xmlns="urn:d" attr="x&quot;&lt;&#x9;">t&amp;&gt;&#xD;<e></e></child>` +
+		`<a:e xml:lang="en"></a:e></a:root>`
+	if s := string(canonicalize(root, nil, nil)); s != expected {
+		t.Error("c14n error:", s)
+	}
+	// namespaces of ancestors are rendered where they are used
+	child := root.child("urn:d", "child")
+	if s := string(canonicalize(child, nil, nil)); s != `<child xmlns="urn:d" attr="x&quot;&lt;&#x9;">t&amp;&gt;&#xD;<e></e></child>` {
+		t.Error("c14n of subtree error:", s)
+	}
+	if s := string(canonicalize(child, []string{"c"}, nil)); !strings.HasPrefix(s, `<child xmlns="urn:d" xmlns:c="urn:c" attr=`) {
+		t.Error("inclusive namespace should be rendered:", s)
+	}
+	if s := string(canonicalize(root, nil, child)); s != `<a:root xmlns:a="urn:a" xmlns:b="urn:b" z="1" b:y="2"><a:e xml:lang="en"></a:e></a:root>` {
+		t.Error("excluded element should be removed:", s)
+	}
+	for _, s := range []string{`<a><b></a></b>`, `<a></a><b></b>`,
+		`<!DOCTYPE a [<!ENTITY x "y">]><a>&x;</a>`, `<a>`, ``} {
+		if _, err = parseXML([]byte(s)); err != ErrXMLInvalid {
+			t.Error("invalid xml should fail:", s, err)
+		}
+	}
+}
+
+// testIdP identity provider signs responses by its key
+type testIdP struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject:   pkix.Name{CommonName: "idp.example.com"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIdP{key: key, cert: cert}
+}
+
+// sign replace <!--sig--> in element of id by its signature
+func (idp *testIdP) sign(t *testing.T, doc string, id string) string {
+	find := func(doc string) *xmlNode {
+		root, err := parseXML([]byte(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ret *xmlNode
+		root.walk(func(n *xmlNode) {
+			if n.attr("ID") == id {
+				ret = n
+			}
+		})
+		return ret
+	}
+	digest := sha256.Sum256(canonicalize(find(doc), nil, nil))
+	sig := `<ds:Signature xmlns:ds="` + dsigNS + `"><ds:SignedInfo>` +
+		`<ds:CanonicalizationMethod Algorithm="` + excC14NAlgorithm + `"/>` +
+		`<ds:SignatureMethod Algorithm="` + rsaSHA256SigAlg + `"/>` +
+		`<ds:Reference URI="#` + id + `"><ds:Transforms>` +
+		`<ds:Transform Algorithm="` + envelopedSigAlg + `"/>` +
+		`<ds:Transform Algorithm="` + excC14NAlgorithm + `"/></ds:Transforms>` +
+		`<ds:DigestMethod Algorithm="` + sha256DigestAlg + `"/>` +
+		`<ds:DigestValue>` + base64.StdEncoding.EncodeToString(digest[:]) +
+		`</ds:DigestValue></ds:Reference></ds:SignedInfo>` +
+		`<ds:SignatureValue>SIGNATURE</ds:SignatureValue></ds:Signature>`
+	doc = strings.Replace(doc, "<!--sig-->", sig, 1)
+	info := find(doc).child(dsigNS, "Signature").child(dsigNS, "SignedInfo")
+	hashed := sha256.Sum256(canonicalize(info, nil, nil))
+	b, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Replace(doc, "SIGNATURE", base64.StdEncoding.EncodeToString(b), 1)
+}
+
+// testSAMLResponse response of assertion for sp, signature of response
+// or assertion is placed at <!--sig-->
+func testSAMLResponse(sp *SAMLServiceProvider, requestID string, audience string,
+	nameID string, expire time.Time, signResponse bool) string {
+	responseSig, assertionSig := "", "<!--sig-->"
+	if signResponse {
+		responseSig, assertionSig = "<!--sig-->", ""
+	}
+	now := time.Now().UTC().Format(samlTimeFormat)
+	notOnOrAfter := expire.UTC().Format(samlTimeFormat)
+	return fmt.Sprintf(`<samlp:Response xmlns:samlp="%s" xmlns:saml="%s" ID="_resp_%s" Version="2.0" IssueInstant="%s" Destination="%s" InResponseTo="%s">`+
+		`<saml:Issuer>%s</saml:Issuer>%s`+
+		`<samlp:Status><samlp:StatusCode Value="%s"/></samlp:Status>`+
+		`<saml:Assertion ID="_assert_%s" Version="2.0" IssueInstant="%s">`+
+		`<saml:Issuer>%s</saml:Issuer>%s`+
+		`<saml:Subject><saml:NameID Format="%s">%s</saml:NameID>`+
+		`<saml:SubjectConfirmation Method="%s"><saml:SubjectConfirmationData InResponseTo="%s" NotOnOrAfter="%s" Recipient="%s"/></saml:SubjectConfirmation></saml:Subject>`+
+		`<saml:Conditions NotBefore="%s" NotOnOrAfter="%s"><saml:AudienceRestriction><saml:Audience>%s</saml:Audience></saml:AudienceRestriction></saml:Conditions>`+
+		`<saml:AttributeStatement>`+
+		`<saml:Attribute Name="displayName"><saml:AttributeValue>SAML User</saml:AttributeValue></saml:Attribute>`+
+		`<saml:Attribute Name="email"><saml:AttributeValue>%s</saml:AttributeValue></saml:Attribute>`+
+		`</saml:AttributeStatement></saml:Assertion></samlp:Response>`,
+		samlpNS, samlNS, requestID, now, sp.ACSURL, requestID,
+		sp.IdPEntityID, responseSig, samlStatusSuccess,
+		requestID, now, sp.IdPEntityID, assertionSig,
+		SAMLNameIDPersistent, nameID,
+		samlBearer, requestID, notOnOrAfter, sp.ACSURL,
+		now, notOnOrAfter, audience, nameID+"@corp.com")
+}
+
+func newTestSAMLServiceProvider(idp *testIdP) *SAMLServiceProvider {
+	return &SAMLServiceProvider{ID: "saml", EntityID: "https://uc.example.com/saml",
+		ACSURL: "https://uc.example.com/saml/acs", IdPEntityID: "https://idp.example.com",
+		IdPSSOURL: "https://idp.example.com/sso", IdPCertificate: idp.cert}
+}
+
+func TestSAMLResponse(t *testing.T) {
+	idp := newTestIdP(t)
+	sp := newTestSAMLServiceProvider(idp)
+	expire := time.Now().Add(5 * time.Minute)
+	parse := func(doc string, now time.Time) (*samlAssertion, error) {
+		root, err := parseXML([]byte(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sp.parseResponse(root, now)
+	}
+
+	doc := idp.sign(t, testSAMLResponse(sp, "1", sp.EntityID, "u1", expire, false), "_assert_1")
+	a, err := parse(doc, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := sp.identity(a)
+	if a.ID != "_assert_1" || a.InResponseTo != "1" || identity.ID != "u1" ||
+		identity.Nickname != "SAML User" || identity.Email != "u1@corp.com" {
+		t.Error("assertion error:", a, identity)
+	}
+	sp.UserNameAttribute = "email"
+	if identity = sp.identity(a); identity.UserName != "u1@corp.com" || identity.ID != "u1" {
+		t.Error("user name attribute error:", identity)
+	}
+	sp.UserNameAttribute = ""
+
+	// signed response
+	doc = idp.sign(t, testSAMLResponse(sp, "2", sp.EntityID, "u2", expire, true), "_resp_2")
+	if a, err = parse(doc, time.Now()); err != nil || a.NameID != "u2" {
+		t.Error("signed response should be accepted:", err)
+	}
+	if _, err = parse(strings.Replace(doc, ">u2<", ">admin<", 1), time.Now()); err != ErrSAMLSignatureInvalid {
+		t.Error("tampered response should fail:", err)
+	}
+	if _, err = parse(testSAMLResponse(sp, "3", sp.EntityID, "u3", expire, false), time.Now()); err != ErrSAMLSignatureInvalid {
+		t.Error("unsigned response should fail:", err)
+	}
+	other := newTestIdP(t)
+	doc = other.sign(t, testSAMLResponse(sp, "4", sp.EntityID, "u4", expire, false), "_assert_4")
+	if _, err = parse(doc, time.Now()); err != ErrSAMLSignatureInvalid {
+		t.Error("response signed by other key should fail:", err)
+	}
+	doc = idp.sign(t, testSAMLResponse(sp, "5", "https://other.example.com", "u5", expire, false), "_assert_5")
+	if _, err = parse(doc, time.Now()); err != ErrSAMLInvalid {
+		t.Error("assertion for other audience should fail:", err)
+	}
+	doc = idp.sign(t, testSAMLResponse(sp, "6", sp.EntityID, "u6", expire, false), "_assert_6")
+	if _, err = parse(doc, expire.Add(2*time.Minute)); err != ErrSAMLInvalid {
+		t.Error("expired assertion should fail:", err)
+	}
+	if _, err = parse(doc, time.Now().Add(-10*time.Minute)); err != ErrSAMLInvalid {
+		t.Error("assertion before NotBefore should fail:", err)
+	}
+	sp.ACSURL = "https://uc.example.com/other"
+	if _, err = parse(doc, time.Now()); err != ErrSAMLInvalid {
+		t.Error("response for other acs should fail:", err)
+	}
+}
+
+func TestSAMLMetadata(t *testing.T) {
+	sp := newTestSAMLServiceProvider(newTestIdP(t))
+	b, err := sp.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := parseXML(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := root.child("urn:oasis:names:tc:SAML:2.0:metadata", "SPSSODescriptor")
+	if root.attr("entityID") != sp.EntityID || d == nil ||
+		d.attr("WantAssertionsSigned") != "true" {
+		t.Fatal("metadata error:", string(b))
+	}
+	acs := d.child("urn:oasis:names:tc:SAML:2.0:metadata", "AssertionConsumerService")
+	if acs == nil || acs.attr("Location") != sp.ACSURL ||
+		acs.attr("Binding") != samlHTTPPostBinding {
+		t.Error("acs error:", string(b))
+	}
+}
+
+func TestSAMLLogin(t *testing.T) {
+	requireMySQL(t)
+	idp := newTestIdP(t)
+	sp := newTestSAMLServiceProvider(idp)
+	nameID, _ := randomToken(8)
+	var names []string
+	for i := 0; i < 2; i++ {
+		uri, err := sp.AuthnRequestURL("relay")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, _ := url.Parse(uri)
+		if u.Query().Get("RelayState") != "relay" {
+			t.Fatal("relay state should be sent:", uri)
+		}
+		deflated, _ := base64.StdEncoding.DecodeString(u.Query().Get("SAMLRequest"))
+		b, _ := io.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+		req, err := parseXML(b)
+		if err != nil || !req.is(samlpNS, "AuthnRequest") ||
+			req.attr("AssertionConsumerServiceURL") != sp.ACSURL {
+			t.Fatal("authn request error:", string(b))
+		}
+		id := req.attr("ID")
+		doc := idp.sign(t, testSAMLResponse(sp, id, sp.EntityID, nameID,
+			time.Now().Add(5*time.Minute), false), "_assert_"+id)
+		response := base64.StdEncoding.EncodeToString([]byte(doc))
+		ret, err := sp.Login(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = sp.Login(response); err != ErrSAMLReplay {
+			t.Fatal("assertion can only be used once:", err)
+		}
+		p, err := Authenticate(ret.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, p.UserName)
+	}
+	if names[0] != names[1] || names[0] != nameID {
+		t.Fatal("identity should login as same user:", names)
+	}
+	info, err := GetUserInfo(names[0])
+	if err != nil || info.Nickname != "SAML User" {
+		t.Fatal("user should be registered:", err, info)
+	}
+	// response not for request of ucenter
+	doc := idp.sign(t, testSAMLResponse(sp, "_unknown", sp.EntityID, nameID,
+		time.Now().Add(5*time.Minute), false), "_assert__unknown")
+	_, err = sp.Login(base64.StdEncoding.EncodeToString([]byte(doc)))
+	if err != ErrSAMLInvalid {
+		t.Fatal("unsolicited response should fail:", err)
+	}
+}
@@ -0,0 +1,143 @@
+package ucenter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// normalizeScopes check requested scopes and join them by space,
+// every scope must in Config.Scopes if it is set
+func normalizeScopes(scopes []string) (string, error) {
+	var ret []string
+	for i := 0; i < len(scopes); i++ {
+		s := scopes[i]
+		if !validScope(s) || !scopeAllowed(s) {
+			return "", ErrScopeInvalid
+		}
+		if !containsString(ret, s) {
+			ret = append(ret, s)
+		}
+	}
+	return strings.Join(ret, " "), nil
+}
+
+// validScope characters of scope defined by RFC 6749
+func validScope(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x21 || c == 0x22 || c == 0x5c || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func scopeAllowed(s string) bool {
+	if len(Config.Scopes) == 0 || s == ScopeOpenID || s == ScopeProfile ||
+		s == ScopeEmail {
+		return true
+	}
+	return containsString(Config.Scopes, s)
+}
+
+// parseScope split scope string to scopes, nil if it is empty
+func parseScope(scope string) []string {
+	return strings.Fields(scope)
+}
+
+// hasScopes granted scope contains all required scopes
+func hasScopes(granted string, required []string) bool {
+	scopes := parseScope(granted)
+	for i := 0; i < len(required); i++ {
+		if !containsString(scopes, required[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// joinScopeValue save scope with other value in one string,
+// scope has no newline so it is put first
+func joinScopeValue(scope string, value string) string {
+	return scope + "\n" + value
+}
+
+// splitScopeValue get scope and value joined by joinScopeValue
+func splitScopeValue(s string) (string, string) {
+	i := strings.Index(s, "\n")
+	if i < 0 {
+		return "", s
+	}
+	return s[:i], s[i+1:]
+}
+
+func containsString(list []string, s string) bool {
+	for i := 0; i < len(list); i++ {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckAccessTokenScopes check access token as Authenticate and the
+// token must have all required scopes, otherwise ErrScopeInsufficient
+func CheckAccessTokenScopes(token string, required ...string) (*Principal, error) {
+	p, err := Authenticate(token)
+	if err != nil {
+		return nil, err
+	}
+	if !p.HasScopes(required...) {
+		return p, ErrScopeInsufficient
+	}
+	return p, nil
+}
+
+// HasScopes the access token of principal has all the scopes
+func (p *Principal) HasScopes(scopes ...string) bool {
+	return hasScopes(strings.Join(p.Scopes, " "), scopes)
+}
+
+// setTokenScopes save scopes granted to refresh token, current access
+// token and pre access token of user issued to client. expire is
+// lifetime of refresh token
+func setTokenScopes(name string, client string, scope string,
+	accessScope string, preScope string, expire int) error {
+	if redisPool == nil {
+		tenant, user := splitAccountKey(name)
+		sql := "update " + Config.TokenTablename +
+			" set scope = ?, access_scope = ?, pre_access_scope = ?" +
+			tokenWhere
+		_, err := db.Exec(sql, scope, accessScope, preScope, tenant, user,
+			client)
+		if err != nil {
+			fmt.Println(err)
+			return ErrSetAccessToken
+		}
+		return nil
+	}
+	tc := tokenConfig(name, client)
+	key := grantKey(name, client)
+	c := redisPool.Get()
+	defer c.Close()
+	args := []interface{}{"scope@" + key, scope}
+	if expire > 0 {
+		args = append(args, "EX", strconv.Itoa(expire))
+	}
+	c.Send("MULTI")
+	c.Send("SET", args...)
+	c.Send("SET", "access_scope@"+key, accessScope,
+		"EX", strconv.Itoa(tc.TokenExpiresIn))
+	c.Send("SET", "pre_access_scope@"+key, preScope,
+		"EX", strconv.Itoa(tc.PreTokenExpireIn))
+	_, err := c.Do("EXEC")
+	if err != nil {
+		fmt.Println(err)
+		return ErrSetAccessToken
+	}
+	return nil
+}
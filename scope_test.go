@@ -0,0 +1,44 @@
+package ucenter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeScopes(t *testing.T) {
+	old := Config.Scopes
+	defer func() { Config.Scopes = old }()
+	Config.Scopes = []string{"read", "write"}
+	scope, err := normalizeScopes([]string{"read", "write", "read"})
+	if err != nil || scope != "read write" {
+		t.Error("scope should be normalized:", scope, err)
+	}
+	if _, err = normalizeScopes([]string{"admin"}); err != ErrScopeInvalid {
+		t.Error("scope not allowed should be invalid:", err)
+	}
+	if _, err = normalizeScopes([]string{"read write"}); err != ErrScopeInvalid {
+		t.Error("scope with space should be invalid:", err)
+	}
+	if !hasScopes(scope, []string{"write"}) || hasScopes("read", []string{"write"}) {
+		t.Error("hasScopes is wrong")
+	}
+	s, v := splitScopeValue(joinScopeValue(scope, "sails"))
+	if s != scope || v != "sails" {
+		t.Error("split scope value failed:", s, v)
+	}
+}
+
+func TestAuthMiddlewareNoToken(t *testing.T) {
+	called := false
+	h := AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}), WithScopes("read"))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Basic abc")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if called || w.Code != http.StatusUnauthorized {
+		t.Error("request without bearer token should be rejected", w.Code)
+	}
+}
@@ -0,0 +1,55 @@
+package ucenter
+
+import (
+	"sync"
+)
+
+// Sender deliver message to user, to is email address or mobile
+// number, implement it by your email or sms service
+type Sender interface {
+	Send(to string, subject string, content string) error
+}
+
+// SentMessage message kept by MemorySender
+type SentMessage struct {
+	To      string
+	Subject string
+	Content string
+}
+
+// MemorySender keep messages in memory instead of delivering them,
+// used for develop and test
+type MemorySender struct {
+	sync.Mutex
+	messages []SentMessage
+}
+
+// Send save the message
+func (s *MemorySender) Send(to string, subject string, content string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.messages = append(s.messages, SentMessage{to, subject, content})
+	return nil
+}
+
+// Messages all messages sent to the address
+func (s *MemorySender) Messages(to string) []SentMessage {
+	s.Lock()
+	defer s.Unlock()
+	var messages []SentMessage
+	for i := 0; i < len(s.messages); i++ {
+		if s.messages[i].To == to {
+			messages = append(messages, s.messages[i])
+		}
+	}
+	return messages
+}
+
+// Last the last message sent to the address, nil if no message
+func (s *MemorySender) Last(to string) *SentMessage {
+	messages := s.Messages(to)
+	if len(messages) == 0 {
+		return nil
+	}
+	return &messages[len(messages)-1]
+}
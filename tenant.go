@@ -0,0 +1,222 @@
+package ucenter
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Tenant isolated namespace of users, the same user name can be used
+// in different tenants. functions without tenant use the default
+// tenant "", e.g. UserLogin(name, pwd) is Tenant("").UserLogin(name, pwd)
+type Tenant string
+
+// TenantConfig settings of a tenant override Config, 0 or nil means
+// the value of Config is used
+type TenantConfig struct {
+	TokenExpiresIn        int
+	PreTokenExpireIn      int
+	SessionExpiresIn      int
+	RefreshTokenExpiresIn int
+	SessionMaxLifetime    int
+	PasswordPolicy        *PasswordPolicy
+}
+
+// PasswordPolicy requirements of password when register,
+// zero value has no requirement
+type PasswordPolicy struct {
+	MinLength     int
+	RequireLetter bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+// tenantKeyPrefix user names of default tenant can not start with it,
+// so key of default tenant is the user name as old version
+const tenantKeyPrefix = "tenant@"
+
+// accountKey identify user in all tenants, it is used as key of
+// tokens in database, redis and caches. "" if name is invalid
+func accountKey(tenant string, name string) string {
+	if strings.HasPrefix(name, tenantKeyPrefix) {
+		return ""
+	}
+	if len(tenant) == 0 {
+		return name
+	}
+	return tenantKeyPrefix + tenant + ":" + name
+}
+
+// splitAccountKey get tenant and user name from account key
+func splitAccountKey(key string) (string, string) {
+	if !strings.HasPrefix(key, tenantKeyPrefix) {
+		return "", key
+	}
+	s := key[len(tenantKeyPrefix):]
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return "", key
+	}
+	return s[:i], s[i+1:]
+}
+
+// validTenant tenant id is letters, digits, "-" and "_"
+func validTenant(id string) bool {
+	if len(id) == 0 || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c > unicode.MaxASCII || !(unicode.IsLetter(c) ||
+			unicode.IsDigit(c) || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// tenantConfig settings of the tenant of account key,
+// values not overridden are copied from Config
+func tenantConfig(key string) TenantConfig {
+	tenant, _ := splitAccountKey(key)
+	c := TenantConfig{
+		TokenExpiresIn:        Config.TokenExpiresIn,
+		PreTokenExpireIn:      Config.PreTokenExpireIn,
+		SessionExpiresIn:      Config.SessionExpiresIn,
+		RefreshTokenExpiresIn: Config.RefreshTokenExpiresIn,
+		SessionMaxLifetime:    Config.SessionMaxLifetime,
+		PasswordPolicy:        &Config.PasswordPolicy,
+	}
+	o, ok := Config.Tenants[tenant]
+	if len(tenant) == 0 || !ok {
+		return c
+	}
+	if o.TokenExpiresIn > 0 {
+		c.TokenExpiresIn = o.TokenExpiresIn
+	}
+	if o.PreTokenExpireIn > 0 {
+		c.PreTokenExpireIn = o.PreTokenExpireIn
+	}
+	if o.SessionExpiresIn > 0 {
+		c.SessionExpiresIn = o.SessionExpiresIn
+	}
+	if o.RefreshTokenExpiresIn > 0 {
+		c.RefreshTokenExpiresIn = o.RefreshTokenExpiresIn
+	}
+	if o.SessionMaxLifetime > 0 {
+		c.SessionMaxLifetime = o.SessionMaxLifetime
+	}
+	if o.PasswordPolicy != nil {
+		c.PasswordPolicy = o.PasswordPolicy
+	}
+	return c
+}
+
+// maxTokenExpiresIn the longest lifetime of access token in all tenants
+func maxTokenExpiresIn() int {
+	n := Config.TokenExpiresIn
+	for _, c := range Config.Tenants {
+		if c.TokenExpiresIn > n {
+			n = c.TokenExpiresIn
+		}
+	}
+	return n
+}
+
+// maxRefreshTokenExpiresIn the longest lifetime of refresh token in
+// all tenants, 0 if refresh token of any tenant never expire
+func maxRefreshTokenExpiresIn() int {
+	n := Config.RefreshTokenExpiresIn
+	if n == 0 {
+		return 0
+	}
+	for _, c := range Config.Tenants {
+		if c.RefreshTokenExpiresIn > n {
+			n = c.RefreshTokenExpiresIn
+		}
+	}
+	return n
+}
+
+// check password satisfies the policy
+func (p *PasswordPolicy) check(password string) error {
+	if p == nil {
+		return nil
+	}
+	if len(password) < p.MinLength {
+		return ErrPasswordWeak
+	}
+	var letter, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLetter(c):
+			letter = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if (p.RequireLetter && !letter) || (p.RequireDigit && !digit) ||
+		(p.RequireSymbol && !symbol) {
+		return ErrPasswordWeak
+	}
+	return nil
+}
+
+// key of tenant for user name, "" if tenant or name is invalid
+func (t Tenant) key(name string) string {
+	if len(t) > 0 && !validTenant(string(t)) {
+		return ""
+	}
+	return accountKey(string(t), name)
+}
+
+// UserRegister register user in the tenant
+func (t Tenant) UserRegister(user UserInfo) error {
+	if len(t) > 0 && !validTenant(string(t)) {
+		return ErrTenantInvalid
+	}
+	user.Tenant = string(t)
+	return userRegister(user)
+}
+
+// UserLogin login user of the tenant
+func (t Tenant) UserLogin(name string, password string, scopes ...string) (*LoginResult, error) {
+	return userLogin(t.key(name), password, scopes)
+}
+
+// CheckAccessToken check access token of user in the tenant
+func (t Tenant) CheckAccessToken(name string, accessToken string) error {
+	return checkAccessToken(t.key(name), accessToken)
+}
+
+// ResetAccessToken refresh access token of user in the tenant
+func (t Tenant) ResetAccessToken(name string, refreshToken string, scopes ...string) (*LoginResult, error) {
+	return resetAccessToken(t.key(name), "", refreshToken, scopes)
+}
+
+// CheckSession check session of user in the tenant
+func (t Tenant) CheckSession(name string, session string) bool {
+	return checkSession(t.key(name), session)
+}
+
+// GetUserInfo get user of the tenant
+func (t Tenant) GetUserInfo(name string) (*UserInfo, error) {
+	return getUserInfo(t.key(name))
+}
+
+// KillOffLine logout user of the tenant
+func (t Tenant) KillOffLine(name string) error {
+	return killOffLine(t.key(name))
+}
+
+// Authenticate check access token and it must belong to the tenant
+func (t Tenant) Authenticate(token string) (*Principal, error) {
+	p, err := Authenticate(token)
+	if err != nil {
+		return nil, err
+	}
+	if p.Tenant != string(t) {
+		return nil, ErrAccessTokenInvalid
+	}
+	return p, nil
+}
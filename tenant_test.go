@@ -0,0 +1,111 @@
+package ucenter
+
+import (
+	"testing"
+)
+
+func TestAccountKey(t *testing.T) {
+	if key := accountKey("", "sails"); key != "sails" {
+		t.Error("key of default tenant should be user name:", key)
+	}
+	if key := accountKey("", "tenant@a:sails"); key != "" {
+		t.Error("user name should not start with tenant prefix:", key)
+	}
+	key := accountKey("acme", "sails:x")
+	tenant, name := splitAccountKey(key)
+	if tenant != "acme" || name != "sails:x" {
+		t.Error("split account key error:", tenant, name)
+	}
+	if Tenant("a:b").key("sails") != "" || validTenant("") {
+		t.Error("tenant should be invalid")
+	}
+}
+
+func TestGrantKey(t *testing.T) {
+	if key := grantKey("sails", ""); key != "sails" {
+		t.Error("grant key of ucenter should be account key:", key)
+	}
+	name := accountKey("client", "a:b")
+	key := grantKey(name, "c1")
+	if key == name || accountKey("", key) != "" {
+		t.Error("grant key should not be account key:", key)
+	}
+	if n, c := splitGrantKey(key); n != name || c != "c1" {
+		t.Error("split grant key error:", n, c)
+	}
+	if n, c := splitGrantKey(name); n != name || c != "" {
+		t.Error("account key should have no client:", n, c)
+	}
+}
+
+func TestTenantConfig(t *testing.T) {
+	old := Config
+	defer func() { Config = old }()
+	policy := &PasswordPolicy{MinLength: 8, RequireLetter: true,
+		RequireDigit: true}
+	Config.Tenants = map[string]TenantConfig{
+		"acme": {TokenExpiresIn: 60, PasswordPolicy: policy}}
+	c := tenantConfig(accountKey("acme", "sails"))
+	if c.TokenExpiresIn != 60 ||
+		c.SessionExpiresIn != Config.SessionExpiresIn {
+		t.Error("tenant config should override Config:", c)
+	}
+	if tenantConfig("sails").TokenExpiresIn != Config.TokenExpiresIn {
+		t.Error("default tenant should use Config")
+	}
+	if policy.check("abc12345") != nil {
+		t.Error("password should satisfy policy")
+	}
+	if policy.check("abcdefgh") != ErrPasswordWeak ||
+		policy.check("abc123") != ErrPasswordWeak {
+		t.Error("password should be weak")
+	}
+}
+
+func TestTenantUsers(t *testing.T) {
+	requireMySQL(t)
+	a, b := Tenant("tenant_a"), Tenant("tenant_b")
+	for _, tenant := range []Tenant{a, b} {
+		err := tenant.UserRegister(UserInfo{UserName: "sails",
+			Password: "pwd_" + string(tenant)})
+		if err != nil && err != ErrUserExist {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.UserLogin("sails", "pwd_tenant_b"); err != ErrPwdInvalid {
+		t.Fatal("password of other tenant should be invalid:", err)
+	}
+	retA, err := a.UserLogin("sails", "pwd_tenant_a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	retB, err := b.UserLogin("sails", "pwd_tenant_b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.CheckAccessToken("sails", retB.AccessToken); err == nil {
+		t.Fatal("token of other tenant should be invalid")
+	}
+	if err = a.CheckAccessToken("sails", retA.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+	p, err := Authenticate(retB.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Tenant != "tenant_b" || p.UserName != "sails" {
+		t.Fatal("principal should be user of tenant_b:", p.Tenant)
+	}
+	if _, err = a.Authenticate(retB.AccessToken); err == nil {
+		t.Fatal("token of other tenant should not be authenticated")
+	}
+	if _, err = a.ResetAccessToken("sails", retA.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.KillOffLine("sails"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.CheckAccessToken("sails", retB.AccessToken); err == nil {
+		t.Fatal("token should be invalid after kill off line")
+	}
+}
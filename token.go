@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -32,7 +33,7 @@ func GetUID(node int) uint64 {
 	return uint64(value)
 }
 
-// GetNewToken 产生新的token
+// GetNewToken 产生新的token, 它可以被猜到, 不要用作凭证
 func GetNewToken() string {
 	UID := GetUID(Config.NodeIdentfy)
 	token := md5.Sum([]byte(strconv.FormatInt(int64(UID), 10)))
@@ -42,12 +43,22 @@ func GetNewToken() string {
 
 // TokenInfo token信息
 type TokenInfo struct {
+	Tenant              string
 	UserName            string
 	RefreshToken        string
 	RefreshTokenCreated string
 	AccessToken         string
 	AccessTokenCreated  string
 	PreAccessToken      string
+	RefreshFamily       string
+	// SessionCreated unix time of login which start the refresh family
+	SessionCreated int64
+	// Scope granted to refresh token, scopes are split by space
+	Scope          string
+	AccessScope    string
+	PreAccessScope string
+	// ClientID oauth client the tokens issued to
+	ClientID string
 }
 
 // TokenType type of token
@@ -59,15 +70,56 @@ const (
 	preAccessToken TokenType = "pre_access_token"
 )
 
-// SetRefreshToken set refresh token for database or redis
+// tokenWhere condition to find tokens of user issued to client, args
+// are the result of splitAccountKey and the client id
+const tokenWhere = " where tenant_id = ? and user_name = ? and client_id = ?"
+
+// clientKeyPrefix prefix of grant key of oauth client, tenant id has
+// no "@", so it is never an account key
+const clientKeyPrefix = tenantKeyPrefix + "@"
+
+// grantKey key of tokens of user issued to client in redis and caches,
+// every client has its own tokens. it is the account key if client is
+// empty, that is ucenter itself
+func grantKey(name string, client string) string {
+	if len(client) == 0 {
+		return name
+	}
+	return clientKeyPrefix + client + ":" + name
+}
+
+// splitGrantKey get account key and client from grant key,
+// client id has no ":"
+func splitGrantKey(key string) (string, string) {
+	if !strings.HasPrefix(key, clientKeyPrefix) {
+		return key, ""
+	}
+	s := key[len(clientKeyPrefix):]
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return key, ""
+	}
+	return s[i+1:], s[:i]
+}
+
+// SetRefreshToken set refresh token for database or redis,
+// name is the account key of user
 func SetRefreshToken(name string, token string) error {
+	return setRefreshToken(name, "", token,
+		tenantConfig(name).RefreshTokenExpiresIn)
+}
+
+// setRefreshToken set refresh token of user issued to client which
+// expired in expire seconds in redis, 0 means never expire
+func setRefreshToken(name string, client string, token string, expire int) error {
 	if redisPool == nil {
-		u, err := GetTokenInfo(name)
+		tenant, user := splitAccountKey(name)
+		u, err := getTokenInfo(name, client)
 		if u == nil {
 			sql := "insert into " + Config.TokenTablename +
-				"(user_name, refresh_token, rtoken_created)" +
-				" values(?,?, now())"
-			_, err := db.Exec(sql, name, token)
+				"(tenant_id, user_name, client_id, refresh_token," +
+				" rtoken_created) values(?, ?, ?, ?, now())"
+			_, err := db.Exec(sql, tenant, user, client, token)
 			if err != nil {
 				fmt.Println(err)
 				return ErrSetRefreshToken
@@ -76,8 +128,8 @@ func SetRefreshToken(name string, token string) error {
 		}
 		sql := "update " + Config.TokenTablename +
 			" set refresh_token= ?, " +
-			" rtoken_created = now() where user_name=?"
-		_, err = db.Exec(sql, token, name)
+			" rtoken_created = now()" + tokenWhere
+		_, err = db.Exec(sql, token, tenant, user, client)
 		if err != nil {
 			fmt.Println(err)
 			return ErrSetRefreshToken
@@ -85,26 +137,42 @@ func SetRefreshToken(name string, token string) error {
 		return nil
 
 	}
-	// set redis cache, refresh_token 不设置过期时间
+	// set redis cache, refresh_token 过期时间为 RefreshTokenExpiresIn
 	c := redisPool.Get()
 	defer c.Close()
-	_, err := c.Do("SET", "refresh_token@"+name, token)
+	key := grantKey(name, client)
+	args := []interface{}{"refresh_token@" + key, token}
+	if expire > 0 {
+		args = append(args, "EX", strconv.Itoa(expire))
+	}
+	_, err := c.Do("SET", args...)
 	if err != nil {
 		fmt.Println(err)
 		return ErrSetRefreshToken
 	}
+	err = setTokenOwner(c, token, key, expire)
+	if err != nil {
+		return ErrSetRefreshToken
+	}
 	return nil
 }
 
 // SetAccessToken set refresh_token for database or redis
 func SetAccessToken(name string, token string) error {
+	return setAccessToken(name, "", token, tenantConfig(name).TokenExpiresIn)
+}
+
+// setAccessToken set access token of user issued to client which
+// expired in expire seconds in redis
+func setAccessToken(name string, client string, token string, expire int) error {
 	if redisPool == nil {
-		u, err := GetTokenInfo(name)
+		tenant, user := splitAccountKey(name)
+		u, err := getTokenInfo(name, client)
 		if u == nil {
 			sql := "insert into " + Config.TokenTablename +
-				"(user_name, access_token, atoken_created)" +
-				" values(?,?, now())"
-			_, err := db.Exec(sql, name, token)
+				"(tenant_id, user_name, client_id, access_token," +
+				" atoken_created) values(?, ?, ?, ?, now())"
+			_, err := db.Exec(sql, tenant, user, client, token)
 			if err != nil {
 				fmt.Println(err)
 				return ErrSetAccessToken
@@ -113,8 +181,8 @@ func SetAccessToken(name string, token string) error {
 		}
 		sql := "update " + Config.TokenTablename +
 			" set access_token= ?, " +
-			" atoken_created = now() where user_name=?"
-		_, err = db.Exec(sql, token, name)
+			" atoken_created = now()" + tokenWhere
+		_, err = db.Exec(sql, token, tenant, user, client)
 		if err != nil {
 			fmt.Println(err)
 			return ErrSetAccessToken
@@ -125,24 +193,35 @@ func SetAccessToken(name string, token string) error {
 	// set redis cache, access_token
 	c := redisPool.Get()
 	defer c.Close()
-	_, err := c.Do("SET", "access_token@"+name, token,
-		"EX", strconv.Itoa(Config.TokenExpiresIn))
+	key := grantKey(name, client)
+	_, err := c.Do("SET", "access_token@"+key, token,
+		"EX", strconv.Itoa(expire))
 	if err != nil {
 		fmt.Println(err)
 		return ErrSetAccessToken
 	}
+	err = setTokenOwner(c, token, key, expire)
+	if err != nil {
+		return ErrSetAccessToken
+	}
 	return nil
 }
 
 // SetPreAccessToken set refresh_token for database or redis
 func SetPreAccessToken(name string, token string) error {
+	return setPreAccessToken(name, "", token)
+}
+
+// setPreAccessToken set pre access token of user issued to client
+func setPreAccessToken(name string, client string, token string) error {
 	if redisPool == nil {
-		u, err := GetTokenInfo(name)
+		tenant, user := splitAccountKey(name)
+		u, err := getTokenInfo(name, client)
 		if u == nil {
 			sql := "insert into " + Config.TokenTablename +
-				"(user_name, pre_access_token)" +
-				" values(?,?)"
-			_, err := db.Exec(sql, name, token)
+				"(tenant_id, user_name, client_id, pre_access_token)" +
+				" values(?, ?, ?, ?)"
+			_, err := db.Exec(sql, tenant, user, client, token)
 			if err != nil {
 				fmt.Println(err)
 				return ErrSetPreAccessToken
@@ -150,9 +229,8 @@ func SetPreAccessToken(name string, token string) error {
 			return nil
 		}
 		sql := "update " + Config.TokenTablename +
-			" set pre_access_token= ? " +
-			"where user_name=?"
-		_, err = db.Exec(sql, token, name)
+			" set pre_access_token= ?" + tokenWhere
+		_, err = db.Exec(sql, token, tenant, user, client)
 		if err != nil {
 			fmt.Println(err)
 			return ErrSetPreAccessToken
@@ -163,8 +241,8 @@ func SetPreAccessToken(name string, token string) error {
 	// set redis cache, pre_access_token
 	c := redisPool.Get()
 	defer c.Close()
-	_, err := c.Do("SET", "pre_access_token@"+name, token,
-		"EX", strconv.Itoa(Config.PreTokenExpireIn))
+	_, err := c.Do("SET", "pre_access_token@"+grantKey(name, client), token,
+		"EX", strconv.Itoa(tenantConfig(name).PreTokenExpireIn))
 	if err != nil {
 		fmt.Println(err)
 		return ErrSetPreAccessToken
@@ -172,23 +250,35 @@ func SetPreAccessToken(name string, token string) error {
 	return nil
 }
 
-// GetTokenInfo get token from database or redis
+// GetTokenInfo get token from database or redis,
+// name is the account key of user. tokens issued to oauth clients
+// are not included
 func GetTokenInfo(name string) (*TokenInfo, error) {
+	return getTokenInfo(name, "")
+}
+
+// getTokenInfo get tokens of user issued to client
+func getTokenInfo(name string, client string) (*TokenInfo, error) {
 	if redisPool == nil {
-		sql := "select user_name,refresh_token,rtoken_created," +
-			"access_token,atoken_created,pre_access_token from " +
-			Config.TokenTablename + " where user_name=?"
-		rows, err := db.Query(sql, name)
+		tenant, user := splitAccountKey(name)
+		sql := "select tenant_id,user_name,refresh_token,rtoken_created," +
+			"access_token,atoken_created,pre_access_token," +
+			"refresh_family,family_created,scope,access_scope," +
+			"pre_access_scope,client_id from " + Config.TokenTablename +
+			tokenWhere
+		rows, err := db.Query(sql, tenant, user, client)
 		if err != nil {
 			return nil, err
 		}
 		defer rows.Close()
 		for rows.Next() {
 			var t TokenInfo
-			if err = rows.Scan(&t.UserName, &t.RefreshToken,
+			if err = rows.Scan(&t.Tenant, &t.UserName, &t.RefreshToken,
 				&t.RefreshTokenCreated, &t.AccessToken,
 				&t.AccessTokenCreated,
-				&t.PreAccessToken); err == nil {
+				&t.PreAccessToken, &t.RefreshFamily,
+				&t.SessionCreated, &t.Scope, &t.AccessScope,
+				&t.PreAccessScope, &t.ClientID); err == nil {
 				return &t, nil
 			}
 		}
@@ -196,28 +286,187 @@ func GetTokenInfo(name string) (*TokenInfo, error) {
 	}
 	c := redisPool.Get()
 	defer c.Close()
-	refreshToken, err := redis.String(c.Do("GET",
-		"refresh_token@"+name))
+	key := grantKey(name, client)
+	// every token has its own expire time, expired token is empty
+	refreshToken, err := redisGetString(c, "refresh_token@"+key)
 	if err != nil {
-		fmt.Println("redis get failed:", err)
-		return nil, ErrGetRedis
+		return nil, err
 	}
-	accessToken, err := redis.String(c.Do("GET",
-		"access_token@"+name))
+	accessToken, err := redisGetString(c, "access_token@"+key)
 	if err != nil {
-		fmt.Println("redis get failed:", err)
-		return nil, ErrGetRedis
+		return nil, err
 	}
-	pretoken, err := redis.String(c.Do("GET",
-		"pre_access_token@"+name))
+	if len(refreshToken) == 0 && len(accessToken) == 0 {
+		return nil, ErrTokenNotExist
+	}
+	pretoken, err := redisGetString(c, "pre_access_token@"+key)
 	if err != nil {
-		fmt.Println("redis get failed:", err)
-		return nil, ErrGetRedis
+		return nil, err
+	}
+	family, err := redisGetString(c, "refresh_family@"+key)
+	if err != nil {
+		return nil, err
 	}
 	var t TokenInfo
-	t.UserName = name
+	if t.Scope, err = redisGetString(c, "scope@"+key); err != nil {
+		return nil, err
+	}
+	t.AccessScope, err = redisGetString(c, "access_scope@"+key)
+	if err != nil {
+		return nil, err
+	}
+	t.PreAccessScope, err = redisGetString(c, "pre_access_scope@"+key)
+	if err != nil {
+		return nil, err
+	}
+	t.Tenant, t.UserName = splitAccountKey(name)
+	t.ClientID = client
 	t.AccessToken = accessToken
 	t.RefreshToken = refreshToken
 	t.PreAccessToken = pretoken
+	if parts := strings.SplitN(family, " ", 2); len(parts) == 2 {
+		t.RefreshFamily = parts[0]
+		t.SessionCreated, _ = strconv.ParseInt(parts[1], 10, 64)
+	}
 	return &t, nil
 }
+
+// getTokenClients clients user has tokens issued to, ucenter itself
+// is not included
+func getTokenClients(name string) ([]string, error) {
+	if redisPool == nil {
+		tenant, user := splitAccountKey(name)
+		return queryStrings("select client_id from "+Config.TokenTablename+
+			" where tenant_id = ? and user_name = ? and client_id <> ''",
+			tenant, user)
+	}
+	c := redisPool.Get()
+	defer c.Close()
+	clients, err := redis.Strings(c.Do("SMEMBERS", "token_clients@"+name))
+	if err != nil {
+		fmt.Println(err)
+		return nil, ErrGetRedis
+	}
+	return clients, nil
+}
+
+// addTokenClient remember client user has tokens issued to in redis,
+// so they can be revoked by KillOffLine
+func addTokenClient(name string, client string) error {
+	if redisPool == nil || len(client) == 0 {
+		return nil
+	}
+	c := redisPool.Get()
+	defer c.Close()
+	if _, err := c.Do("SADD", "token_clients@"+name, client); err != nil {
+		fmt.Println(err)
+		return ErrSetRedis
+	}
+	return nil
+}
+
+// setTokenOwner save grant key of token in redis, so the user and
+// client can be found by token. the key is not deleted with token,
+// user of it should check the token by getTokenInfo
+func setTokenOwner(c redis.Conn, token string, key string, expire int) error {
+	if len(token) == 0 {
+		return nil
+	}
+	args := []interface{}{"token_owner@" + hashToken(token), key}
+	if expire > 0 {
+		args = append(args, "EX", strconv.Itoa(expire))
+	}
+	_, err := c.Do("SET", args...)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// findTokenOwner find user of token and which type it is,
+// stored is the value saved in database or redis, hash of jti of jwt.
+// it returns nil if token not exist
+func findTokenOwner(stored string) (*TokenInfo, TokenType, error) {
+	if len(stored) == 0 {
+		return nil, "", nil
+	}
+	var name, client string
+	if redisPool == nil {
+		sql := "select tenant_id, user_name, client_id from " +
+			Config.TokenTablename +
+			" where refresh_token = ? or access_token = ?" +
+			" or pre_access_token = ? limit 1"
+		rows, err := db.Query(sql, stored, stored, stored)
+		if err != nil {
+			fmt.Println(err)
+			return nil, "", err
+		}
+		for rows.Next() {
+			var tenant, user string
+			if err = rows.Scan(&tenant, &user, &client); err != nil {
+				fmt.Println(err)
+			}
+			name = accountKey(tenant, user)
+		}
+		rows.Close()
+	} else {
+		c := redisPool.Get()
+		key, err := redisGetString(c, "token_owner@"+hashToken(stored))
+		c.Close()
+		if err != nil {
+			return nil, "", err
+		}
+		name, client = splitGrantKey(key)
+	}
+	if len(name) == 0 {
+		return nil, "", nil
+	}
+	t, err := getTokenInfo(name, client)
+	if err == ErrTokenNotExist {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	switch stored {
+	case t.AccessToken:
+		return t, accessToken, nil
+	case t.PreAccessToken:
+		return t, preAccessToken, nil
+	case t.RefreshToken:
+		return t, refreshToken, nil
+	}
+	return nil, "", nil
+}
+
+// key account key of the token owner
+func (t *TokenInfo) key() string {
+	return accountKey(t.Tenant, t.UserName)
+}
+
+// grantKey key of the tokens in redis and caches
+func (t *TokenInfo) grantKey() string {
+	return grantKey(t.key(), t.ClientID)
+}
+
+// parseDBTime parse datetime column of mysql
+func parseDBTime(s string) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", s, time.Local)
+	if err != nil {
+		return t, ErrTimeParse
+	}
+	return t, nil
+}
+
+// redisGetString get string value, "" if key not exist
+func redisGetString(c redis.Conn, key string) (string, error) {
+	s, err := redis.String(c.Do("GET", key))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	if err != nil {
+		fmt.Println("redis get failed:", err)
+		return "", ErrGetRedis
+	}
+	return s, nil
+}
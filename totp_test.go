@@ -0,0 +1,85 @@
+package ucenter
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// test vectors of RFC 6238 with SHA1, last 6 digits
+	key := []byte("12345678901234567890")
+	cases := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for ts, code := range cases {
+		if c := totpCode(key, ts/totpPeriod); c != code {
+			t.Fatalf("time %d: want %s, got %s", ts, code, c)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	now := time.Now()
+	step := totpStep(now)
+	if s, ok := matchTOTP(secret, totpCode(key, step-1), now); !ok ||
+		s != step-1 {
+		t.Fatal("code of previous step should match")
+	}
+	if _, ok := matchTOTP(secret, totpCode(key, step+3), now); ok {
+		t.Fatal("code out of window should not match")
+	}
+	uri := totpURI("ucenter", "sails", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/ucenter:sails?") ||
+		!strings.Contains(uri, "secret="+secret) {
+		t.Fatal("totp uri error: " + uri)
+	}
+}
+
+func TestEncryptSecret(t *testing.T) {
+	Config.SecretKey = "test secret key"
+	defer func() { Config.SecretKey = "" }()
+	s, err := encryptSecret([]byte("JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := decryptSecret(s)
+	if err != nil || string(plain) != "JBSWY3DPEHPK3PXP" {
+		t.Fatal("decrypt secret error")
+	}
+	Config.SecretKey = "another key"
+	if _, err = decryptSecret(s); err != ErrDecryptSecret {
+		t.Fatal("decrypt by wrong key should fail")
+	}
+}
+
+func TestRecoveryCode(t *testing.T) {
+	Config.SecretKey = "test secret key"
+	defer func() { Config.SecretKey = "" }()
+	code, err := newRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != recoveryCodeLength+1 || !isRecoveryCode(code) {
+		t.Fatal("recovery code format error: " + code)
+	}
+	if isRecoveryCode("123456") {
+		t.Fatal("totp code should not be recovery code")
+	}
+	h1, _ := hashRecoveryCode(1, code)
+	h2, _ := hashRecoveryCode(1, strings.ToUpper(strings.Replace(code, "-", "", 1)))
+	h3, _ := hashRecoveryCode(2, code)
+	if h1 != h2 || h1 == h3 {
+		t.Fatal("recovery code hash error")
+	}
+}
@@ -1,11 +1,14 @@
 package ucenter
 
 import (
+	"crypto"
 	"crypto/md5"
 	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
 	"time"
 	// for mysql driver
 	_ "github.com/go-sql-driver/mysql"
@@ -15,12 +18,44 @@ var (
 	// Config configure must initialization before call Init()
 	// default config not use redis
 	Config = Configure{
-		UserTableName:         "uc_users",
-		TokenTablename:        "uc_user_token",
-		TokenExpiresIn:        7 * 24 * 60 * 60, // one week
-		SessionExpiresIn:      24 * 60 * 60,     // a day
-		PreTokenExpireIn:      2 * 60 * 60,      // two hours
-		InMemoryCacheExpireIn: 2 * 60 * 60,      // two hours
+		UserTableName:               "uc_users",
+		TokenTablename:              "uc_user_token",
+		TokenExpiresIn:              7 * 24 * 60 * 60,  // one week
+		SessionExpiresIn:            24 * 60 * 60,      // a day
+		PreTokenExpireIn:            2 * 60 * 60,       // two hours
+		RefreshTokenExpiresIn:       30 * 24 * 60 * 60, // a month
+		SessionMaxLifetime:          90 * 24 * 60 * 60, // three months
+		InMemoryCacheExpireIn:       2 * 60 * 60,       // two hours
+		MFATableName:                "uc_user_mfa",
+		RecoveryCodeTableName:       "uc_user_recovery_code",
+		MFAIssuer:                   "ucenter",
+		MFAChallengeExpiresIn:       5 * 60, // five minutes
+		WebAuthnTableName:           "uc_user_webauthn",
+		WebAuthnRPName:              "ucenter",
+		WebAuthnTimeout:             5 * 60, // five minutes
+		WebAuthnUserVerification:    "preferred",
+		LoginCodeExpiresIn:          5 * 60, // five minutes
+		LoginCodeMaxAttempts:        5,
+		LoginCodeResendInterval:     60,
+		MagicLinkExpiresIn:          15 * 60, // fifteen minutes
+		SigningKeyTableName:         "uc_signing_keys",
+		RefreshTokenTableName:       "uc_refresh_token",
+		RoleTableName:               "uc_roles",
+		RoleParentTableName:         "uc_role_parents",
+		RolePermissionTableName:     "uc_role_permissions",
+		UserRoleTableName:           "uc_user_roles",
+		OrganizationTableName:       "uc_organizations",
+		OrganizationMemberTableName: "uc_org_members",
+		InvitationTableName:         "uc_org_invitations",
+		InvitationExpiresIn:         7 * 24 * 60 * 60, // a week
+		OAuthClientTableName:        "uc_oauth_clients",
+		AuthorizationCodeExpiresIn:  60,      // a minute
+		DeviceCodeExpiresIn:         10 * 60, // ten minutes
+		DeviceCodeInterval:          5,
+		RegistrationScopes:          []string{ScopeOpenID, ScopeProfile, ScopeEmail},
+		IdentityTableName:           "uc_identities",
+		ConnectorStateExpiresIn:     10 * 60,           // ten minutes
+		JWTKeyRotateIn:              30 * 24 * 60 * 60, // a month
 	}
 
 	// inner variable
@@ -28,6 +63,8 @@ var (
 	accessTokenCache    *Cache
 	preAccessTokenCache *Cache
 	sessionCache        *Cache
+	tempCache           *Cache
+	tokenOwnerCache     *Cache
 	redisPool           *redis.Pool
 )
 
@@ -73,6 +110,240 @@ var (
 
 	// ErrGetRedis get key from reids error
 	ErrGetRedis = errors.New("get key from reids error")
+
+	// ErrSecretKeyNotSet Config.SecretKey must set for encrypt secret
+	ErrSecretKeyNotSet = errors.New("config.SecretKey not set")
+
+	// ErrDecryptSecret secret can not decrypt by Config.SecretKey
+	ErrDecryptSecret = errors.New("decrypt secret error")
+
+	// ErrMFANotEnrolled user has not enrolled mfa
+	ErrMFANotEnrolled = errors.New("mfa has not enrolled")
+
+	// ErrMFAAlreadyEnabled mfa has been enabled for user
+	ErrMFAAlreadyEnabled = errors.New("mfa has been enabled")
+
+	// ErrMFAChallengeInvalid mfa challenge is invalid or expired
+	ErrMFAChallengeInvalid = errors.New("mfa challenge is invalid")
+
+	// ErrMFACodeInvalid mfa code is invalid
+	ErrMFACodeInvalid = errors.New("mfa code is invalid")
+
+	// ErrMFACodeReplayed mfa code has been used
+	ErrMFACodeReplayed = errors.New("mfa code has been used")
+
+	// ErrCBORInvalid data is not valid cbor or use unsupported type
+	ErrCBORInvalid = errors.New("cbor data invalid")
+
+	// ErrPasskeyInvalid passkey response is invalid
+	ErrPasskeyInvalid = errors.New("passkey response is invalid")
+
+	// ErrPasskeyChallengeInvalid passkey challenge is invalid or expired
+	ErrPasskeyChallengeInvalid = errors.New("passkey challenge is invalid")
+
+	// ErrPasskeyOriginInvalid passkey response is not from our site
+	ErrPasskeyOriginInvalid = errors.New("passkey origin is invalid")
+
+	// ErrPasskeyAttestation attestation format is not "none"
+	ErrPasskeyAttestation = errors.New("passkey attestation not supported")
+
+	// ErrPasskeyKeyInvalid public key is invalid or algorithm not supported
+	ErrPasskeyKeyInvalid = errors.New("passkey public key is invalid")
+
+	// ErrPasskeySignature signature of passkey assertion is invalid
+	ErrPasskeySignature = errors.New("passkey signature is invalid")
+
+	// ErrPasskeyCloned sign count not increase, authenticator maybe cloned
+	ErrPasskeyCloned = errors.New("passkey sign count invalid")
+
+	// ErrPasskeyExist credential has been registered
+	ErrPasskeyExist = errors.New("passkey has exist")
+
+	// ErrPasskeyNotExist credential not exist
+	ErrPasskeyNotExist = errors.New("passkey not exist")
+
+	// ErrSenderNotSet sender for email or sms not configured
+	ErrSenderNotSet = errors.New("sender not set")
+
+	// ErrLoginCodeInvalid login code is wrong, used or expired
+	ErrLoginCodeInvalid = errors.New("login code is invalid")
+
+	// ErrLoginCodeTooFrequent login code send too frequently
+	ErrLoginCodeTooFrequent = errors.New("login code send too frequently")
+
+	// ErrUserAmbiguous email or mobile is used by more than one user
+	ErrUserAmbiguous = errors.New("more than one user matched")
+
+	// ErrSignatureInvalid signature of token is invalid
+	ErrSignatureInvalid = errors.New("signature is invalid")
+
+	// ErrRedirectInvalid redirect url is not allowed
+	ErrRedirectInvalid = errors.New("redirect url is not allowed")
+
+	// ErrMagicLinkInvalid magic link is invalid, used or expired
+	ErrMagicLinkInvalid = errors.New("magic link is invalid")
+
+	// ErrMagicLinkSession magic link is not used in the browser request it
+	ErrMagicLinkSession = errors.New("magic link session not match")
+
+	// ErrJWTInvalid token is not a valid jwt
+	ErrJWTInvalid = errors.New("jwt is invalid")
+
+	// ErrJWTAlgorithm jwt algorithm not supported or not match the key
+	ErrJWTAlgorithm = errors.New("jwt algorithm not supported")
+
+	// ErrJWTKeyNotSet key for signing jwt not configured
+	ErrJWTKeyNotSet = errors.New("jwt signing key not set")
+
+	// ErrJWTKeyInvalid key in JWKS is invalid or not supported
+	ErrJWTKeyInvalid = errors.New("jwt key is invalid")
+
+	// ErrJWTKeyRotating signing key is rotating by other instance
+	ErrJWTKeyRotating = errors.New("jwt signing key is rotating")
+
+	// ErrJWTType jwt is not an access token, such as id token
+	ErrJWTType = errors.New("jwt is not an access token")
+
+	// ErrRefreshTokenReused rotated refresh token is used again
+	ErrRefreshTokenReused = errors.New("refresh token has been used")
+
+	// ErrUnsupportedTokenType token type hint is not access_token or refresh_token
+	ErrUnsupportedTokenType = errors.New("unsupported token type")
+
+	// ErrScopeInvalid requested scope is not allowed
+	ErrScopeInvalid = errors.New("scope is invalid")
+
+	// ErrScopeInsufficient access token has not the required scopes
+	ErrScopeInsufficient = errors.New("scope of token is insufficient")
+
+	// ErrRoleExist role name has been used
+	ErrRoleExist = errors.New("role has exist")
+
+	// ErrRoleNotExist role not exist
+	ErrRoleNotExist = errors.New("role not exist")
+
+	// ErrRoleCycle role can not inherit itself
+	ErrRoleCycle = errors.New("role inherit cycle")
+
+	// ErrPermissionInvalid permission is empty or has space
+	ErrPermissionInvalid = errors.New("permission is invalid")
+
+	// ErrOrgExist organization name has been used
+	ErrOrgExist = errors.New("organization has exist")
+
+	// ErrOrgNotExist organization not exist
+	ErrOrgNotExist = errors.New("organization not exist")
+
+	// ErrOrgRoleInvalid role is not owner, admin or member
+	ErrOrgRoleInvalid = errors.New("organization role is invalid")
+
+	// ErrOrgForbidden user can not do it in organization
+	ErrOrgForbidden = errors.New("not allowed in organization")
+
+	// ErrNotOrgMember user is not member of organization
+	ErrNotOrgMember = errors.New("not member of organization")
+
+	// ErrMemberExist user has been member of organization
+	ErrMemberExist = errors.New("member has exist")
+
+	// ErrLastOwner organization must have an owner
+	ErrLastOwner = errors.New("last owner of organization")
+
+	// ErrInvitationInvalid invitation not exist or expired
+	ErrInvitationInvalid = errors.New("invitation is invalid")
+
+	// ErrTenantInvalid tenant id is invalid
+	ErrTenantInvalid = errors.New("tenant is invalid")
+
+	// ErrPasswordWeak password not satisfy the password policy
+	ErrPasswordWeak = errors.New("password is too weak")
+
+	// ErrOAuthClientInvalid oauth client not exist or authenticate failed
+	ErrOAuthClientInvalid = errors.New("oauth client is invalid")
+
+	// ErrRedirectURIInvalid redirect uri is not registered by client
+	ErrRedirectURIInvalid = errors.New("redirect uri is invalid")
+
+	// ErrUnsupportedResponseType response_type is not code
+	ErrUnsupportedResponseType = errors.New("unsupported response type")
+
+	// ErrPKCEInvalid code challenge or code verifier is invalid
+	ErrPKCEInvalid = errors.New("pkce is invalid")
+
+	// ErrAuthCodeInvalid authorization code is invalid or expired
+	ErrAuthCodeInvalid = errors.New("authorization code is invalid")
+
+	// ErrOAuthLoginRequired user has not login when authorize client
+	ErrOAuthLoginRequired = errors.New("user has not login")
+
+	// ErrUnauthorizedClient client can not use the grant type
+	ErrUnauthorizedClient = errors.New("client is not authorized")
+
+	// ErrDeviceCodeInvalid device code or user code is invalid
+	ErrDeviceCodeInvalid = errors.New("device code is invalid")
+
+	// ErrDeviceCodeExpired device code has expired
+	ErrDeviceCodeExpired = errors.New("device code has expired")
+
+	// ErrAuthorizationPending user has not approved the device
+	ErrAuthorizationPending = errors.New("authorization pending")
+
+	// ErrSlowDown device poll tokens too fast
+	ErrSlowDown = errors.New("slow down")
+
+	// ErrAccessDenied user denied the authorization
+	ErrAccessDenied = errors.New("access denied")
+
+	// ErrIssuerNotSet Config.JWTIssuer is required by OpenID Connect
+	ErrIssuerNotSet = errors.New("jwt issuer not set")
+
+	// ErrConnectorInvalid connector not registered
+	ErrConnectorInvalid = errors.New("connector is invalid")
+
+	// ErrConnectorStateInvalid state of connector login is invalid
+	// or expired
+	ErrConnectorStateInvalid = errors.New("connector state is invalid")
+
+	// ErrUpstreamFailed upstream provider failed or returned invalid user
+	ErrUpstreamFailed = errors.New("upstream provider failed")
+
+	// ErrIDTokenInvalid id token of upstream provider is invalid
+	ErrIDTokenInvalid = errors.New("id token is invalid")
+
+	// ErrLDAPFailed ldap server failed or returned invalid response
+	ErrLDAPFailed = errors.New("ldap server failed")
+
+	// ErrLDAPFilterInvalid filter of ldap search is invalid
+	ErrLDAPFilterInvalid = errors.New("ldap filter is invalid")
+
+	// ErrLDAPUserNotLinked local user has the name of directory user
+	// but is not linked to it by LinkLDAPUser
+	ErrLDAPUserNotLinked = errors.New("user is not linked to ldap")
+
+	// ErrBERInvalid ldap message is not valid BER
+	ErrBERInvalid = errors.New("ber is invalid")
+
+	// ErrXMLInvalid xml is not well-formed or has doctype
+	ErrXMLInvalid = errors.New("xml is invalid")
+
+	// ErrXMLSignatureInvalid xml signature is invalid or not supported
+	ErrXMLSignatureInvalid = errors.New("xml signature is invalid")
+
+	// ErrSAMLInvalid saml response is invalid, expired or not for ucenter
+	ErrSAMLInvalid = errors.New("saml response is invalid")
+
+	// ErrSAMLSignatureInvalid saml response is not signed by identity provider
+	ErrSAMLSignatureInvalid = errors.New("saml signature is invalid")
+
+	// ErrSAMLReplay saml assertion has been used
+	ErrSAMLReplay = errors.New("saml assertion has been used")
+
+	// ErrClientMetadataInvalid metadata of oauth client is invalid
+	ErrClientMetadataInvalid = errors.New("client metadata is invalid")
+
+	// ErrInitialAccessTokenInvalid initial access token of client
+	// registration is invalid or has been used
+	ErrInitialAccessTokenInvalid = errors.New("initial access token is invalid")
 )
 
 // Configure configure for data and validation
@@ -85,11 +356,141 @@ type Configure struct {
 	// access_token expires_in
 	TokenExpiresIn   int
 	PreTokenExpireIn int
+	// refresh_token expires_in, it is renewed when refresh token rotate,
+	// 0 means never expire
+	RefreshTokenExpiresIn int
+	// SessionMaxLifetime max seconds after login that refresh token can be
+	// used, user must login again after it. 0 means no limit
+	SessionMaxLifetime int
 	// session expires_in
 	SessionExpiresIn int
 	// RedisConnStr connect string for redis, "172.17.0.89:6379"
 	RedisConnStr          string
 	InMemoryCacheExpireIn int
+	// SecretKey used to encrypt secret saved in database, such as
+	// totp secret, must set before use mfa
+	SecretKey string
+	// MFATableName table for mfa settings of user
+	MFATableName string
+	// RecoveryCodeTableName table for hash of mfa recovery codes
+	RecoveryCodeTableName string
+	// MFAIssuer name show in authenticator app
+	MFAIssuer string
+	// MFAChallengeExpiresIn time for the second step of login
+	MFAChallengeExpiresIn int
+	// WebAuthnTableName table for passkey credentials
+	WebAuthnTableName string
+	// WebAuthnRPID domain of site, like "example.com"
+	WebAuthnRPID string
+	// WebAuthnRPName name of site show in authenticator
+	WebAuthnRPName string
+	// WebAuthnOrigin origin of the login page, like "https://example.com"
+	WebAuthnOrigin string
+	// WebAuthnTimeout time for user to finish passkey ceremony
+	WebAuthnTimeout int
+	// WebAuthnUserVerification "required", "preferred" or "discouraged"
+	WebAuthnUserVerification string
+	// EmailSender send message to email, used by login code
+	EmailSender Sender
+	// SMSSender send message to mobile, used by login code
+	SMSSender Sender
+	// LoginCodeExpiresIn time before login code expired
+	LoginCodeExpiresIn int
+	// LoginCodeMaxAttempts wrong codes before the code is invalid
+	LoginCodeMaxAttempts int
+	// LoginCodeResendInterval min seconds between two codes
+	LoginCodeResendInterval int
+	// MagicLinkURL page of magic link, token will add to its query
+	MagicLinkURL string
+	// MagicLinkExpiresIn time before magic link expired
+	MagicLinkExpiresIn int
+	// MagicLinkBindSession magic link can only used in the browser request it
+	MagicLinkBindSession bool
+	// MagicLinkRedirectHosts hosts allowed to redirect after login
+	MagicLinkRedirectHosts []string
+	// AccessTokenFormat "jwt" for signed access token which can be
+	// checked offline, default is opaque token
+	AccessTokenFormat string
+	// JWTAlgorithm "HS256", "RS256" or "EdDSA"
+	JWTAlgorithm string
+	// JWTSecret key of HS256
+	JWTSecret string
+	// JWTPrivateKey *rsa.PrivateKey for RS256, ed25519.PrivateKey for EdDSA
+	JWTPrivateKey crypto.Signer
+	// JWTIssuer iss claim of jwt
+	JWTIssuer string
+	// SigningKeyTableName table for signing keys, used when
+	// JWTPrivateKey and JWTSecret are not set
+	SigningKeyTableName string
+	// JWTKeyRotateIn seconds before signing key rotate, 0 means
+	// only rotate by RotateSigningKey
+	JWTKeyRotateIn int
+	// RefreshTokenTableName table for rotated refresh tokens
+	RefreshTokenTableName string
+	// SecurityEventHandler called when something may be an attack,
+	// such as a refresh token is reused
+	SecurityEventHandler func(SecurityEvent)
+	// IntrospectionClients id and secret of clients which can call
+	// IntrospectionHandler
+	IntrospectionClients map[string]string
+	// Scopes can be requested when login, any scope can be
+	// requested if it is empty
+	Scopes []string
+	// RoleTableName table of roles
+	RoleTableName string
+	// RoleParentTableName table of roles inherited by roles
+	RoleParentTableName string
+	// RolePermissionTableName table of permissions of roles
+	RolePermissionTableName string
+	// UserRoleTableName table of roles assigned to users
+	UserRoleTableName string
+	// OrganizationTableName table of organizations
+	OrganizationTableName string
+	// OrganizationMemberTableName table of users in organizations
+	OrganizationMemberTableName string
+	// InvitationTableName table of invitations to join organizations
+	InvitationTableName string
+	// InvitationExpiresIn time before invitation expired
+	InvitationExpiresIn int
+	// PasswordPolicy requirements of password for register
+	PasswordPolicy PasswordPolicy
+	// Tenants settings override this config for users of tenants
+	Tenants map[string]TenantConfig
+	// OAuthClientTableName table of clients of oauth2 authorization server
+	OAuthClientTableName string
+	// AuthorizationCodeExpiresIn time before authorization code expired
+	AuthorizationCodeExpiresIn int
+	// OAuthUser get name of user who has login from the request of
+	// AuthorizeHandler, empty if user has not login. it must check
+	// csrf token of POST requests if user is got by cookie, otherwise
+	// other sites can approve consent or device for the user
+	OAuthUser func(r *http.Request) string
+	// OAuthLoginURL page to login for AuthorizeHandler, url of the
+	// authorization request is added as parameter "redirect"
+	OAuthLoginURL string
+	// RegistrationScopes scopes a client registered by RegisterClient
+	// can have, client not requested scope has all of them
+	RegistrationScopes []string
+	// RegistrationClientCredentials client registered by RegisterClient
+	// can use client_credentials grant, it gets tokens without user so
+	// it is disabled by default
+	RegistrationClientCredentials bool
+	// DeviceCodeExpiresIn time before device code expired
+	DeviceCodeExpiresIn int
+	// DeviceCodeInterval seconds device must wait between polls
+	DeviceCodeInterval int
+	// DeviceVerificationURI page user enter the user code
+	DeviceVerificationURI string
+	// OIDCEndpoints urls in OpenID Connect discovery document by name,
+	// such as "token_endpoint", default is path under Config.JWTIssuer
+	OIDCEndpoints map[string]string
+	// IdentityTableName table of users of upstream providers linked to
+	// users of ucenter
+	IdentityTableName string
+	// ConnectorStateExpiresIn time user can login at upstream provider
+	ConnectorStateExpiresIn int
+	// LDAP directory users of default tenant login by, not used if nil
+	LDAP *LDAPConfig
 }
 
 // UserInfo user basic information
@@ -98,17 +499,31 @@ type UserInfo struct {
 	UserName   string
 	Nickname   string
 	Email      string
+	Mobile     string
 	Password   string
 	Registered string
+	// Tenant of user, empty for default tenant
+	Tenant string
 }
 
 // LoginResult Login result
+// if MFARequired is true, there is no token but MFAChallenge,
+// and tokens will return by VerifyMFA
 type LoginResult struct {
 	RefreshToken         string
 	AccessToken          string
 	Session              string
 	AccessTokenExpiresIn int
 	SessionExpiresIn     int
+	// RefreshTokenExpiresIn seconds the refresh token can be used,
+	// 0 means never expire
+	RefreshTokenExpiresIn int
+	// Scopes granted to the access token
+	Scopes       []string
+	MFARequired  bool
+	MFAChallenge string
+	// IDToken of OpenID Connect, only returned to oauth client
+	IDToken string
 }
 
 // Init check environment and init settings
@@ -137,6 +552,10 @@ func Init() {
 		preAccessTokenCache.Init()
 		sessionCache = &Cache{expire: Config.SessionExpiresIn}
 		sessionCache.Init()
+		tempCache = &Cache{expire: Config.InMemoryCacheExpireIn}
+		tempCache.Init()
+		tokenOwnerCache = &Cache{expire: Config.InMemoryCacheExpireIn}
+		tokenOwnerCache.Init()
 	} else {
 		redisPool = &redis.Pool{
 			MaxIdle:     3,                 // adjust to your needs
@@ -152,12 +571,31 @@ func Init() {
 	}
 }
 
-// UserRegister register must have set username and password
+// UserRegister register must have set username and password,
+// user without password must have email or mobile for login by code
 func UserRegister(user UserInfo) error {
-	if len(user.UserName) == 0 || len(user.Password) == 0 {
+	user.Tenant = ""
+	return userRegister(user)
+}
+
+// userRegister register user in user.Tenant, password must satisfy
+// the password policy of the tenant
+func userRegister(user UserInfo) error {
+	key := user.key()
+	if len(user.UserName) == 0 || len(key) == 0 {
+		return ErrParamInvalid
+	}
+	if len(user.Password) == 0 && len(user.Email) == 0 &&
+		len(user.Mobile) == 0 {
 		return ErrParamInvalid
 	}
-	u, _ := getUserByName(user.UserName)
+	if len(user.Password) > 0 {
+		err := tenantConfig(key).PasswordPolicy.check(user.Password)
+		if err != nil {
+			return err
+		}
+	}
+	u, _ := getUserByName(key)
 	if u != nil {
 		return ErrUserExist
 	}
@@ -171,10 +609,35 @@ func UserRegister(user UserInfo) error {
 // UserLogin  user login, if login succeed will return two token string
 // first token : refresh_token
 // second token: access_token
-func UserLogin(name string, password string) (*LoginResult, error) {
+// if user has enabled mfa, it return a LoginResult only with MFARequired
+// and MFAChallenge, then call VerifyMFA to get tokens.
+// scopes are granted to the tokens, token without scope can only be
+// checked by CheckAccessToken and Authenticate
+func UserLogin(name string, password string, scopes ...string) (*LoginResult, error) {
+	return userLogin(accountKey("", name), password, scopes)
+}
+
+// userLogin login user by account key and password
+func userLogin(name string, password string, scopes []string) (*LoginResult, error) {
 	if len(name) == 0 || len(password) == 0 {
 		return nil, ErrParamInvalid
 	}
+	scope, err := normalizeScopes(scopes)
+	if err != nil {
+		return nil, err
+	}
+	if Config.LDAP != nil {
+		if tenant, _ := splitAccountKey(name); len(tenant) == 0 {
+			u, err := ldapLogin(name, password)
+			if err != nil {
+				return nil, err
+			}
+			if u != nil {
+				return loginUser(u, scope)
+			}
+			// user not in directory login by password
+		}
+	}
 	u, err := getUserByName(name)
 	if err != nil {
 		return nil, err
@@ -184,87 +647,274 @@ func UserLogin(name string, password string) (*LoginResult, error) {
 	if pwdStr != u.Password {
 		return nil, ErrPwdInvalid
 	}
-	refreshToken := GetNewToken()
-	err = SetRefreshToken(name, refreshToken)
+	return loginUser(u, scope)
+}
+
+// loginUser user has passed the first step of login, if user has
+// enabled mfa return the challenge, otherwise return tokens
+func loginUser(u *UserInfo, scope string) (*LoginResult, error) {
+	enabled, err := mfaEnabled(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		challenge, err := newMFAChallenge(u.key(), scope)
+		if err != nil {
+			return nil, err
+		}
+		return &LoginResult{MFARequired: true,
+			MFAChallenge: challenge}, nil
+	}
+	return newLoginResult(u.key(), scope)
+}
+
+// newLoginResult create tokens and session for user who has passed
+// authentication, name is account key and scope is granted to tokens
+func newLoginResult(name string, scope string) (*LoginResult, error) {
+	ret, err := issueTokens(name, scope, "")
+	if err != nil {
+		return nil, err
+	}
+	session, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	ret.SessionExpiresIn = tenantConfig(name).SessionExpiresIn
+	err = setSession(name, session, ret.SessionExpiresIn)
+	if err != nil {
+		return nil, err
+	}
+	ret.Session = session
+	return ret, nil
+}
+
+// issueTokens create a new pair of tokens for user issued to client,
+// client is empty if user login by ucenter itself. only tokens issued
+// to the same client before are replaced, others are still valid
+func issueTokens(name string, scope string, client string) (*LoginResult, error) {
+	tc := tokenConfig(name, client)
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	err = setRefreshToken(name, client, refreshToken, tc.RefreshTokenExpiresIn)
+	if err != nil {
+		return nil, ErrSetRefreshToken
+	}
+	family, err := newRefreshFamily()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	err = setRefreshFamily(name, client, family, now)
 	if err != nil {
 		return nil, ErrSetRefreshToken
 	}
-	accessToken := GetNewToken()
-	err = SetAccessToken(name, accessToken)
+	accessToken, storedToken, err := newAccessToken(name, scope, client)
+	if err != nil {
+		return nil, err
+	}
+	err = setAccessToken(name, client, storedToken, tc.TokenExpiresIn)
 	if err != nil {
 		return nil, ErrSetAccessToken
 	}
-	SetPreAccessToken(name, "")
-
-	session := GetNewToken()
+	setPreAccessToken(name, client, "")
+	lifetime := refreshTokenLifetime(name, client, now)
+	err = setTokenScopes(name, client, scope, scope, "", lifetime)
+	if err != nil {
+		return nil, err
+	}
+	err = addTokenClient(name, client)
+	if err != nil {
+		return nil, err
+	}
 
-	// cache token and session if not use redis
+	// cache token if not use redis
 	if redisPool == nil {
-		accessTokenCache.Set(name, accessToken)
-		preAccessTokenCache.Delete(name)
-		sessionCache.Set(name, session)
+		key := grantKey(name, client)
+		accessTokenCache.Set(key, storedToken)
+		preAccessTokenCache.Delete(key)
 	}
 
-	return &LoginResult{refreshToken, accessToken, session,
-		Config.TokenExpiresIn, Config.SessionExpiresIn}, nil
+	return &LoginResult{RefreshToken: refreshToken,
+		AccessToken:           accessToken,
+		AccessTokenExpiresIn:  tc.TokenExpiresIn,
+		RefreshTokenExpiresIn: lifetime,
+		Scopes:                parseScope(scope)}, nil
+}
+
+// setSession save session of user for web site
+func setSession(name string, session string, expire int) error {
+	if redisPool == nil {
+		sessionCache.SetEx(name, session, expire)
+		return nil
+	}
+	c := redisPool.Get()
+	defer c.Close()
+	_, err := c.Do("SET", "session@"+name, session,
+		"EX", strconv.Itoa(expire))
+	if err != nil {
+		fmt.Println(err)
+		return ErrSetRedis
+	}
+	return nil
 }
 
 // CheckAccessToken check user is valid?
 // because of access_token maybe check every request in app, so
-// need save it in cache used to reduce the load
+// need save it in cache used to reduce the load.
+// jwt access token is checked by its signature without cache,
+// so it is valid until expired even if user has been kill off line
 func CheckAccessToken(name string, accessToken string) error {
+	return checkAccessToken(accountKey("", name), accessToken)
+}
+
+// checkAccessToken check access token of user by account key, the
+// token may be issued to ucenter itself or an oauth client
+func checkAccessToken(name string, accessToken string) error {
+	if len(name) == 0 || len(accessToken) == 0 {
+		return ErrParamInvalid
+	}
+	// "nil" is saved in cache for expired token
+	if accessToken == "nil" {
+		return ErrAccessTokenInvalid
+	}
+	if Config.AccessTokenFormat == TokenFormatJWT {
+		// value saved in database or redis is not a token
+		if !isJWT(accessToken) {
+			return ErrAccessTokenInvalid
+		}
+		return checkJWTAccessToken(name, accessToken)
+	}
+	// token of ucenter itself is checked first, then tokens of
+	// oauth clients of the user
+	err := checkGrantAccessToken(name, "", accessToken)
+	if err != ErrAccessTokenInvalid && err != ErrTokenExpired &&
+		err != ErrTokenNotExist {
+		return err
+	}
+	client, cerr := accessTokenClient(name, accessToken)
+	if cerr != nil {
+		return cerr
+	}
+	if len(client) == 0 {
+		return err
+	}
+	return checkGrantAccessToken(name, client, accessToken)
+}
+
+// accessTokenClient oauth client which the token is the current or
+// previous access token of user issued to, empty if not found
+func accessTokenClient(name string, accessToken string) (string, error) {
+	if redisPool == nil {
+		// owner found by Authenticate is cached
+		_, s := splitScopeValue(tokenOwnerCache.Get(accessToken))
+		if client, owner := splitScopeValue(s); owner == name {
+			return client, nil
+		}
+		tenant, user := splitAccountKey(name)
+		clients, err := queryStrings("select client_id from "+
+			Config.TokenTablename+" where tenant_id = ? and user_name = ?"+
+			" and client_id <> '' and (access_token = ?"+
+			" or pre_access_token = ?) limit 1",
+			tenant, user, accessToken, accessToken)
+		if err != nil || len(clients) == 0 {
+			return "", err
+		}
+		return clients[0], nil
+	}
+	clients, err := getTokenClients(name)
+	if err != nil || len(clients) == 0 {
+		return "", err
+	}
+	c := redisPool.Get()
+	defer c.Close()
+	for i := 0; i < len(clients); i++ {
+		key := grantKey(name, clients[i])
+		c.Send("MGET", "access_token@"+key, "pre_access_token@"+key)
+	}
+	if err = c.Flush(); err != nil {
+		fmt.Println(err)
+		return "", ErrGetRedis
+	}
+	client := ""
+	for i := 0; i < len(clients); i++ {
+		tokens, err := redis.Strings(c.Receive())
+		if err != nil {
+			fmt.Println(err)
+			return "", ErrGetRedis
+		}
+		if tokens[0] == accessToken || tokens[1] == accessToken {
+			client = clients[i]
+		}
+	}
+	return client, nil
+}
+
+// checkGrantAccessToken check access token is the current or previous
+// access token of user issued to client
+func checkGrantAccessToken(name string, client string, accessToken string) error {
+	key := grantKey(name, client)
 	// if not use redis, check in-memory cache first
 	if redisPool == nil {
-		token := accessTokenCache.Get(name)
+		token := accessTokenCache.Get(key)
 		if len(token) > 0 { // have load from database
 			if token == accessToken {
 				return nil
 			}
-			preToken := preAccessTokenCache.Get(name)
+			preToken := preAccessTokenCache.Get(key)
 			if preToken == accessToken {
 				return nil
 			}
 			return ErrAccessTokenInvalid
 		}
-	}
-	t, err := GetTokenInfo(name)
-	if err != nil {
-		return err
-	}
-
-	// check redis
-	if redisPool != nil {
-		if accessToken == t.AccessToken ||
-			accessToken == t.PreAccessToken {
+	} else {
+		// expired token has been deleted from redis
+		c := redisPool.Get()
+		defer c.Close()
+		tokens, err := redis.Strings(c.Do("MGET", "access_token@"+key,
+			"pre_access_token@"+key))
+		if err != nil {
+			fmt.Println(err)
+			return ErrGetRedis
+		}
+		if len(tokens[0]) == 0 && len(tokens[1]) == 0 {
+			return ErrTokenNotExist
+		}
+		if accessToken == tokens[0] || accessToken == tokens[1] {
 			return nil
 		}
 		return ErrAccessTokenInvalid
 	}
+	t, err := getTokenInfo(name, client)
+	if err != nil {
+		return err
+	}
 
 	// check database
+	c := tokenConfig(name, client)
 	now := time.Now()
-	tokenCreated, err := time.Parse("2006-01-02 15:04:05",
-		t.AccessTokenCreated)
+	tokenCreated, err := parseDBTime(t.AccessTokenCreated)
 	if err != nil {
-		return ErrTimeParse
+		return err
 	}
-	if now.Unix()-tokenCreated.Unix() > int64(Config.TokenExpiresIn) ||
+	if now.Unix()-tokenCreated.Unix() > int64(c.TokenExpiresIn) ||
 		t.AccessToken == "" {
 		// expire_in or kill down
-		preAccessTokenCache.Set(name, "nil")
-		accessTokenCache.Set(name, "nil")
+		preAccessTokenCache.Set(key, "nil")
+		accessTokenCache.Set(key, "nil")
 		return ErrTokenExpired
 	}
 	// database have right value
 	if redisPool == nil {
-		preAccessTokenCache.Set(name, t.PreAccessToken)
-		accessTokenCache.Set(name, t.AccessToken)
+		preAccessTokenCache.Set(key, t.PreAccessToken)
+		accessTokenCache.Set(key, t.AccessToken)
 	}
 
 	if t.AccessToken != accessToken {
 		// pre_access_token is valid in 2 hours
 		if now.Unix()-tokenCreated.Unix() <
-			int64(Config.PreTokenExpireIn) {
+			int64(c.PreTokenExpireIn) {
 			if accessToken == t.PreAccessToken {
 				return nil
 			}
@@ -276,35 +926,111 @@ func CheckAccessToken(name string, accessToken string) error {
 
 // ResetAccessToken reset the access_token by refreshToken
 // because of access_token maybe check every request in app, so
-// need save it in cache used to reduce the load
-func ResetAccessToken(name string, refreshToken string) (string, error) {
-	t, err := GetTokenInfo(name)
+// need save it in cache used to reduce the load.
+// refresh token is rotated every time, the returned RefreshToken must be
+// used next time. if a rotated refresh token is used again, it may have
+// been stolen, all tokens of the login will be revoked and
+// ErrRefreshTokenReused returned.
+// scopes of new access token must be granted to the refresh token,
+// all granted scopes are used if it is empty
+func ResetAccessToken(name string, refreshToken string, scopes ...string) (*LoginResult, error) {
+	return resetAccessToken(accountKey("", name), "", refreshToken, scopes)
+}
+
+// resetAccessToken refresh access token of user issued to client by
+// account key, only the refresh token of the client can be used
+func resetAccessToken(name string, client string, refreshToken string, scopes []string) (*LoginResult, error) {
+	if len(name) == 0 || len(refreshToken) == 0 {
+		return nil, ErrParamInvalid
+	}
+	scope, err := normalizeScopes(scopes)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	t, err := getTokenInfo(name, client)
+	if err != nil {
+		return nil, err
 	}
 	if t.RefreshToken != refreshToken {
-		return "", ErrRefreshTokenInvalid
+		return nil, checkRefreshTokenReused(name, t, refreshToken)
 	}
-	err = SetPreAccessToken(name, t.AccessToken)
+	if len(scope) == 0 {
+		scope = t.Scope
+	} else if !hasScopes(t.Scope, parseScope(scope)) {
+		return nil, ErrScopeInvalid
+	}
+	expired, err := refreshTokenExpired(t)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	lifetime := refreshTokenLifetime(name, client, t.SessionCreated)
+	if expired || lifetime < 0 {
+		return nil, ErrTokenExpired
 	}
-	AccessToken := GetNewToken()
-	err = SetAccessToken(name, AccessToken)
+	// remember it before rotate, so concurrent request using
+	// the same token will be found as reused
+	saved, err := saveUsedRefreshToken(name, client, t.RefreshFamily,
+		refreshToken)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if !saved {
+		return nil, checkRefreshTokenReused(name, t, refreshToken)
+	}
+	newRefreshToken, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	rotated, err := rotateRefreshToken(name, client, refreshToken,
+		newRefreshToken, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	if !rotated {
+		return nil, checkRefreshTokenReused(name, t, refreshToken)
+	}
+	err = setPreAccessToken(name, client, t.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	AccessToken, storedToken, err := newAccessToken(name, scope, client)
+	if err != nil {
+		return nil, err
+	}
+	tc := tokenConfig(name, client)
+	err = setAccessToken(name, client, storedToken, tc.TokenExpiresIn)
+	if err != nil {
+		return nil, err
+	}
+	err = setTokenScopes(name, client, t.Scope, scope, t.AccessScope, lifetime)
+	if err != nil {
+		return nil, err
 	}
 	if redisPool == nil {
-		accessTokenCache.Set(name, AccessToken)
-		preAccessTokenCache.Set(name, t.AccessToken)
+		key := grantKey(name, client)
+		accessTokenCache.Set(key, storedToken)
+		preAccessTokenCache.Set(key, t.AccessToken)
 	}
 
-	return AccessToken, nil
+	return &LoginResult{RefreshToken: newRefreshToken,
+		AccessToken:           AccessToken,
+		AccessTokenExpiresIn:  tc.TokenExpiresIn,
+		RefreshTokenExpiresIn: lifetime,
+		Scopes:                parseScope(scope)}, nil
 }
 
 // CheckSession check session for web site,
 // and it will auto refresh session expires_in
 func CheckSession(name string, session string) bool {
+	return checkSession(accountKey("", name), session)
+}
+
+// checkSession check session of user by account key
+func checkSession(name string, session string) bool {
+	if len(name) == 0 || len(session) == 0 {
+		return false
+	}
+	expire := tenantConfig(name).SessionExpiresIn
 	if redisPool != nil {
 		c := redisPool.Get()
 		defer c.Close()
@@ -314,6 +1040,7 @@ func CheckSession(name string, session string) bool {
 			return false
 		}
 		if s == session {
+			c.Do("EXPIRE", "session@"+name, expire)
 			return true
 		}
 		return false
@@ -323,12 +1050,20 @@ func CheckSession(name string, session string) bool {
 		return false
 	}
 
-	sessionCache.Set(name, session)
+	sessionCache.SetEx(name, session, expire)
 	return true
 }
 
 // GetUserInfo get user basic info but not contain authentication information
 func GetUserInfo(name string) (*UserInfo, error) {
+	return getUserInfo(accountKey("", name))
+}
+
+// getUserInfo get user by account key
+func getUserInfo(name string) (*UserInfo, error) {
+	if len(name) == 0 {
+		return nil, ErrParamInvalid
+	}
 	u, err := getUserByName(name)
 	if err != nil {
 		return nil, err
@@ -338,14 +1073,19 @@ func GetUserInfo(name string) (*UserInfo, error) {
 
 // KillOffLine will delete user token
 func KillOffLine(name string) error {
+	return killOffLine(accountKey("", name))
+}
+
+// killOffLine delete tokens of user by account key
+func killOffLine(name string) error {
+	if len(name) == 0 {
+		return ErrParamInvalid
+	}
 	_, err := getUserByName(name)
 	if err != nil {
 		return err
 	}
-	SetRefreshToken(name, "")
-	SetAccessToken(name, "")
-	SetPreAccessToken(name, "")
-	sessionCache.Set(name, "")
+	revokeUserTokens(name)
 
 	return nil
 }
@@ -356,38 +1096,148 @@ func makeSureUserTableExist() error {
 	if err != nil {
 		return err
 	}
-	findedUserTable := false
-	for i := 0; i < len(tables); i++ {
-		if Config.UserTableName == tables[i] {
-			findedUserTable = true
-			break
-		}
-	}
-	if !findedUserTable {
+	if !hasTable(tables, Config.UserTableName) {
 		fmt.Println("not find " + Config.UserTableName)
 		err := createUserTable()
 		if err != nil {
 			return err
 		}
+	} else {
+		// user table created by old version
+		err := addColumnIfNotExist(Config.UserTableName, "user_mobile",
+			"varchar(20) NOT NULL DEFAULT '' AFTER user_email")
+		if err != nil {
+			return err
+		}
+		err = addColumnIfNotExist(Config.UserTableName, "tenant_id",
+			"varchar(64) NOT NULL DEFAULT '' AFTER ID")
+		if err != nil {
+			return err
+		}
+		err = addIndexIfNotExist(Config.UserTableName, "tenant_user",
+			"tenant_id, user_name")
+		if err != nil {
+			return err
+		}
 	}
-	if redisClient == nil {
-		findedTokenTable := false
-		for i := 0; i < len(tables); i++ {
-			if Config.TokenTablename == tables[i] {
-				findedTokenTable = true
-				break
+	// token save in redis if have configured it
+	if len(Config.RedisConnStr) == 0 {
+		if !hasTable(tables, Config.TokenTablename) {
+			err := createUserTokenTable()
+			if err != nil {
+				return err
+			}
+		} else {
+			err := addColumnIfNotExist(Config.TokenTablename,
+				"refresh_family", "varchar(64) NOT NULL DEFAULT ''")
+			if err != nil {
+				return err
+			}
+			err = addColumnIfNotExist(Config.TokenTablename,
+				"family_created", "bigint(20) NOT NULL DEFAULT 0")
+			if err != nil {
+				return err
+			}
+			err = addColumnIfNotExist(Config.TokenTablename, "tenant_id",
+				"varchar(64) NOT NULL DEFAULT '' FIRST")
+			if err != nil {
+				return err
+			}
+			err = addColumnIfNotExist(Config.TokenTablename, "client_id",
+				"varchar(64) NOT NULL DEFAULT ''")
+			if err != nil {
+				return err
+			}
+			// every client has its own tokens
+			err = addIndexIfNotExist(Config.TokenTablename,
+				"tenant_user_client", "tenant_id, user_name, client_id")
+			if err != nil {
+				return err
+			}
+			for _, column := range []string{"scope", "access_scope",
+				"pre_access_scope"} {
+				err = addColumnIfNotExist(Config.TokenTablename, column,
+					"varchar(1024) NOT NULL DEFAULT ''")
+				if err != nil {
+					return err
+				}
+			}
+			// find user by token
+			for _, column := range []string{"refresh_token",
+				"access_token", "pre_access_token"} {
+				err = addIndexIfNotExist(Config.TokenTablename, column, column)
+				if err != nil {
+					return err
+				}
 			}
 		}
-		if !findedTokenTable {
-			err := createUserTokenTable()
+		if !hasTable(tables, Config.RefreshTokenTableName) {
+			err := createRefreshTokenTable()
 			if err != nil {
 				return err
 			}
 		}
 	}
+	if !hasTable(tables, Config.MFATableName) {
+		err := createMFATable()
+		if err != nil {
+			return err
+		}
+	}
+	if !hasTable(tables, Config.RecoveryCodeTableName) {
+		err := createRecoveryCodeTable()
+		if err != nil {
+			return err
+		}
+	}
+	if !hasTable(tables, Config.WebAuthnTableName) {
+		err := createWebAuthnTable()
+		if err != nil {
+			return err
+		}
+	}
+	if !hasTable(tables, Config.SigningKeyTableName) {
+		err := createSigningKeyTable()
+		if err != nil {
+			return err
+		}
+	}
+	if !hasTable(tables, Config.RoleTableName) {
+		err := createRoleTables()
+		if err != nil {
+			return err
+		}
+	}
+	if !hasTable(tables, Config.OrganizationTableName) {
+		err := createOrganizationTables()
+		if err != nil {
+			return err
+		}
+	}
+	if !hasTable(tables, Config.OAuthClientTableName) {
+		err := createOAuthClientTable()
+		if err != nil {
+			return err
+		}
+	}
+	if !hasTable(tables, Config.IdentityTableName) {
+		err := createIdentityTable()
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func hasTable(tables []string, name string) bool {
+	for i := 0; i < len(tables); i++ {
+		if name == tables[i] {
+			return true
+		}
+	}
+	return false
+}
+
 func getAllTables() ([]string, error) {
 	// 得到所有的分类
 	rows, err := db.Query("show tables like '%%'")
@@ -405,18 +1255,64 @@ func getAllTables() ([]string, error) {
 	return tables, nil
 }
 
+// addColumnIfNotExist add new column for table created by old version
+func addColumnIfNotExist(table string, column string, definition string) error {
+	var count int
+	sql := "select count(*) from information_schema.columns" +
+		" where table_schema = database() and table_name = ?" +
+		" and column_name = ?"
+	err := db.QueryRow(sql, table, column).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err = db.Exec("alter table " + table + " add column " + column +
+		" " + definition)
+	return err
+}
+
+// addIndexIfNotExist add new index for table created by old version
+func addIndexIfNotExist(table string, index string, columns string) error {
+	has, err := hasIndex(table, index)
+	if err != nil || has {
+		return err
+	}
+	_, err = db.Exec("alter table " + table + " add index `" + index +
+		"` (" + columns + ")")
+	return err
+}
+
+// hasIndex check index of table exist
+func hasIndex(table string, index string) (bool, error) {
+	var count int
+	sql := "select count(*) from information_schema.statistics" +
+		" where table_schema = database() and table_name = ?" +
+		" and index_name = ?"
+	err := db.QueryRow(sql, table, index).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
 // create user table
 func createUserTable() error {
 	createStr := "create table " + Config.UserTableName + "(" +
 		"ID               bigint(20) unsigned NOT NULL AUTO_INCREMENT," +
+		"tenant_id        varchar(64) NOT NULL DEFAULT ''," +
 		"user_name        varchar(60) NOT NULL DEFAULT ''," +
 		"user_pass        varchar(255) NOT NULL DEFAULT ''," +
 		"user_nicename    varchar(50) NOT NULL DEFAULT ''," +
 		"user_email       varchar(100) NOT NULL DEFAULT ''," +
+		"user_mobile      varchar(20) NOT NULL DEFAULT ''," +
 		"user_registered  datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
 		"PRIMARY KEY (`ID`), " +
 		"KEY `user_name` (`user_name`), " +
-		"KEY `user_email` (`user_email`)" +
+		"KEY `tenant_user` (`tenant_id`, `user_name`), " +
+		"KEY `user_email` (`user_email`), " +
+		"KEY `user_mobile` (`user_mobile`)" +
 		") ENGINE=InnoDB DEFAULT CHARSET=utf8"
 	_, err := db.Exec(createStr)
 	if err != nil {
@@ -428,13 +1324,24 @@ func createUserTable() error {
 // if not use redis, this information need save in database
 func createUserTokenTable() error {
 	createStr := "create table  " + Config.TokenTablename + " (" +
+		"tenant_id        varchar(64) NOT NULL DEFAULT ''," +
 		"user_name        varchar(255) NOT NULL DEFAULT ''," +
 		"refresh_token    varchar(255) NOT NULL DEFAULT ''," +
 		"rtoken_created   datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
 		"access_token     varchar(255) NOT NULL DEFAULT ''," +
 		"atoken_created   datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
 		"pre_access_token varchar(255) NOT NULL DEFAULT ''," +
-		"KEY `user_name` (`user_name`)" +
+		"refresh_family   varchar(64) NOT NULL DEFAULT ''," +
+		"family_created   bigint(20) NOT NULL DEFAULT 0," +
+		"scope            varchar(1024) NOT NULL DEFAULT ''," +
+		"access_scope     varchar(1024) NOT NULL DEFAULT ''," +
+		"pre_access_scope varchar(1024) NOT NULL DEFAULT ''," +
+		"client_id        varchar(64) NOT NULL DEFAULT ''," +
+		"KEY `user_name` (`user_name`), " +
+		"KEY `tenant_user_client` (`tenant_id`, `user_name`, `client_id`), " +
+		"KEY `refresh_token` (`refresh_token`), " +
+		"KEY `access_token` (`access_token`), " +
+		"KEY `pre_access_token` (`pre_access_token`)" +
 		") ENGINE=InnoDB DEFAULT CHARSET=utf8"
 	_, err := db.Exec(createStr)
 	if err != nil {
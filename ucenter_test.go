@@ -10,6 +10,16 @@ func TestInit(t *testing.T) {
 	Init()
 }
 
+// requireMySQL init ucenter by local mysql, the test is skipped if
+// mysql is not available
+func requireMySQL(t *testing.T) {
+	Config.MysqlConnStr = "root:@/ucenter?charset=utf8"
+	Init()
+	if db == nil || db.Ping() != nil {
+		t.Skip("mysql is not available")
+	}
+}
+
 func TestCreateUser(t *testing.T) {
 	Config.MysqlConnStr = "root:@/ucenter?charset=utf8"
 	Init()
@@ -39,13 +49,13 @@ func TestLogin(t *testing.T) {
 	}
 	preAccessToken := loginRet.AccessToken
 
-	accessToken, err := ResetAccessToken(name, loginRet.RefreshToken)
+	resetRet, err := ResetAccessToken(name, loginRet.RefreshToken)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// check by access token
-	err = CheckAccessToken(name, accessToken)
+	err = CheckAccessToken(name, resetRet.AccessToken)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -56,6 +66,133 @@ func TestLogin(t *testing.T) {
 	}
 }
 
+func TestRefreshTokenReused(t *testing.T) {
+	requireMySQL(t)
+	name := "sails"
+	pwd := "twtpsu31"
+	loginRet, err := UserLogin(name, pwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetRet, err := ResetAccessToken(name, loginRet.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resetRet.RefreshToken == loginRet.RefreshToken {
+		t.Fatal("refresh token should be rotated")
+	}
+	// the old refresh token is used again
+	_, err = ResetAccessToken(name, loginRet.RefreshToken)
+	if err != ErrRefreshTokenReused {
+		t.Fatal("reused refresh token should be found", err)
+	}
+	// the family has been revoked
+	_, err = ResetAccessToken(name, resetRet.RefreshToken)
+	if err != ErrRefreshTokenInvalid {
+		t.Fatal("family should be revoked", err)
+	}
+	err = CheckAccessToken(name, resetRet.AccessToken)
+	if err == nil {
+		t.Fatal("access token should be revoked")
+	}
+	if CheckSession(name, loginRet.Session) {
+		t.Fatal("session should be revoked")
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	requireMySQL(t)
+	name := "sails"
+	pwd := "twtpsu31"
+	loginRet, err := UserLogin(name, pwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := IntrospectToken(loginRet.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Active || info.UserName != name {
+		t.Fatal("access token should be active", info)
+	}
+	err = RevokeToken(loginRet.AccessToken, TokenTypeHintAccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckAccessToken(name, loginRet.AccessToken); err == nil {
+		t.Fatal("access token should be revoked")
+	}
+	// refresh token is still valid
+	resetRet, err := ResetAccessToken(name, loginRet.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RevokeToken(resetRet.RefreshToken, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckAccessToken(name, resetRet.AccessToken); err == nil {
+		t.Fatal("access token of revoked refresh token should be revoked")
+	}
+	info, err = IntrospectToken(resetRet.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Active {
+		t.Fatal("refresh token should be revoked")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	requireMySQL(t)
+	name := "sails"
+	pwd := "twtpsu31"
+	loginRet, err := UserLogin(name, pwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Authenticate(loginRet.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.UserName != name || p.Session != loginRet.Session {
+		t.Fatal("principal is wrong", p)
+	}
+	if _, err = Authenticate(loginRet.RefreshToken); err == nil {
+		t.Fatal("refresh token should not be used to authenticate")
+	}
+	KillOffLine(name)
+	if _, err = Authenticate(loginRet.AccessToken); err == nil {
+		t.Fatal("access token should be invalid after kill off line")
+	}
+}
+
+func TestScopedToken(t *testing.T) {
+	requireMySQL(t)
+	name := "sails"
+	pwd := "twtpsu31"
+	loginRet, err := UserLogin(name, pwd, "read", "write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = CheckAccessTokenScopes(loginRet.AccessToken, "read",
+		"write"); err != nil {
+		t.Fatal(err)
+	}
+	resetRet, err := ResetAccessToken(name, loginRet.RefreshToken, "read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CheckAccessTokenScopes(resetRet.AccessToken, "write")
+	if err != ErrScopeInsufficient {
+		t.Fatal("scope should be narrowed", err)
+	}
+	_, err = ResetAccessToken(name, resetRet.RefreshToken, "admin")
+	if err != ErrScopeInvalid {
+		t.Fatal("scope not granted should be invalid", err)
+	}
+}
+
 func TestLoginWithRedis(t *testing.T) {
 	Config.MysqlConnStr = "root:@/ucenter?charset=utf8"
 	Config.RedisConnStr = ":6379"
@@ -75,13 +212,13 @@ func TestLoginWithRedis(t *testing.T) {
 	}
 	preAccessToken := loginRet.AccessToken
 
-	accessToken, err := ResetAccessToken(name, loginRet.RefreshToken)
+	resetRet, err := ResetAccessToken(name, loginRet.RefreshToken)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// check by access token
-	err = CheckAccessToken(name, accessToken)
+	err = CheckAccessToken(name, resetRet.AccessToken)
 	if err != nil {
 		t.Fatal(err)
 	}
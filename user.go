@@ -2,14 +2,51 @@ package ucenter
 
 import (
 	"crypto/md5"
+	"database/sql"
 	"fmt"
 )
 
-func getUserByName(name string) (*UserInfo, error) {
-	sql := "select ID, user_name, user_pass, user_nicename, user_email," +
-		" user_registered " +
-		" from " + Config.UserTableName + " where user_name = ?"
-	rows, err := db.Query(sql, name)
+// getUserByName get user by account key, it is user name in default tenant
+func getUserByName(key string) (*UserInfo, error) {
+	tenant, name := splitAccountKey(key)
+	return queryUser("tenant_id = ? and user_name = ?", tenant, name)
+}
+
+func getUserByID(id int64) (*UserInfo, error) {
+	return queryUser("ID = ?", id)
+}
+
+// getUserByEmail get user of default tenant by email, it returns
+// ErrUserAmbiguous if more than one user has the email
+func getUserByEmail(email string) (*UserInfo, error) {
+	return queryUniqueUser("tenant_id = '' and user_email = ?", email)
+}
+
+// getUserByMobile get user of default tenant by mobile, it returns
+// ErrUserAmbiguous if more than one user has the mobile
+func getUserByMobile(mobile string) (*UserInfo, error) {
+	return queryUniqueUser("tenant_id = '' and user_mobile = ?", mobile)
+}
+
+// queryUniqueUser get the only user matched the condition
+func queryUniqueUser(where string, args ...interface{}) (*UserInfo, error) {
+	var n int
+	sql := "select count(*) from " + Config.UserTableName + " where " + where
+	if err := db.QueryRow(sql, args...).Scan(&n); err != nil {
+		return nil, err
+	}
+	if n > 1 {
+		return nil, ErrUserAmbiguous
+	}
+	return queryUser(where, args...)
+}
+
+// queryUser get the first user matched the condition
+func queryUser(where string, args ...interface{}) (*UserInfo, error) {
+	sql := "select ID, tenant_id, user_name, user_pass, user_nicename," +
+		" user_email, user_mobile, user_registered " +
+		" from " + Config.UserTableName + " where " + where
+	rows, err := db.Query(sql, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -17,8 +54,8 @@ func getUserByName(name string) (*UserInfo, error) {
 	for rows.Next() {
 
 		var u UserInfo
-		if err = rows.Scan(&u.ID, &u.Nickname, &u.Password,
-			&u.Nickname, &u.Email, &u.Registered); err == nil {
+		if err = rows.Scan(&u.ID, &u.Tenant, &u.UserName, &u.Password,
+			&u.Nickname, &u.Email, &u.Mobile, &u.Registered); err == nil {
 			return &u, nil
 		}
 		fmt.Println(err)
@@ -27,12 +64,34 @@ func getUserByName(name string) (*UserInfo, error) {
 }
 
 func createUser(user UserInfo) error {
-	password := md5.Sum([]byte(user.Password))
-	passwordstr := fmt.Sprintf("%x", password)
-	sql := "insert into " + Config.UserTableName + "(user_name, " +
-		"user_pass, user_nicename, user_email, user_registered ) " +
-		"values(?, ?, ?, ?, now())"
-	_, err := db.Exec(sql, user.UserName, passwordstr, user.Nickname,
-		user.Email)
+	_, err := insertUser(db.Exec, user)
+	return err
+}
+
+// insertUser insert user by Exec of db or transaction
+func insertUser(exec func(string, ...interface{}) (sql.Result, error), user UserInfo) (sql.Result, error) {
+	// user without password can only login by code or link
+	passwordstr := ""
+	if len(user.Password) > 0 {
+		password := md5.Sum([]byte(user.Password))
+		passwordstr = fmt.Sprintf("%x", password)
+	}
+	sql := "insert into " + Config.UserTableName + "(tenant_id, user_name, " +
+		"user_pass, user_nicename, user_email, user_mobile, user_registered ) " +
+		"values(?, ?, ?, ?, ?, ?, now())"
+	return exec(sql, user.Tenant, user.UserName, passwordstr,
+		user.Nickname, user.Email, user.Mobile)
+}
+
+// updateUserProfile update nickname, email and mobile of user by ID
+func updateUserProfile(user UserInfo) error {
+	sql := "update " + Config.UserTableName + " set user_nicename = ?," +
+		" user_email = ?, user_mobile = ? where ID = ?"
+	_, err := db.Exec(sql, user.Nickname, user.Email, user.Mobile, user.ID)
 	return err
 }
+
+// key account key of user
+func (u *UserInfo) key() string {
+	return accountKey(u.Tenant, u.UserName)
+}
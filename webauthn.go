@@ -0,0 +1,590 @@
+package ucenter
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// COSE algorithms supported for passkey
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// flags of authenticator data
+const (
+	authFlagUserPresent  = 0x01
+	authFlagUserVerified = 0x04
+	authFlagAttested     = 0x40
+)
+
+// PasskeyCredentialParam algorithm accepted for new credential
+type PasskeyCredentialParam struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// PasskeyDescriptor credential id in base64url
+type PasskeyDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// PasskeyRelyingParty the site that user register passkey for
+type PasskeyRelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// PasskeyUser user entity, ID is base64url of user id
+type PasskeyUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// PasskeyAuthenticatorSelection requirement of authenticator
+type PasskeyAuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// PasskeyCreationOptions publicKey options for navigator.credentials.create,
+// all binary fields are base64url, browser need decode them to ArrayBuffer
+type PasskeyCreationOptions struct {
+	Challenge              string                        `json:"challenge"`
+	RP                     PasskeyRelyingParty           `json:"rp"`
+	User                   PasskeyUser                   `json:"user"`
+	PubKeyCredParams       []PasskeyCredentialParam      `json:"pubKeyCredParams"`
+	Timeout                int                           `json:"timeout"`
+	Attestation            string                        `json:"attestation"`
+	ExcludeCredentials     []PasskeyDescriptor           `json:"excludeCredentials"`
+	AuthenticatorSelection PasskeyAuthenticatorSelection `json:"authenticatorSelection"`
+}
+
+// PasskeyRequestOptions publicKey options for navigator.credentials.get
+type PasskeyRequestOptions struct {
+	Challenge        string              `json:"challenge"`
+	RPID             string              `json:"rpId"`
+	Timeout          int                 `json:"timeout"`
+	AllowCredentials []PasskeyDescriptor `json:"allowCredentials"`
+	UserVerification string              `json:"userVerification"`
+}
+
+// PasskeyAttestation response of navigator.credentials.create,
+// fields are raw bytes decoded from ArrayBuffer
+type PasskeyAttestation struct {
+	ClientDataJSON    []byte
+	AttestationObject []byte
+}
+
+// PasskeyAssertion response of navigator.credentials.get,
+// fields are raw bytes decoded from ArrayBuffer
+type PasskeyAssertion struct {
+	CredentialID      []byte
+	ClientDataJSON    []byte
+	AuthenticatorData []byte
+	Signature         []byte
+}
+
+// passkeyCredential credential saved for user
+type passkeyCredential struct {
+	UserID    int64
+	ID        []byte
+	PublicKey []byte // COSE_Key
+	SignCount uint32
+}
+
+// clientData collected by browser, signed by authenticator
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// authenticatorData binary data created by authenticator
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// BeginPasskeyRegistration create options for register a new passkey,
+// the options should pass to navigator.credentials.create
+func BeginPasskeyRegistration(name string) (*PasskeyCreationOptions, error) {
+	u, err := getUserByName(accountKey("", name))
+	if err != nil {
+		return nil, err
+	}
+	creds, err := getPasskeyCredentials(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := newPasskeyChallenge("register:" + name)
+	if err != nil {
+		return nil, err
+	}
+	displayName := u.Nickname
+	if len(displayName) == 0 {
+		displayName = name
+	}
+	opts := &PasskeyCreationOptions{
+		Challenge: challenge,
+		RP:        PasskeyRelyingParty{Config.WebAuthnRPID, Config.WebAuthnRPName},
+		User: PasskeyUser{
+			ID: base64.RawURLEncoding.EncodeToString(
+				[]byte(strconv.FormatInt(u.ID, 10))),
+			Name:        name,
+			DisplayName: displayName,
+		},
+		PubKeyCredParams: []PasskeyCredentialParam{
+			{"public-key", coseAlgES256},
+			{"public-key", coseAlgEdDSA},
+			{"public-key", coseAlgRS256},
+		},
+		Timeout:            Config.WebAuthnTimeout * 1000,
+		Attestation:        "none",
+		ExcludeCredentials: passkeyDescriptors(creds),
+		AuthenticatorSelection: PasskeyAuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: Config.WebAuthnUserVerification,
+		},
+	}
+	return opts, nil
+}
+
+// FinishPasskeyRegistration verify response of navigator.credentials.create
+// and save the new credential for user
+func FinishPasskeyRegistration(name string, att *PasskeyAttestation) error {
+	if att == nil {
+		return ErrParamInvalid
+	}
+	cd, err := checkClientData(att.ClientDataJSON, "webauthn.create")
+	if err != nil {
+		return err
+	}
+	if takeTempValue("webauthn_challenge@"+cd.Challenge) != "register:"+name {
+		return ErrPasskeyChallengeInvalid
+	}
+	u, err := getUserByName(accountKey("", name))
+	if err != nil {
+		return err
+	}
+	cred, err := verifyAttestation(att.AttestationObject)
+	if err != nil {
+		return err
+	}
+	old, err := getPasskeyCredential(cred.ID)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		return ErrPasskeyExist
+	}
+	id := base64.RawURLEncoding.EncodeToString(cred.ID)
+	sql := "insert into " + Config.WebAuthnTableName +
+		"(user_id, credential_hash, credential_id, public_key, sign_count," +
+		" created) values(?, ?, ?, ?, ?, now())"
+	_, err = db.Exec(sql, u.ID, hashToken(id), id, cred.PublicKey,
+		cred.SignCount)
+	return err
+}
+
+// BeginPasskeyLogin create options for login by passkey,
+// the options should pass to navigator.credentials.get. name can be
+// empty, so user will select passkey saved in authenticator
+func BeginPasskeyLogin(name string) (*PasskeyRequestOptions, error) {
+	var creds []passkeyCredential
+	if len(name) > 0 {
+		u, err := getUserByName(accountKey("", name))
+		if err != nil {
+			return nil, err
+		}
+		creds, err = getPasskeyCredentials(u.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(creds) == 0 {
+			return nil, ErrPasskeyNotExist
+		}
+	}
+	challenge, err := newPasskeyChallenge("login:" + name)
+	if err != nil {
+		return nil, err
+	}
+	return &PasskeyRequestOptions{
+		Challenge:        challenge,
+		RPID:             Config.WebAuthnRPID,
+		Timeout:          Config.WebAuthnTimeout * 1000,
+		AllowCredentials: passkeyDescriptors(creds),
+		UserVerification: Config.WebAuthnUserVerification,
+	}, nil
+}
+
+// FinishPasskeyLogin verify response of navigator.credentials.get,
+// if succeed return tokens as UserLogin
+func FinishPasskeyLogin(a *PasskeyAssertion) (*LoginResult, error) {
+	if a == nil || len(a.CredentialID) == 0 {
+		return nil, ErrParamInvalid
+	}
+	cd, err := checkClientData(a.ClientDataJSON, "webauthn.get")
+	if err != nil {
+		return nil, err
+	}
+	expected := takeTempValue("webauthn_challenge@" + cd.Challenge)
+	if !strings.HasPrefix(expected, "login:") {
+		return nil, ErrPasskeyChallengeInvalid
+	}
+	cred, err := getPasskeyCredential(a.CredentialID)
+	if err != nil {
+		return nil, err
+	}
+	if cred == nil {
+		return nil, ErrPasskeyNotExist
+	}
+	u, err := getUserByID(cred.UserID)
+	if err != nil {
+		return nil, err
+	}
+	// challenge created for a user can only used by the user
+	name := strings.TrimPrefix(expected, "login:")
+	if len(name) > 0 && name != u.key() {
+		return nil, ErrPasskeyChallengeInvalid
+	}
+	count, err := verifyAssertion(cred, a)
+	if err == ErrPasskeyCloned {
+		reportSecurityEvent(SecurityEventPasskeyCloned, u.UserName,
+			"credential "+base64.RawURLEncoding.EncodeToString(cred.ID))
+	}
+	if err != nil {
+		return nil, err
+	}
+	sql := "update " + Config.WebAuthnTableName +
+		" set sign_count = ?, last_used = now() where credential_hash = ?"
+	_, err = db.Exec(sql, count,
+		hashToken(base64.RawURLEncoding.EncodeToString(cred.ID)))
+	if err != nil {
+		return nil, err
+	}
+	return newLoginResult(u.key(), "")
+}
+
+// DeletePasskey remove passkey of user, credentialID is base64url
+func DeletePasskey(name string, credentialID string) error {
+	u, err := getUserByName(accountKey("", name))
+	if err != nil {
+		return err
+	}
+	sql := "delete from " + Config.WebAuthnTableName +
+		" where user_id = ? and credential_hash = ?"
+	_, err = db.Exec(sql, u.ID, hashToken(credentialID))
+	return err
+}
+
+func newPasskeyChallenge(value string) (string, error) {
+	challenge, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	err = setTempValue("webauthn_challenge@"+challenge, value,
+		Config.WebAuthnTimeout)
+	if err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+func passkeyDescriptors(creds []passkeyCredential) []PasskeyDescriptor {
+	descriptors := make([]PasskeyDescriptor, 0, len(creds))
+	for i := 0; i < len(creds); i++ {
+		descriptors = append(descriptors, PasskeyDescriptor{"public-key",
+			base64.RawURLEncoding.EncodeToString(creds[i].ID)})
+	}
+	return descriptors
+}
+
+// checkClientData check type and origin of client data
+func checkClientData(data []byte, typ string) (*clientData, error) {
+	var cd clientData
+	if err := json.Unmarshal(data, &cd); err != nil {
+		return nil, ErrPasskeyInvalid
+	}
+	if cd.Type != typ || len(cd.Challenge) == 0 {
+		return nil, ErrPasskeyInvalid
+	}
+	if cd.Origin != Config.WebAuthnOrigin {
+		return nil, ErrPasskeyOriginInvalid
+	}
+	return &cd, nil
+}
+
+// verifyAttestation check attestation object whose format is "none",
+// and return the new credential
+func verifyAttestation(attestationObject []byte) (*passkeyCredential, error) {
+	v, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, ErrPasskeyInvalid
+	}
+	obj, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrPasskeyInvalid
+	}
+	if format, _ := obj["fmt"].(string); format != "none" {
+		return nil, ErrPasskeyAttestation
+	}
+	if stmt, ok := obj["attStmt"].(map[interface{}]interface{}); !ok ||
+		len(stmt) != 0 {
+		return nil, ErrPasskeyAttestation
+	}
+	raw, ok := obj["authData"].([]byte)
+	if !ok {
+		return nil, ErrPasskeyInvalid
+	}
+	ad, err := parseAuthenticatorData(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkAuthenticatorData(ad); err != nil {
+		return nil, err
+	}
+	if ad.Flags&authFlagAttested == 0 {
+		return nil, ErrPasskeyInvalid
+	}
+	if _, _, err = parseCOSEKey(ad.PublicKey); err != nil {
+		return nil, err
+	}
+	return &passkeyCredential{ID: ad.CredentialID,
+		PublicKey: ad.PublicKey, SignCount: ad.SignCount}, nil
+}
+
+// verifyAssertion check signature of assertion by the credential,
+// return the new sign count
+func verifyAssertion(cred *passkeyCredential, a *PasskeyAssertion) (uint32, error) {
+	ad, err := parseAuthenticatorData(a.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	if err = checkAuthenticatorData(ad); err != nil {
+		return 0, err
+	}
+	pub, alg, err := parseCOSEKey(cred.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	hash := sha256.Sum256(a.ClientDataJSON)
+	signed := append(append([]byte{}, a.AuthenticatorData...), hash[:]...)
+	if !verifyCOSESignature(pub, alg, signed, a.Signature) {
+		return 0, ErrPasskeySignature
+	}
+	// authenticator not support counter always return 0,
+	// otherwise counter must increase or the credential has been cloned
+	if ad.SignCount != 0 || cred.SignCount != 0 {
+		if ad.SignCount <= cred.SignCount {
+			return 0, ErrPasskeyCloned
+		}
+	}
+	return ad.SignCount, nil
+}
+
+// checkAuthenticatorData check rp id and user flags
+func checkAuthenticatorData(ad *authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(Config.WebAuthnRPID))
+	if !bytes.Equal(ad.RPIDHash, rpIDHash[:]) {
+		return ErrPasskeyInvalid
+	}
+	if ad.Flags&authFlagUserPresent == 0 {
+		return ErrPasskeyInvalid
+	}
+	if Config.WebAuthnUserVerification == "required" &&
+		ad.Flags&authFlagUserVerified == 0 {
+		return ErrPasskeyInvalid
+	}
+	return nil
+}
+
+// parseAuthenticatorData
+// rpIdHash(32) flags(1) signCount(4) [aaguid(16) idLen(2) id pubKey]
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, ErrPasskeyInvalid
+	}
+	ad := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if ad.Flags&authFlagAttested == 0 {
+		return ad, nil
+	}
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, ErrPasskeyInvalid
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return nil, ErrPasskeyInvalid
+	}
+	ad.CredentialID = rest[:idLen]
+	rest = rest[idLen:]
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, ErrPasskeyInvalid
+	}
+	ad.PublicKey = rest[:len(rest)-len(after)]
+	return ad, nil
+}
+
+// parseCOSEKey parse public key of ES256, EdDSA(Ed25519) or RS256
+func parseCOSEKey(data []byte) (crypto.PublicKey, int64, error) {
+	v, _, err := decodeCBOR(data)
+	if err != nil {
+		return nil, 0, ErrPasskeyKeyInvalid
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, ErrPasskeyKeyInvalid
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, ErrPasskeyKeyInvalid
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(),
+			X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, ErrPasskeyKeyInvalid
+		}
+		return pub, alg, nil
+	case kty == 1 && alg == coseAlgEdDSA:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, ErrPasskeyKeyInvalid
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case kty == 3 && alg == coseAlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, ErrPasskeyKeyInvalid
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64())}, alg, nil
+	}
+	return nil, 0, ErrPasskeyKeyInvalid
+}
+
+func verifyCOSESignature(pub crypto.PublicKey, alg int64, data []byte, sig []byte) bool {
+	switch alg {
+	case coseAlgES256:
+		hash := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), hash[:], sig)
+	case coseAlgEdDSA:
+		return ed25519.Verify(pub.(ed25519.PublicKey), data, sig)
+	case coseAlgRS256:
+		hash := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256,
+			hash[:], sig) == nil
+	}
+	return false
+}
+
+func getPasskeyCredentials(userID int64) ([]passkeyCredential, error) {
+	sql := "select user_id, credential_id, public_key, sign_count from " +
+		Config.WebAuthnTableName + " where user_id = ?"
+	rows, err := db.Query(sql, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var creds []passkeyCredential
+	for rows.Next() {
+		var c passkeyCredential
+		var id string
+		if err = rows.Scan(&c.UserID, &id, &c.PublicKey,
+			&c.SignCount); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		c.ID, err = base64.RawURLEncoding.DecodeString(id)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		creds = append(creds, c)
+	}
+	return creds, nil
+}
+
+// getPasskeyCredential return nil if credential not exist
+func getPasskeyCredential(id []byte) (*passkeyCredential, error) {
+	sql := "select user_id, public_key, sign_count from " +
+		Config.WebAuthnTableName + " where credential_hash = ?"
+	rows, err := db.Query(sql,
+		hashToken(base64.RawURLEncoding.EncodeToString(id)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := passkeyCredential{ID: id}
+		if err = rows.Scan(&c.UserID, &c.PublicKey,
+			&c.SignCount); err == nil {
+			return &c, nil
+		}
+		fmt.Println(err)
+	}
+	return nil, nil
+}
+
+func countPasskeys(userID int64) (int, error) {
+	var count int
+	sql := "select count(*) from " + Config.WebAuthnTableName +
+		" where user_id = ?"
+	err := db.QueryRow(sql, userID).Scan(&count)
+	return count, err
+}
+
+// save passkey credentials of user, credential id can be 1023 bytes
+// so it is found by its hash
+func createWebAuthnTable() error {
+	createStr := "create table " + Config.WebAuthnTableName + "(" +
+		"ID               bigint(20) unsigned NOT NULL AUTO_INCREMENT," +
+		"user_id          bigint(20) unsigned NOT NULL," +
+		"credential_hash  varchar(64) NOT NULL DEFAULT ''," +
+		"credential_id    text NOT NULL," +
+		"public_key       blob NOT NULL," +
+		"sign_count       int(10) unsigned NOT NULL DEFAULT 0," +
+		"created          datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"last_used        datetime NULL DEFAULT NULL," +
+		"PRIMARY KEY (`ID`), " +
+		"UNIQUE KEY `credential_hash` (`credential_hash`), " +
+		"KEY `user_id` (`user_id`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8"
+	_, err := db.Exec(createStr)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package ucenter
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+// cborPair keep the order of map keys when encode
+type cborPair struct {
+	key   interface{}
+	value interface{}
+}
+
+func cborHead(major byte, n int) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 256:
+		return []byte{major<<5 | 24, byte(n)}
+	default:
+		return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+	}
+}
+
+// cborEncode encode the types used by the software authenticator
+func cborEncode(v interface{}) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return cborHead(1, -1-v)
+		}
+		return cborHead(0, v)
+	case []byte:
+		return append(cborHead(2, len(v)), v...)
+	case string:
+		return append(cborHead(3, len(v)), v...)
+	case []cborPair:
+		b := cborHead(5, len(v))
+		for _, p := range v {
+			b = append(b, cborEncode(p.key)...)
+			b = append(b, cborEncode(p.value)...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+// softAuthenticator a passkey authenticator implemented in software
+type softAuthenticator struct {
+	credentialID []byte
+	ecKey        *ecdsa.PrivateKey
+	edKey        ed25519.PrivateKey
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T, ed bool) *softAuthenticator {
+	a := &softAuthenticator{credentialID: make([]byte, 16)}
+	rand.Read(a.credentialID)
+	var err error
+	if ed {
+		_, a.edKey, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		a.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	if a.edKey != nil {
+		return cborEncode([]cborPair{{1, 1}, {3, coseAlgEdDSA}, {-1, 6},
+			{-2, []byte(a.edKey.Public().(ed25519.PublicKey))}})
+	}
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.ecKey.X.FillBytes(x)
+	a.ecKey.Y.FillBytes(y)
+	return cborEncode([]cborPair{{1, 2}, {3, coseAlgES256}, {-1, 1},
+		{-2, x}, {-3, y}})
+}
+
+func (a *softAuthenticator) authData(rpID string, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	flags := byte(authFlagUserPresent | authFlagUserVerified)
+	if attested {
+		flags |= authFlagAttested
+	}
+	data := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...) // aaguid
+		data = append(data, byte(len(a.credentialID)>>8),
+			byte(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func (a *softAuthenticator) clientData(typ, challenge, origin string) []byte {
+	b, _ := json.Marshal(clientData{typ, challenge, origin})
+	return b
+}
+
+func (a *softAuthenticator) create(rpID, origin, challenge string) *PasskeyAttestation {
+	attObj := cborEncode([]cborPair{{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", a.authData(rpID, true)}})
+	return &PasskeyAttestation{
+		a.clientData("webauthn.create", challenge, origin), attObj}
+}
+
+func (a *softAuthenticator) get(rpID, origin, challenge string) *PasskeyAssertion {
+	a.signCount++
+	authData := a.authData(rpID, false)
+	clientDataJSON := a.clientData("webauthn.get", challenge, origin)
+	hash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), hash[:]...)
+	var sig []byte
+	if a.edKey != nil {
+		sig = ed25519.Sign(a.edKey, signed)
+	} else {
+		digest := sha256.Sum256(signed)
+		sig, _ = ecdsa.SignASN1(rand.Reader, a.ecKey, digest[:])
+	}
+	return &PasskeyAssertion{a.credentialID, clientDataJSON, authData, sig}
+}
+
+func TestPasskeyCeremony(t *testing.T) {
+	Config.WebAuthnRPID = "example.com"
+	Config.WebAuthnOrigin = "https://example.com"
+	for _, ed := range []bool{false, true} {
+		a := newSoftAuthenticator(t, ed)
+		att := a.create("example.com", "https://example.com", "challenge")
+		if _, err := checkClientData(att.ClientDataJSON,
+			"webauthn.create"); err != nil {
+			t.Fatal(err)
+		}
+		cred, err := verifyAttestation(att.AttestationObject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(cred.ID) != string(a.credentialID) {
+			t.Fatal("credential id error")
+		}
+
+		as := a.get("example.com", "https://example.com", "challenge2")
+		if _, err = checkClientData(as.ClientDataJSON,
+			"webauthn.get"); err != nil {
+			t.Fatal(err)
+		}
+		count, err := verifyAssertion(cred, as)
+		if err != nil || count != 1 {
+			t.Fatal("verify assertion error", err)
+		}
+		cred.SignCount = count
+
+		// replay old assertion
+		if _, err = verifyAssertion(cred, as); err != ErrPasskeyCloned {
+			t.Fatal("sign count should be checked", err)
+		}
+		// tampered signature
+		as = a.get("example.com", "https://example.com", "challenge3")
+		as.Signature[len(as.Signature)-1] ^= 0xff
+		if _, err = verifyAssertion(cred, as); err != ErrPasskeySignature {
+			t.Fatal("signature should be checked", err)
+		}
+		// another rp
+		as = a.get("evil.com", "https://example.com", "challenge4")
+		if _, err = verifyAssertion(cred, as); err != ErrPasskeyInvalid {
+			t.Fatal("rp id should be checked", err)
+		}
+	}
+
+	a := newSoftAuthenticator(t, false)
+	as := a.get("example.com", "https://evil.com", "challenge")
+	if _, err := checkClientData(as.ClientDataJSON,
+		"webauthn.get"); err != ErrPasskeyOriginInvalid {
+		t.Fatal("origin should be checked", err)
+	}
+}
@@ -0,0 +1,68 @@
+package ucenter
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// weiboBaseURL url of weibo api
+const weiboBaseURL = "https://api.weibo.com"
+
+// WeiboConnector login by weibo, ID of identity is uid of user
+type WeiboConnector struct {
+	AppKey    string
+	AppSecret string
+	// BaseURL of api, default is https://api.weibo.com
+	BaseURL string
+}
+
+// Name of connector is "weibo"
+func (c *WeiboConnector) Name() string {
+	return "weibo"
+}
+
+// AuthCodeURL url of weibo login page
+func (c *WeiboConnector) AuthCodeURL(req *ConnectorRequest) (string, error) {
+	return addQuery(c.baseURL()+"/oauth2/authorize",
+		"response_type", "code", "client_id", c.AppKey,
+		"redirect_uri", req.RedirectURI, "state", req.State), nil
+}
+
+// Identity get uid and screen name of user by code
+func (c *WeiboConnector) Identity(req *ConnectorRequest, code string) (*ExternalIdentity, error) {
+	var token struct {
+		AccessToken string `json:"access_token"`
+		UID         string `json:"uid"`
+	}
+	err := connectorPost(c.baseURL()+"/oauth2/access_token", url.Values{
+		"grant_type": {"authorization_code"}, "client_id": {c.AppKey},
+		"client_secret": {c.AppSecret}, "code": {code},
+		"redirect_uri": {req.RedirectURI}}, &token)
+	if err != nil {
+		return nil, err
+	}
+	if len(token.AccessToken) == 0 || len(token.UID) == 0 {
+		return nil, ErrUpstreamFailed
+	}
+	var info struct {
+		ID         json.Number `json:"id"`
+		ScreenName string      `json:"screen_name"`
+	}
+	err = connectorGet(addQuery(c.baseURL()+"/2/users/show.json",
+		"access_token", token.AccessToken, "uid", token.UID), &info)
+	if err != nil {
+		return nil, err
+	}
+	if info.ID.String() != token.UID {
+		return nil, ErrUpstreamFailed
+	}
+	return &ExternalIdentity{ID: token.UID, Nickname: info.ScreenName}, nil
+}
+
+func (c *WeiboConnector) baseURL() string {
+	if len(c.BaseURL) == 0 {
+		return weiboBaseURL
+	}
+	return strings.TrimRight(c.BaseURL, "/")
+}
@@ -0,0 +1,409 @@
+package ucenter
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// namespaces and algorithms of xml signature
+const (
+	xmlNS             = "http://www.w3.org/XML/1998/namespace"
+	dsigNS            = "http://www.w3.org/2000/09/xmldsig#"
+	excC14NAlgorithm  = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	envelopedSigAlg   = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	rsaSHA256SigAlg   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	ecdsaSHA256SigAlg = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	sha256DigestAlg   = "http://www.w3.org/2001/04/xmlenc#sha256"
+)
+
+// xmlMaxDepth limit nesting of untrusted xml
+const xmlMaxDepth = 64
+
+// xmlNode element of xml tree, prefixes are kept for canonicalization.
+// children are *xmlNode or string of char data
+type xmlNode struct {
+	Prefix   string
+	Local    string
+	Attrs    []xmlAttr
+	NS       map[string]string
+	Children []interface{}
+	Parent   *xmlNode
+}
+
+// xmlAttr attribute which is not namespace declaration
+type xmlAttr struct {
+	Prefix string
+	Local  string
+	Value  string
+}
+
+// parseXML parse document to tree, comments and processing instructions
+// are dropped, doctype is not allowed
+func parseXML(data []byte) (*xmlNode, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var root, cur *xmlNode
+	depth := 0
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, ErrXMLInvalid
+		}
+		switch v := t.(type) {
+		case xml.StartElement:
+			if (root != nil && cur == nil) || depth >= xmlMaxDepth {
+				return nil, ErrXMLInvalid
+			}
+			n := &xmlNode{Prefix: v.Name.Space, Local: v.Name.Local,
+				NS: map[string]string{}, Parent: cur}
+			for _, a := range v.Attr {
+				switch {
+				case a.Name.Space == "xmlns":
+					n.NS[a.Name.Local] = a.Value
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					n.NS[""] = a.Value
+				default:
+					n.Attrs = append(n.Attrs, xmlAttr{a.Name.Space,
+						a.Name.Local, a.Value})
+				}
+			}
+			if cur == nil {
+				root = n
+			} else {
+				cur.Children = append(cur.Children, n)
+			}
+			cur = n
+			depth++
+		case xml.EndElement:
+			// raw token does not check the end element
+			if cur == nil || v.Name.Space != cur.Prefix ||
+				v.Name.Local != cur.Local {
+				return nil, ErrXMLInvalid
+			}
+			cur = cur.Parent
+			depth--
+		case xml.CharData:
+			if cur == nil {
+				if len(bytes.TrimSpace(v)) > 0 {
+					return nil, ErrXMLInvalid
+				}
+				continue
+			}
+			last := len(cur.Children) - 1
+			if last >= 0 {
+				if s, ok := cur.Children[last].(string); ok {
+					cur.Children[last] = s + string(v)
+					continue
+				}
+			}
+			cur.Children = append(cur.Children, string(v))
+		case xml.Directive:
+			return nil, ErrXMLInvalid
+		}
+	}
+	if root == nil || cur != nil {
+		return nil, ErrXMLInvalid
+	}
+	return root, nil
+}
+
+// namespace uri of prefix in scope of element
+func (n *xmlNode) namespace(prefix string) string {
+	if prefix == "xml" {
+		return xmlNS
+	}
+	for e := n; e != nil; e = e.Parent {
+		if uri, ok := e.NS[prefix]; ok {
+			return uri
+		}
+	}
+	return ""
+}
+
+// is element has the namespace and local name
+func (n *xmlNode) is(ns string, local string) bool {
+	return n.Local == local && n.namespace(n.Prefix) == ns
+}
+
+// child the first child element of namespace and local name
+func (n *xmlNode) child(ns string, local string) *xmlNode {
+	list := n.children(ns, local)
+	if len(list) == 0 {
+		return nil
+	}
+	return list[0]
+}
+
+// children child elements of namespace and local name
+func (n *xmlNode) children(ns string, local string) []*xmlNode {
+	var ret []*xmlNode
+	for _, c := range n.Children {
+		if e, ok := c.(*xmlNode); ok && e.is(ns, local) {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// attr value of attribute without prefix
+func (n *xmlNode) attr(local string) string {
+	for _, a := range n.Attrs {
+		if len(a.Prefix) == 0 && a.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// text char data of element
+func (n *xmlNode) text() string {
+	var b strings.Builder
+	for _, c := range n.Children {
+		if s, ok := c.(string); ok {
+			b.WriteString(s)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// walk call f for element and all its descendants
+func (n *xmlNode) walk(f func(*xmlNode)) {
+	f(n)
+	for _, c := range n.Children {
+		if e, ok := c.(*xmlNode); ok {
+			e.walk(f)
+		}
+	}
+}
+
+// canonicalize element by exclusive xml canonicalization without
+// comments, prefixes in inclusive are rendered as inclusive c14n.
+// exclude is removed by enveloped signature transform
+func canonicalize(n *xmlNode, inclusive []string, exclude *xmlNode) []byte {
+	var b bytes.Buffer
+	writeC14N(&b, n, map[string]string{}, inclusive, exclude)
+	return b.Bytes()
+}
+
+func writeC14N(b *bytes.Buffer, n *xmlNode, rendered map[string]string,
+	inclusive []string, exclude *xmlNode) {
+	// namespaces visibly utilized by element and its attributes
+	prefixes := []string{n.Prefix}
+	for _, a := range n.Attrs {
+		if len(a.Prefix) > 0 && a.Prefix != "xml" {
+			prefixes = append(prefixes, a.Prefix)
+		}
+	}
+	for _, p := range inclusive {
+		if p == "#default" {
+			p = ""
+		}
+		if len(n.namespace(p)) > 0 {
+			prefixes = append(prefixes, p)
+		}
+	}
+	decls := map[string]string{}
+	for _, p := range prefixes {
+		uri := n.namespace(p)
+		old, ok := rendered[p]
+		if (ok && old == uri) || (!ok && len(uri) == 0) {
+			continue
+		}
+		decls[p] = uri
+	}
+	var declPrefixes []string
+	for p := range decls {
+		declPrefixes = append(declPrefixes, p)
+	}
+	sort.Strings(declPrefixes)
+	attrs := make([]xmlAttr, len(n.Attrs))
+	copy(attrs, n.Attrs)
+	sort.Slice(attrs, func(i, j int) bool {
+		ni, nj := "", ""
+		if len(attrs[i].Prefix) > 0 {
+			ni = n.namespace(attrs[i].Prefix)
+		}
+		if len(attrs[j].Prefix) > 0 {
+			nj = n.namespace(attrs[j].Prefix)
+		}
+		if ni != nj {
+			return ni < nj
+		}
+		return attrs[i].Local < attrs[j].Local
+	})
+
+	b.WriteString("<" + xmlQName(n.Prefix, n.Local))
+	if len(decls) > 0 {
+		scope := make(map[string]string, len(rendered)+len(decls))
+		for p, uri := range rendered {
+			scope[p] = uri
+		}
+		for _, p := range declPrefixes {
+			if len(p) == 0 {
+				b.WriteString(` xmlns="`)
+			} else {
+				b.WriteString(` xmlns:` + p + `="`)
+			}
+			b.WriteString(escapeC14NAttr(decls[p]) + `"`)
+			scope[p] = decls[p]
+		}
+		rendered = scope
+	}
+	for _, a := range attrs {
+		b.WriteString(" " + xmlQName(a.Prefix, a.Local) + `="` +
+			escapeC14NAttr(a.Value) + `"`)
+	}
+	b.WriteString(">")
+	for _, c := range n.Children {
+		switch v := c.(type) {
+		case string:
+			b.WriteString(escapeC14NText(v))
+		case *xmlNode:
+			if v != exclude {
+				writeC14N(b, v, rendered, inclusive, exclude)
+			}
+		}
+	}
+	b.WriteString("</" + xmlQName(n.Prefix, n.Local) + ">")
+}
+
+func xmlQName(prefix string, local string) string {
+	if len(prefix) == 0 {
+		return local
+	}
+	return prefix + ":" + local
+}
+
+var c14nTextReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;",
+	">", "&gt;", "\r", "&#xD;")
+
+var c14nAttrReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;",
+	`"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+
+func escapeC14NText(s string) string {
+	return c14nTextReplacer.Replace(s)
+}
+
+func escapeC14NAttr(s string) string {
+	return c14nAttrReplacer.Replace(s)
+}
+
+// verifyXMLSignature verify enveloped signature of element by cert,
+// the signature must reference the element by its ID. KeyInfo in
+// signature is ignored
+func verifyXMLSignature(n *xmlNode, cert *x509.Certificate) error {
+	sig := n.child(dsigNS, "Signature")
+	if sig == nil {
+		return ErrXMLSignatureInvalid
+	}
+	info := sig.child(dsigNS, "SignedInfo")
+	if info == nil {
+		return ErrXMLSignatureInvalid
+	}
+	method := info.child(dsigNS, "CanonicalizationMethod")
+	if method == nil || method.attr("Algorithm") != excC14NAlgorithm {
+		return ErrXMLSignatureInvalid
+	}
+	refs := info.children(dsigNS, "Reference")
+	id := n.attr("ID")
+	if len(refs) != 1 || len(id) == 0 || refs[0].attr("URI") != "#"+id {
+		return ErrXMLSignatureInvalid
+	}
+	// transforms must be enveloped signature and exclusive c14n
+	var inclusive []string
+	c14n := false
+	if transforms := refs[0].child(dsigNS, "Transforms"); transforms != nil {
+		for _, t := range transforms.children(dsigNS, "Transform") {
+			switch t.attr("Algorithm") {
+			case envelopedSigAlg:
+			case excC14NAlgorithm:
+				c14n = true
+				inclusive = inclusiveNamespaces(t)
+			default:
+				return ErrXMLSignatureInvalid
+			}
+		}
+	}
+	if !c14n {
+		return ErrXMLSignatureInvalid
+	}
+	digestMethod := refs[0].child(dsigNS, "DigestMethod")
+	digestValue := refs[0].child(dsigNS, "DigestValue")
+	if digestMethod == nil || digestValue == nil ||
+		digestMethod.attr("Algorithm") != sha256DigestAlg {
+		return ErrXMLSignatureInvalid
+	}
+	expected, err := decodeXMLBase64(digestValue.text())
+	if err != nil {
+		return ErrXMLSignatureInvalid
+	}
+	digest := sha256.Sum256(canonicalize(n, inclusive, sig))
+	if subtle.ConstantTimeCompare(digest[:], expected) != 1 {
+		return ErrXMLSignatureInvalid
+	}
+
+	value := sig.child(dsigNS, "SignatureValue")
+	sigMethod := info.child(dsigNS, "SignatureMethod")
+	if value == nil || sigMethod == nil {
+		return ErrXMLSignatureInvalid
+	}
+	signature, err := decodeXMLBase64(value.text())
+	if err != nil {
+		return ErrXMLSignatureInvalid
+	}
+	hashed := sha256.Sum256(canonicalize(info, inclusiveNamespaces(method), nil))
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if sigMethod.attr("Algorithm") != rsaSHA256SigAlg ||
+			rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], signature) != nil {
+			return ErrXMLSignatureInvalid
+		}
+	case *ecdsa.PublicKey:
+		// signature is r and s of same length
+		if sigMethod.attr("Algorithm") != ecdsaSHA256SigAlg ||
+			len(signature) == 0 || len(signature)%2 != 0 {
+			return ErrXMLSignatureInvalid
+		}
+		r := new(big.Int).SetBytes(signature[:len(signature)/2])
+		s := new(big.Int).SetBytes(signature[len(signature)/2:])
+		if !ecdsa.Verify(pub, hashed[:], r, s) {
+			return ErrXMLSignatureInvalid
+		}
+	default:
+		return ErrXMLSignatureInvalid
+	}
+	return nil
+}
+
+// inclusiveNamespaces PrefixList of exclusive c14n
+func inclusiveNamespaces(method *xmlNode) []string {
+	e := method.child(excC14NAlgorithm, "InclusiveNamespaces")
+	if e == nil {
+		return nil
+	}
+	return strings.Fields(e.attr("PrefixList"))
+}
+
+// decodeXMLBase64 base64 in xml may contain line breaks
+func decodeXMLBase64(s string) ([]byte, error) {
+	s = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+	return base64.StdEncoding.DecodeString(s)
+}